@@ -0,0 +1,204 @@
+package timeseries
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// AggregateFunc is an aggregation which is applied per time bucket
+type AggregateFunc string
+
+const (
+	AggregateAvg   AggregateFunc = "avg"
+	AggregateMin   AggregateFunc = "min"
+	AggregateMax   AggregateFunc = "max"
+	AggregateSum   AggregateFunc = "sum"
+	AggregateCount AggregateFunc = "count"
+	AggregateFirst AggregateFunc = "first"
+	AggregateLast  AggregateFunc = "last"
+)
+
+// Bucket holds the aggregated values of one time bucket in the order of the
+// requested functions. Values are NaN if the bucket has no values.
+type Bucket struct {
+	Time   time.Time
+	Values []float64
+}
+
+// AggregateResult contains the buckets of one tag ordered by time
+type AggregateResult struct {
+	Tag     string
+	Bucket  time.Duration
+	Funcs   []AggregateFunc
+	Buckets []Bucket
+}
+
+// Value returns the aggregated value of f in bucket i
+func (r AggregateResult) Value(i int, f AggregateFunc) float64 {
+	for index, function := range r.Funcs {
+		if function == f {
+			return r.Buckets[i].Values[index]
+		}
+	}
+	return math.NaN()
+}
+
+// Fill returns the result with a bucket for every interval in [from, to).
+// Missing buckets have a count of 0 and NaN for all other functions.
+func (r AggregateResult) Fill(from time.Time, to time.Time) AggregateResult {
+	filled := r
+	filled.Buckets = nil
+	existing := make(map[int64]Bucket, len(r.Buckets))
+	for _, bucket := range r.Buckets {
+		existing[bucket.Time.Unix()] = bucket
+	}
+	for t := bucketStart(from, r.Bucket); t.Before(to); t = t.Add(r.Bucket) {
+		if bucket, ok := existing[t.Unix()]; ok {
+			filled.Buckets = append(filled.Buckets, bucket)
+			continue
+		}
+		bucket := Bucket{Time: t, Values: make([]float64, len(r.Funcs))}
+		for i, f := range r.Funcs {
+			bucket.Values[i] = math.NaN()
+			if f == AggregateCount {
+				bucket.Values[i] = 0
+			}
+		}
+		filled.Buckets = append(filled.Buckets, bucket)
+	}
+	return filled
+}
+
+// bucketStart returns the start of the bucket containing t, buckets are
+// aligned to the unix epoch.
+func bucketStart(t time.Time, bucket time.Duration) time.Time {
+	seconds := int64(bucket / time.Second)
+	unix := t.Unix()
+	start := unix - unix%seconds
+	if unix%seconds < 0 {
+		start -= seconds
+	}
+	return time.Unix(start, 0).UTC()
+}
+
+// Aggregate calculates funcs (avg if none is given) for tag in time buckets
+// of [from, to). Buckets are aligned to the unix epoch and must be whole
+// seconds. It uses time_bucket on TimescaleDB and epoch arithmetic on plain
+// postgres and sqlite, all of them return the same buckets.
+func (dbh *DbHandler) Aggregate(table string, tag string, from time.Time, to time.Time, bucket time.Duration, funcs ...AggregateFunc) (AggregateResult, error) {
+	return dbh.AggregateContext(context.Background(), table, tag, from, to, bucket, funcs...)
+}
+
+// AggregateContext calculates funcs for tag in time buckets, see Aggregate.
+func (dbh *DbHandler) AggregateContext(ctx context.Context, table string, tag string, from time.Time, to time.Time, bucket time.Duration, funcs ...AggregateFunc) (AggregateResult, error) {
+	logFields := log.Fields{"package": logPkg, "func": "Aggregate"}
+	if len(funcs) == 0 {
+		funcs = []AggregateFunc{AggregateAvg}
+	}
+	result := AggregateResult{Tag: tag, Bucket: bucket, Funcs: funcs}
+	if bucket < time.Second || bucket%time.Second != 0 {
+		return result, fmt.Errorf("bucket %v is not a multiple of seconds", bucket)
+	}
+	hasTimescale, err := dbh.HasTimescaleDBContext(ctx)
+	if err != nil {
+		return result, err
+	}
+	sqlStr, err := dbh.aggregateQuery(table, int64(bucket/time.Second), funcs, hasTimescale)
+	if err != nil {
+		return result, err
+	}
+	log.WithFields(logFields).Tracef("Aggregate query: %s", sqlStr)
+
+	rows, err := dbh.ExecuteQueryContext(ctx, sqlStr, tag, FormatTimestamp(from), FormatTimestamp(to))
+	if err != nil {
+		log.WithFields(logFields).Errorf("Failed to aggregate %s: %v", tag, err)
+		return result, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var start int64
+		values := make([]*float64, len(funcs))
+		dest := []any{&start}
+		for i := range values {
+			dest = append(dest, &values[i])
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return result, err
+		}
+		b := Bucket{Time: time.Unix(start, 0).UTC(), Values: make([]float64, len(funcs))}
+		for i, value := range values {
+			b.Values[i] = math.NaN()
+			if value != nil {
+				b.Values[i] = *value
+			}
+		}
+		result.Buckets = append(result.Buckets, b)
+	}
+	return result, rows.Err()
+}
+
+// aggregateQuery builds a query returning the bucket start (unix seconds)
+// followed by one column per function. The arguments are tag, from and to.
+func (dbh *DbHandler) aggregateQuery(table string, seconds int64, funcs []AggregateFunc, hasTimescale bool) (string, error) {
+	quoted, err := dbh.quoteIdentifier(table)
+	if err != nil {
+		return "", err
+	}
+	n := strconv.FormatInt(seconds, 10)
+	where := " FROM " + quoted + " WHERE tag = " + dbh.placeholder(1) +
+		" AND time >= " + dbh.placeholder(2) + " AND time < " + dbh.placeholder(3)
+
+	columns := make([]string, 0, len(funcs))
+	if hasTimescale {
+		for _, f := range funcs {
+			switch f {
+			case AggregateFirst, AggregateLast:
+				columns = append(columns, string(f)+"(value, time)")
+			case AggregateAvg, AggregateMin, AggregateMax, AggregateSum, AggregateCount:
+				columns = append(columns, string(f)+"(value)")
+			default:
+				return "", fmt.Errorf("unknown aggregate function %q", f)
+			}
+		}
+		bucket := "time_bucket(make_interval(secs => " + n + "), time, TIMESTAMP '1970-01-01')"
+		return "SELECT extract(epoch FROM " + bucket + ")::bigint AS bucket, " +
+			strings.Join(columns, ", ") + where + " GROUP BY 1 ORDER BY 1", nil
+	}
+
+	// the epoch is taken in whole milliseconds from julianday so fractional
+	// seconds don't depend on how strftime rounds, the modulo floors times
+	// before 1970 since integer division truncates towards zero
+	unixMs := "CAST(round((julianday(time) - 2440587.5) * 86400000) AS INTEGER)"
+	ms := strconv.FormatInt(seconds*1000, 10)
+	bucket := "((" + unixMs + " - ((" + unixMs + " % " + ms + ") + " + ms + ") % " + ms + ") / 1000)"
+	if dbh.conf.UsePostgres {
+		bucket = "(floor(extract(epoch FROM time) / " + n + ") * " + n + ")::bigint"
+	}
+	window := ""
+	for _, f := range funcs {
+		switch f {
+		case AggregateFirst, AggregateLast:
+			// all rows of a bucket have the same first and last value
+			columns = append(columns, "max("+string(f)+"_value)")
+			window = " OVER (PARTITION BY " + bucket + " ORDER BY time" +
+				" ROWS BETWEEN UNBOUNDED PRECEDING AND UNBOUNDED FOLLOWING)"
+		case AggregateAvg, AggregateMin, AggregateMax, AggregateSum, AggregateCount:
+			columns = append(columns, string(f)+"(value)")
+		default:
+			return "", fmt.Errorf("unknown aggregate function %q", f)
+		}
+	}
+	inner := "SELECT " + bucket + " AS bucket, value"
+	if len(window) > 0 {
+		inner += ", first_value(value)" + window + " AS first_value" +
+			", last_value(value)" + window + " AS last_value"
+	}
+	return "SELECT bucket, " + strings.Join(columns, ", ") +
+		" FROM (" + inner + where + ") AS buckets GROUP BY bucket ORDER BY bucket", nil
+}
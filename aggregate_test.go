@@ -0,0 +1,133 @@
+package timeseries
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestAggregate(t *testing.T) {
+	t.Parallel()
+	dbh := newTestDbHandler(t)
+	start := time.Date(2023, 3, 1, 0, 0, 0, 0, time.UTC)
+	series := Series{Tag: "power"}
+	// 3 hours with a value every 10 minutes, the second hour is missing
+	for i := 0; i < 18; i++ {
+		if i >= 6 && i < 12 {
+			continue
+		}
+		value := float64(i)
+		if i == 14 {
+			value = math.NaN()
+		}
+		series.Points = append(series.Points, Point{Time: start.Add(time.Duration(i*10)*time.Minute + 500*time.Millisecond), Value: value})
+	}
+	if err := dbh.InsertSeries([]Series{series}, false, DefaultTimeseriesTable); err != nil {
+		t.Fatalf("Failed to insert: %v", err)
+	}
+
+	funcs := []AggregateFunc{AggregateAvg, AggregateMin, AggregateMax, AggregateSum, AggregateCount, AggregateFirst, AggregateLast}
+	result, err := dbh.Aggregate(DefaultTimeseriesTable, "power", start, start.Add(3*time.Hour), time.Hour, funcs...)
+	if err != nil {
+		t.Fatalf("Failed to aggregate: %v", err)
+	}
+	if len(result.Buckets) != 2 {
+		t.Fatalf("Expected 2 buckets but got %+v", result.Buckets)
+	}
+	expected := map[AggregateFunc][]float64{
+		AggregateAvg:   {2.5, 14.6},
+		AggregateMin:   {0, 12},
+		AggregateMax:   {5, 17},
+		AggregateSum:   {15, 73},
+		AggregateCount: {6, 5},
+		AggregateFirst: {0, 12},
+		AggregateLast:  {5, 17},
+	}
+	for f, values := range expected {
+		for i, value := range values {
+			if got := result.Value(i, f); math.Abs(got-value) > 1e-9 {
+				t.Errorf("Expected %s of bucket %d to be %v but got %v", f, i, value, got)
+			}
+		}
+	}
+	if !result.Buckets[1].Time.Equal(start.Add(2 * time.Hour)) {
+		t.Errorf("Unexpected bucket time %v", result.Buckets[1].Time)
+	}
+
+	filled := result.Fill(start, start.Add(3*time.Hour))
+	if len(filled.Buckets) != 3 || filled.Value(1, AggregateCount) != 0 || !math.IsNaN(filled.Value(1, AggregateAvg)) {
+		t.Errorf("Unexpected filled buckets %+v", filled.Buckets)
+	}
+
+	if _, err := dbh.Aggregate(DefaultTimeseriesTable, "power", start, start.Add(time.Hour), time.Millisecond); err == nil {
+		t.Errorf("Expected error for sub second bucket")
+	}
+	if _, err := dbh.Aggregate(DefaultTimeseriesTable, "power", start, start.Add(time.Hour), time.Hour, "median"); err == nil {
+		t.Errorf("Expected error for unknown function")
+	}
+}
+
+func TestBucketStart(t *testing.T) {
+	ts := time.Date(2023, 3, 1, 10, 47, 12, 0, time.UTC)
+	if b := bucketStart(ts, 15*time.Minute); !b.Equal(time.Date(2023, 3, 1, 10, 45, 0, 0, time.UTC)) {
+		t.Errorf("Unexpected bucket start %v", b)
+	}
+	if b := bucketStart(ts, 24*time.Hour); !b.Equal(time.Date(2023, 3, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Unexpected bucket start %v", b)
+	}
+}
+
+func TestAggregateBeforeEpoch(t *testing.T) {
+	t.Parallel()
+	dbh := newTestDbHandler(t)
+	start := time.Date(1969, 12, 31, 22, 0, 0, 0, time.UTC)
+	series := Series{Tag: "old"}
+	for i := 0; i < 4; i++ {
+		series.Points = append(series.Points, Point{Time: start.Add(time.Duration(i*30+10) * time.Minute), Value: float64(i)})
+	}
+	if err := dbh.InsertSeries([]Series{series}, false, DefaultTimeseriesTable); err != nil {
+		t.Fatalf("Failed to insert: %v", err)
+	}
+	result, err := dbh.Aggregate(DefaultTimeseriesTable, "old", start, start.Add(2*time.Hour), time.Hour, AggregateCount)
+	if err != nil {
+		t.Fatalf("Failed to aggregate: %v", err)
+	}
+	if len(result.Buckets) != 2 || !result.Buckets[0].Time.Equal(start) || !result.Buckets[1].Time.Equal(start.Add(time.Hour)) ||
+		result.Value(0, AggregateCount) != 2 || result.Value(1, AggregateCount) != 2 {
+		t.Errorf("Expected buckets at 22:00 and 23:00 with 2 points but got %+v", result.Buckets)
+	}
+	if b := bucketStart(start.Add(10*time.Minute), time.Hour); !b.Equal(start) {
+		t.Errorf("Unexpected bucket start %v", b)
+	}
+}
+
+func TestAggregateBeforeEpochFractional(t *testing.T) {
+	t.Parallel()
+	dbh := newTestDbHandler(t)
+	epoch := time.Unix(0, 0).UTC()
+	series := Series{Tag: "edge", Points: []Point{
+		{Time: epoch.Add(-1500 * time.Millisecond), Value: 1},
+		{Time: epoch.Add(-500 * time.Millisecond), Value: 2},
+		{Time: epoch, Value: 3},
+		{Time: epoch.Add(500 * time.Millisecond), Value: 4},
+	}}
+	if err := dbh.InsertSeries([]Series{series}, false, DefaultTimeseriesTable); err != nil {
+		t.Fatalf("Failed to insert: %v", err)
+	}
+	result, err := dbh.Aggregate(DefaultTimeseriesTable, "edge", epoch.Add(-2*time.Second), epoch.Add(time.Second), time.Second, AggregateSum)
+	if err != nil {
+		t.Fatalf("Failed to aggregate: %v", err)
+	}
+	expected := []struct {
+		start time.Time
+		sum   float64
+	}{{epoch.Add(-2 * time.Second), 1}, {epoch.Add(-time.Second), 2}, {epoch, 7}}
+	if len(result.Buckets) != len(expected) {
+		t.Fatalf("Expected %d buckets but got %+v", len(expected), result.Buckets)
+	}
+	for i, e := range expected {
+		if !result.Buckets[i].Time.Equal(e.start) || result.Value(i, AggregateSum) != e.sum {
+			t.Errorf("Expected bucket %v with sum %v but got %+v", e.start, e.sum, result.Buckets[i])
+		}
+	}
+}
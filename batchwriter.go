@@ -0,0 +1,312 @@
+package timeseries
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrBatchWriterClosed is returned by writes after Close
+var ErrBatchWriterClosed = errors.New("batch writer is closed")
+
+// BatchWriterConfig configures NewBatchWriter
+type BatchWriterConfig struct {
+	BatchSize           int           // pending points or rows of a table which trigger a flush, 1000 if 0
+	Interval            time.Duration // longest time a write is pending, 1s if 0
+	QueueSize           int           // writes which can be queued before writes block, 10000 if 0
+	OnConflictDoNothing bool          // timeseries tables: skip points which already exist (needs a unique key)
+	// OnError is called when a batch couldn't be written. After temporary
+	// errors (timeouts, lost connections, a locked database) the batch is
+	// kept and retried with the next interval, at most QueueSize points and
+	// rows per table are kept. Otherwise the batch is dropped, invalid rows of
+	// wide tables are dropped alone and reported with an InvalidRowsError.
+	// Errors are logged if it is nil. OnError runs on the goroutine of the
+	// writer, it must not call Close or Flush which wait for that goroutine.
+	OnError func(table string, err error)
+}
+
+// BatchWriter collects points of timeseries tables and rows of wide tables
+// and writes them per table with multi-row inserts when BatchSize is reached
+// or Interval passed. Writes block while the queue is full, so a slow
+// database slows the writers down instead of using more and more memory.
+type BatchWriter struct {
+	dbh   *DbHandler
+	conf  BatchWriterConfig
+	queue chan batchItem
+	done  chan struct{}
+
+	mutex  sync.RWMutex // protects closed and sending on queue
+	closed bool
+	err    error // first error of the final flush
+}
+
+// batchItem is a write or, if flushed is set, a flush request
+type batchItem struct {
+	table   string
+	points  []Point
+	row     *ImportRowStruct
+	flushed chan error
+}
+
+// pendingTable contains the pending writes of a table
+type pendingTable struct {
+	points  []Point
+	rows    []ImportRowStruct
+	failing bool // the last flush failed, retry with the next interval
+}
+
+func (p *pendingTable) len() int {
+	return len(p.points) + len(p.rows)
+}
+
+// NewBatchWriter starts a BatchWriter for dbh, it must be closed to write
+// the pending points.
+func NewBatchWriter(dbh *DbHandler, conf BatchWriterConfig) *BatchWriter {
+	if conf.BatchSize <= 0 {
+		conf.BatchSize = 1000
+	}
+	if conf.Interval <= 0 {
+		conf.Interval = time.Second
+	}
+	if conf.QueueSize <= 0 {
+		conf.QueueSize = 10000
+	}
+	w := &BatchWriter{
+		dbh:   dbh,
+		conf:  conf,
+		queue: make(chan batchItem, conf.QueueSize),
+		done:  make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+// WritePoints queues points for a timeseries table
+func (w *BatchWriter) WritePoints(table string, points ...Point) error {
+	return w.WritePointsContext(context.Background(), table, points...)
+}
+
+// WritePointsContext queues points for a timeseries table, it waits while
+// the queue is full until ctx is done.
+func (w *BatchWriter) WritePointsContext(ctx context.Context, table string, points ...Point) error {
+	if len(points) == 0 {
+		return nil
+	}
+	return w.enqueue(ctx, batchItem{table: table, points: points})
+}
+
+// WriteRow queues a row for a wide table like InsertRowToTable
+func (w *BatchWriter) WriteRow(table string, row ImportRowStruct) error {
+	return w.WriteRowContext(context.Background(), table, row)
+}
+
+// WriteRowContext queues a row for a wide table, it waits while the queue is
+// full until ctx is done.
+func (w *BatchWriter) WriteRowContext(ctx context.Context, table string, row ImportRowStruct) error {
+	return w.enqueue(ctx, batchItem{table: table, row: &row})
+}
+
+// Flush writes everything which was queued before and returns the first error
+func (w *BatchWriter) Flush() error {
+	return w.FlushContext(context.Background())
+}
+
+// FlushContext writes everything which was queued before, see Flush.
+func (w *BatchWriter) FlushContext(ctx context.Context) error {
+	flushed := make(chan error, 1)
+	if err := w.enqueue(ctx, batchItem{flushed: flushed}); err != nil {
+		return err
+	}
+	select {
+	case err := <-flushed:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close stops accepting writes, writes all pending points and rows and
+// returns the first error of this final flush. Writes which fail then are
+// dropped.
+func (w *BatchWriter) Close() error {
+	w.mutex.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.queue)
+	}
+	w.mutex.Unlock()
+	<-w.done
+	return w.err
+}
+
+func (w *BatchWriter) enqueue(ctx context.Context, item batchItem) error {
+	w.mutex.RLock()
+	defer w.mutex.RUnlock()
+	if w.closed {
+		return ErrBatchWriterClosed
+	}
+	select {
+	case w.queue <- item:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// run collects the queued writes until the queue is closed
+func (w *BatchWriter) run() {
+	defer close(w.done)
+	ticker := time.NewTicker(w.conf.Interval)
+	defer ticker.Stop()
+	pending := make(map[string]*pendingTable)
+	var order []string // tables in the order of their first write
+	for {
+		select {
+		case item, ok := <-w.queue:
+			if !ok {
+				w.err = w.flushAll(pending, order)
+				return
+			}
+			if item.flushed != nil {
+				item.flushed <- w.flushAll(pending, order)
+				continue
+			}
+			p := pending[item.table]
+			if p == nil {
+				p = &pendingTable{}
+				pending[item.table] = p
+				order = append(order, item.table)
+			}
+			if item.row != nil {
+				p.rows = append(p.rows, *item.row)
+			} else {
+				p.points = append(p.points, item.points...)
+			}
+			if p.len() >= w.conf.BatchSize && !p.failing {
+				w.flush(item.table, p)
+			}
+		case <-ticker.C:
+			w.flushAll(pending, order)
+		}
+	}
+}
+
+// flushAll writes the pending writes of all tables and returns the first error
+func (w *BatchWriter) flushAll(pending map[string]*pendingTable, order []string) error {
+	var first error
+	for _, table := range order {
+		if err := w.flush(table, pending[table]); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// flush writes the pending writes of a table. Writes which failed with a
+// temporary error are kept for the next flush.
+func (w *BatchWriter) flush(table string, p *pendingTable) error {
+	logFields := log.Fields{"package": logPkg, "func": "BatchWriter"}
+	if p.len() == 0 {
+		return nil
+	}
+	var first error
+	report := func(err error, count int) {
+		if first == nil {
+			first = err
+		}
+		if w.conf.OnError != nil {
+			w.conf.OnError(table, err)
+		} else {
+			log.WithFields(logFields).Errorf("Failed to write %d points and rows into %s: %v", count, table, err)
+		}
+	}
+	// the writes are flushed even if the writer of the points gave up
+	ctx := context.Background()
+	var retryPoints []Point
+	if len(p.points) > 0 {
+		if err := w.dbh.InsertPointsContext(ctx, p.points, w.conf.OnConflictDoNothing, table); err != nil {
+			report(err, len(p.points))
+			if isTemporaryError(err) {
+				retryPoints = p.points
+			}
+		}
+	}
+	// rows with the same columns are written together
+	var groups [][]ImportRowStruct
+	index := make(map[string]int)
+	for _, row := range p.rows {
+		key := strings.Join(row.Names, "\x00")
+		if i, ok := index[key]; ok {
+			groups[i] = append(groups[i], row)
+			continue
+		}
+		index[key] = len(groups)
+		groups = append(groups, []ImportRowStruct{row})
+	}
+	var retryRows []ImportRowStruct
+	for _, rows := range groups {
+		err := w.dbh.insertWideRows(ctx, table, rows[0].Names, rows)
+		var invalid *InvalidRowsError
+		switch {
+		case err == nil:
+		case errors.As(err, &invalid):
+			report(err, len(invalid.Rows))
+		default:
+			report(err, len(rows))
+			if isTemporaryError(err) {
+				retryRows = append(retryRows, rows...)
+			}
+		}
+	}
+	if first == nil {
+		log.WithFields(logFields).Tracef("Wrote %d points and rows into %s", p.len(), table)
+	}
+
+	p.points = append(p.points[:0:0], retryPoints...)
+	p.rows = retryRows
+	p.failing = p.len() > 0
+	// the oldest failed writes are dropped
+	if over := p.len() - w.conf.QueueSize; over > 0 {
+		dropPoints := over
+		if dropPoints > len(p.points) {
+			dropPoints = len(p.points)
+		}
+		p.points = p.points[dropPoints:]
+		p.rows = p.rows[over-dropPoints:]
+		w.dbh.metrics.addFailedRows(table, over)
+		report(fmt.Errorf("dropped %d points and rows of %s after failed writes: %w", over, table, first), over)
+	}
+	return first
+}
+
+// isTemporaryError reports whether a write may succeed when it is retried
+func isTemporaryError(err error) bool {
+	if errors.Is(err, ErrTimeout) || errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, driver.ErrBadConn) || errors.Is(err, sql.ErrConnDone) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code.Class() {
+		case "08", "40", "53", "57": // connection, rollback, resources, operator intervention
+			return true
+		}
+		return false
+	}
+	// sqlite reports SQLITE_BUSY and SQLITE_LOCKED as text
+	message := strings.ToLower(err.Error())
+	return strings.Contains(message, "database is locked") || strings.Contains(message, "sqlite_busy")
+}
@@ -0,0 +1,183 @@
+package timeseries
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBatchWriter(t *testing.T) {
+	t.Parallel()
+	dbh := newTestDbHandler(t)
+	var failed []string
+	w := NewBatchWriter(dbh, BatchWriterConfig{BatchSize: 3, Interval: time.Hour,
+		OnError: func(table string, err error) { failed = append(failed, table) }})
+
+	start := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 4; i++ {
+		point := Point{Time: start.Add(time.Duration(i) * time.Second), Tag: "batch", Value: float64(i)}
+		if err := w.WritePoints(DefaultTimeseriesTable, point); err != nil {
+			t.Fatalf("Failed to write: %v", err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		row := ImportRowStruct{Names: []string{"Temperature", "Room"},
+			Timestamp: FormatTimestamp(start.Add(time.Duration(i) * time.Second)), Values: []string{"20.5", "living"}}
+		if err := w.WriteRow("living", row); err != nil {
+			t.Fatalf("Failed to write row: %v", err)
+		}
+	}
+	// the batch size was reached once, the fourth point is pending
+	if err := w.Flush(); err != nil {
+		t.Fatalf("Failed to flush: %v", err)
+	}
+	if n := countRows(t, dbh, "measurements WHERE tag = 'batch'"); n != 4 {
+		t.Errorf("Expected 4 points but got %d", n)
+	}
+	// wide rows keep the Fetched column of InsertRowToTable
+	if n := countRows(t, dbh, "living WHERE Fetched = 0 AND Room = 'living'"); n != 2 {
+		t.Errorf("Expected 2 rows but got %d", n)
+	}
+
+	if err := w.WriteRow("living", ImportRowStruct{Names: []string{"Temperature"}, Timestamp: "2023-06-01 12:00:05"}); err != nil {
+		t.Fatalf("Failed to write row: %v", err)
+	}
+	if err := w.Flush(); err == nil || len(failed) != 1 || failed[0] != "living" {
+		t.Errorf("Expected error for row without values but got %v, %v", err, failed)
+	}
+
+	// Close writes the pending points
+	if err := w.WritePoints(DefaultTimeseriesTable, Point{Time: start.Add(time.Minute), Tag: "batch", Value: 5}); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+	if n := countRows(t, dbh, "measurements WHERE tag = 'batch'"); n != 5 {
+		t.Errorf("Expected 5 points after close but got %d", n)
+	}
+	if err := w.WritePoints(DefaultTimeseriesTable, Point{Time: start, Tag: "batch"}); !errors.Is(err, ErrBatchWriterClosed) {
+		t.Errorf("Expected closed error but got %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Errorf("Expected second close to succeed but got %v", err)
+	}
+}
+
+func TestBatchWriterInterval(t *testing.T) {
+	t.Parallel()
+	dbh := newTestDbHandler(t)
+	w := NewBatchWriter(dbh, BatchWriterConfig{Interval: 20 * time.Millisecond})
+	defer w.Close()
+	if err := w.WritePoints(DefaultTimeseriesTable, Point{Time: time.Now(), Tag: "interval", Value: 1}); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for countRows(t, dbh, "measurements WHERE tag = 'interval'") != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Point wasn't flushed after the interval")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestBatchWriterBackpressure(t *testing.T) {
+	t.Parallel()
+	dbh := newTestDbHandler(t)
+	w := NewBatchWriter(dbh, BatchWriterConfig{BatchSize: 1, QueueSize: 1, Interval: time.Hour})
+
+	// hold the database lock so the writer blocks in the first flush
+	release := make(chan struct{})
+	locked := make(chan struct{})
+	go dbh.execute(context.Background(), func() error {
+		close(locked)
+		<-release
+		return nil
+	})
+	<-locked
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	written := 0
+	var err error
+	for ; written < 5 && err == nil; written++ {
+		err = w.WritePointsContext(ctx, DefaultTimeseriesTable, Point{Time: start.Add(time.Duration(written) * time.Second), Tag: "pressure"})
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected blocked write but got %v", err)
+	}
+	close(release)
+	if err := w.Close(); err != nil {
+		t.Errorf("Failed to close: %v", err)
+	}
+	if n := countRows(t, dbh, "measurements WHERE tag = 'pressure'"); n != written-1 {
+		t.Errorf("Expected %d points but got %d", written-1, n)
+	}
+}
+
+func TestBatchWriterInvalidRows(t *testing.T) {
+	t.Parallel()
+	dbh := newTestDbHandler(t)
+	var errs []error
+	w := NewBatchWriter(dbh, BatchWriterConfig{BatchSize: 100, Interval: time.Hour,
+		OnError: func(table string, err error) { errs = append(errs, err) }})
+	names := []string{"Temperature"}
+	rows := []ImportRowStruct{
+		{Names: names, Timestamp: "2023-06-01 12:00:00", Values: []string{"20"}},
+		{Names: names, Timestamp: "noon", Values: []string{"21"}},
+		{Names: names, Timestamp: "2023-06-01 12:00:02", Values: []string{"22"}},
+	}
+	for _, row := range rows {
+		if err := w.WriteRow("living", row); err != nil {
+			t.Fatalf("Failed to write row: %v", err)
+		}
+	}
+	if err := w.Close(); err == nil {
+		t.Errorf("Expected error for invalid row")
+	}
+	var invalid *InvalidRowsError
+	if len(errs) != 1 || !errors.As(errs[0], &invalid) || len(invalid.Rows) != 1 || invalid.Rows[0].Timestamp != "noon" {
+		t.Errorf("Expected the invalid row to be reported but got %v", errs)
+	}
+	if n := countRows(t, dbh, "living"); n != 2 {
+		t.Errorf("Expected the valid rows to be written but got %d", n)
+	}
+}
+
+func TestBatchWriterRetry(t *testing.T) {
+	t.Parallel()
+	dbh := newTestDbHandler(t)
+	var errs []error
+	w := NewBatchWriter(dbh, BatchWriterConfig{BatchSize: 100, QueueSize: 2, Interval: time.Hour,
+		OnError: func(table string, err error) { errs = append(errs, err) }})
+
+	// the writes time out while the database is locked
+	dbh.timeout = 10 * time.Millisecond
+	dbh.lock <- struct{}{}
+	start := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		if err := w.WritePoints(DefaultTimeseriesTable, Point{Time: start.Add(time.Duration(i) * time.Second), Tag: "retry", Value: float64(i)}); err != nil {
+			t.Fatalf("Failed to write: %v", err)
+		}
+	}
+	if err := w.Flush(); !errors.Is(err, ErrTimeout) {
+		t.Errorf("Expected timeout but got %v", err)
+	}
+	// the oldest point is dropped to keep QueueSize points
+	if len(errs) != 2 {
+		t.Errorf("Expected the timeout and the dropped point to be reported but got %v", errs)
+	}
+	<-dbh.lock
+
+	if err := w.Close(); err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+	if n := countRows(t, dbh, "measurements WHERE tag = 'retry' AND value > 0"); n != 2 {
+		t.Errorf("Expected the kept points to be written but got %d", n)
+	}
+	if n := countRows(t, dbh, "measurements WHERE tag = 'retry'"); n != 2 {
+		t.Errorf("Expected the oldest point to be dropped but got %d", n)
+	}
+}
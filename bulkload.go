@@ -0,0 +1,195 @@
+package timeseries
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// stageTable is the temporary table used for ON CONFLICT with COPY
+const stageTable string = "timeseries_stage"
+
+// BulkStats reports the outcome of a bulk insert
+type BulkStats struct {
+	Rows     int64 // rows written into the table (without conflicting rows)
+	Points   int64 // points sent to the database
+	Duration time.Duration
+}
+
+// RowsPerSecond returns the throughput of the bulk insert
+func (s BulkStats) RowsPerSecond() float64 {
+	if s.Duration <= 0 {
+		return 0
+	}
+	return float64(s.Points) / s.Duration.Seconds()
+}
+
+// BulkInsertTimeseries stores large timeseries into a timeseries table, see BulkInsertSeries.
+func (dbh *DbHandler) BulkInsertTimeseries(importStructs []TimeseriesImportStruct, onConflictDoNothing bool, table string) (BulkStats, error) {
+	return dbh.BulkInsertTimeseriesContext(context.Background(), importStructs, onConflictDoNothing, table)
+}
+
+// BulkInsertTimeseriesContext stores large timeseries into a timeseries table, see BulkInsertSeries.
+func (dbh *DbHandler) BulkInsertTimeseriesContext(ctx context.Context, importStructs []TimeseriesImportStruct, onConflictDoNothing bool, table string) (BulkStats, error) {
+	series := make([]Series, 0, len(importStructs))
+	for _, is := range importStructs {
+		s, err := SeriesFromImportStruct(is)
+		if err != nil {
+			return BulkStats{}, err
+		}
+		series = append(series, s)
+	}
+	return dbh.BulkInsertSeriesContext(ctx, series, onConflictDoNothing, table)
+}
+
+// BulkInsertSeries stores large series into a timeseries table. Postgres uses
+// the COPY protocol, conflicting rows are filtered through a temporary staging
+// table. Sqlite uses a prepared statement inside one transaction.
+func (dbh *DbHandler) BulkInsertSeries(series []Series, onConflictDoNothing bool, table string) (BulkStats, error) {
+	return dbh.BulkInsertSeriesContext(context.Background(), series, onConflictDoNothing, table)
+}
+
+// BulkInsertSeriesContext stores large series into a timeseries table, see BulkInsertSeries.
+func (dbh *DbHandler) BulkInsertSeriesContext(ctx context.Context, series []Series, onConflictDoNothing bool, table string) (BulkStats, error) {
+	logFields := log.Fields{"package": logPkg, "func": "BulkInsertSeries"}
+	quoted, err := dbh.quoteIdentifier(table)
+	if err != nil {
+		return BulkStats{}, err
+	}
+	start := time.Now()
+	var stats BulkStats
+	err = dbh.execute(ctx, func() error {
+		tx, err := dbh.DB.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		if dbh.conf.UsePostgres {
+			stats, err = dbh.copySeries(ctx, tx, series, onConflictDoNothing, quoted)
+		} else {
+			stats, err = dbh.prepareSeries(ctx, tx, series, onConflictDoNothing, quoted)
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		return tx.Commit()
+	})
+	if err != nil {
+		log.WithFields(logFields).Errorf("Failed to bulk insert into %s: %v", table, err)
+		return BulkStats{}, err
+	}
+	stats.Duration = time.Since(start)
+	dbh.metrics.addRowsInserted(table, stats.Rows)
+	log.WithFields(logFields).Infof("Inserted %d of %d rows into %s in %v (%.0f rows/s)",
+		stats.Rows, stats.Points, table, stats.Duration, stats.RowsPerSecond())
+	dbh.afterInsert(ctx, table, seriesSummary(series))
+	return stats, nil
+}
+
+// seriesSummary returns the points of series which afterInsert needs, the
+// first, the last and the newest non-null point of every series, so large
+// series aren't copied.
+func seriesSummary(series []Series) []Point {
+	summary := make([]Point, 0, 3*len(series))
+	for _, s := range series {
+		if len(s.Points) == 0 {
+			continue
+		}
+		first, last := s.Points[0], s.Points[0]
+		newest := -1
+		for i, point := range s.Points {
+			if point.Time.Before(first.Time) {
+				first = point
+			}
+			if point.Time.After(last.Time) {
+				last = point
+			}
+			if !math.IsNaN(point.Value) && (newest < 0 || point.Time.After(s.Points[newest].Time)) {
+				newest = i
+			}
+		}
+		first.Tag, last.Tag = s.Tag, s.Tag
+		summary = append(summary, first, last)
+		if newest >= 0 {
+			point := s.Points[newest]
+			point.Tag = s.Tag
+			summary = append(summary, point)
+		}
+	}
+	return summary
+}
+
+// copySeries writes the series with COPY FROM STDIN, pq switches to the copy
+// protocol for such statements.
+func (dbh *DbHandler) copySeries(ctx context.Context, tx *sql.Tx, series []Series, onConflictDoNothing bool, table string) (BulkStats, error) {
+	var stats BulkStats
+	target := table
+	if onConflictDoNothing {
+		_, err := tx.ExecContext(ctx, "CREATE TEMP TABLE "+stageTable+
+			" (LIKE "+table+" INCLUDING DEFAULTS) ON COMMIT DROP")
+		if err != nil {
+			return stats, fmt.Errorf("failed to create staging table: %v", err)
+		}
+		target = stageTable
+	}
+	stmt, err := tx.PrepareContext(ctx, "COPY "+target+" (time, tag, value, comment) FROM STDIN")
+	if err != nil {
+		return stats, err
+	}
+	defer stmt.Close()
+	for _, s := range series {
+		for _, point := range s.Points {
+			if _, err := stmt.ExecContext(ctx, pointRow(s.Tag, point)...); err != nil {
+				return stats, err
+			}
+			stats.Points++
+		}
+	}
+	if _, err := stmt.ExecContext(ctx); err != nil {
+		return stats, err
+	}
+	if !onConflictDoNothing {
+		stats.Rows = stats.Points
+		return stats, nil
+	}
+	res, err := tx.ExecContext(ctx, "INSERT INTO "+table+" (time, tag, value, comment)"+
+		" SELECT time, tag, value, comment FROM "+stageTable+" ON CONFLICT DO NOTHING")
+	if err != nil {
+		return stats, err
+	}
+	stats.Rows, err = res.RowsAffected()
+	return stats, err
+}
+
+// prepareSeries writes the series with one prepared statement
+func (dbh *DbHandler) prepareSeries(ctx context.Context, tx *sql.Tx, series []Series, onConflictDoNothing bool, table string) (BulkStats, error) {
+	var stats BulkStats
+	sqlStr := "INSERT INTO " + table + " (time, tag, value, comment) VALUES (" + dbh.placeholders(1, 4) + ")"
+	if onConflictDoNothing {
+		sqlStr += " ON CONFLICT DO NOTHING"
+	}
+	stmt, err := tx.PrepareContext(ctx, sqlStr)
+	if err != nil {
+		return stats, err
+	}
+	defer stmt.Close()
+	for _, s := range series {
+		for _, point := range s.Points {
+			res, err := stmt.ExecContext(ctx, pointRow(s.Tag, point)...)
+			if err != nil {
+				return stats, err
+			}
+			affected, err := res.RowsAffected()
+			if err != nil {
+				return stats, err
+			}
+			stats.Points++
+			stats.Rows += affected
+		}
+	}
+	return stats, nil
+}
@@ -0,0 +1,115 @@
+// tsexport writes tags of a timeseries table or a wide table as CSV, TSV or
+// NDJSON to a file or stdout. The rows are streamed, so large ranges don't
+// have to fit into memory.
+//
+//	tsexport -config db.json -tags livingroom/temperature,livingroom/humidity -from 2023-06-01 -format ndjson
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/pat-rohn/timeseries"
+)
+
+func main() {
+	configPath := flag.String("config", "", "database config in JSON format, default sqlite data.db")
+	table := flag.String("table", timeseries.DefaultTimeseriesTable, "table to export")
+	wide := flag.Bool("wide", false, "the table is a wide table (one column per sensor)")
+	tags := flag.String("tags", "", "comma separated tags of a timeseries table, all if empty")
+	columns := flag.String("columns", "", "comma separated columns of a wide table, all if empty")
+	from := flag.String("from", "", "first timestamp (inclusive), everything if empty")
+	to := flag.String("to", "", "last timestamp (exclusive), open if empty")
+	format := flag.String("format", "csv", "csv, tsv or ndjson")
+	timeLayout := flag.String("time-layout", "", "Go layout of the timestamps, 'unix' or 'unixms', "+timeseries.TimestampLayout+" if empty")
+	zone := flag.String("time-zone", "UTC", "time zone of the timestamps")
+	output := flag.String("o", "", "output file, stdout if empty")
+	verbose := flag.Bool("v", false, "verbose logging")
+	flag.Parse()
+
+	log.SetLevel(log.WarnLevel)
+	if *verbose {
+		log.SetLevel(log.InfoLevel)
+	}
+	location, err := time.LoadLocation(*zone)
+	if err != nil {
+		log.Fatalf("Invalid zone: %v", err)
+	}
+	start, err := parseTime(*from, location)
+	if err != nil {
+		log.Fatalf("Invalid -from: %v", err)
+	}
+	end, err := parseTime(*to, location)
+	if err != nil {
+		log.Fatalf("Invalid -to: %v", err)
+	}
+	opts := timeseries.ExportOptions{
+		Format:          timeseries.ExportFormat(strings.ToLower(*format)),
+		TimestampLayout: *timeLayout,
+		Location:        location,
+	}
+	if len(*columns) > 0 {
+		opts.Columns = strings.Split(*columns, ",")
+	}
+
+	conf, err := timeseries.LoadDBConfig(*configPath)
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+	dbh, err := timeseries.NewDbHandler(conf)
+	if err != nil {
+		log.Fatalf("Failed to open database: %v", err)
+	}
+	defer dbh.Close()
+
+	var out io.Writer = os.Stdout
+	if len(*output) > 0 {
+		file, err := os.Create(*output)
+		if err != nil {
+			dbh.Close()
+			log.Fatalf("Failed to create %s: %v", *output, err)
+		}
+		defer file.Close()
+		out = file
+	}
+	buffered := bufio.NewWriter(out)
+	var rows int64
+	if *wide {
+		rows, err = dbh.ExportTable(buffered, *table, start, end, opts)
+	} else {
+		var selected []string
+		if len(*tags) > 0 {
+			selected = strings.Split(*tags, ",")
+		}
+		rows, err = dbh.ExportSeries(buffered, *table, selected, start, end, opts)
+	}
+	if err == nil {
+		err = buffered.Flush()
+	}
+	if err != nil {
+		dbh.Close()
+		log.Fatalf("Export failed after %d rows: %v", rows, err)
+	}
+	fmt.Fprintf(os.Stderr, "Exported %d rows of %s\n", rows, *table)
+}
+
+// parseTime parses an RFC 3339 timestamp, a timestamp in
+// timeseries.TimestampLayout or a date, in location if it has no zone
+func parseTime(value string, location *time.Location) (time.Time, error) {
+	if len(value) == 0 {
+		return time.Time{}, nil
+	}
+	for _, layout := range []string{time.RFC3339Nano, timeseries.TimestampLayout, "2006-01-02T15:04:05", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, value, location); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unknown format of %q", value)
+}
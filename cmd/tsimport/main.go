@@ -0,0 +1,140 @@
+// tsimport reads a CSV or TSV file and writes it into a wide table (one
+// column per tag) or into a timeseries table (tag/value).
+//
+//	tsimport -config db.json -mode narrow -time-column Time -map 'T=livingroom/temperature' data.csv
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/pat-rohn/timeseries"
+)
+
+// maxRejectedShown limits the rejected lines printed in the summary
+const maxRejectedShown int = 10
+
+func main() {
+	configPath := flag.String("config", "", "database config in JSON format, default sqlite data.db")
+	mode := flag.String("mode", "narrow", "wide: one column per tag, narrow: tag/value timeseries table")
+	table := flag.String("table", "", "table to write, measurements in narrow mode")
+	delimiter := flag.String("delimiter", "", "field delimiter, 'tab' for TSV, default ',' or tab for .tsv files")
+	header := flag.Bool("header", true, "the first line contains the column names")
+	timeColumn := flag.String("time-column", "0", "name or zero based index of the timestamp column")
+	timeLayout := flag.String("time-layout", "", "Go layout of the timestamps, 'unix' or 'unixms', common formats if empty")
+	zone := flag.String("time-zone", "UTC", "time zone of timestamps without zone")
+	mapping := flag.String("map", "", "comma separated column=tag pairs, all columns if empty")
+	skipExisting := flag.Bool("skip-existing", false, "narrow mode: skip points which exist already (needs a unique key)")
+	verbose := flag.Bool("v", false, "verbose logging")
+	flag.Parse()
+
+	log.SetLevel(log.WarnLevel)
+	if *verbose {
+		log.SetLevel(log.InfoLevel)
+	}
+	if flag.NArg() != 1 || (*mode != "wide" && *mode != "narrow") {
+		fmt.Fprintln(os.Stderr, "usage: tsimport [flags] file.csv")
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+	path := flag.Arg(0)
+	if len(*table) == 0 {
+		if *mode == "wide" {
+			log.Fatal("Wide mode needs -table")
+		}
+		*table = timeseries.DefaultTimeseriesTable
+	}
+
+	opts := timeseries.CSVOptions{
+		Header:          *header,
+		TimestampColumn: *timeColumn,
+		TimestampLayout: *timeLayout,
+		Columns:         make(map[string]string),
+	}
+	switch {
+	case *delimiter == "tab" || *delimiter == `\t`:
+		opts.Delimiter = '\t'
+	case len(*delimiter) > 0:
+		opts.Delimiter = []rune(*delimiter)[0]
+	case strings.EqualFold(filepath.Ext(path), ".tsv"):
+		opts.Delimiter = '\t'
+	}
+	location, err := time.LoadLocation(*zone)
+	if err != nil {
+		log.Fatalf("Invalid zone: %v", err)
+	}
+	opts.Location = location
+	if len(*mapping) > 0 {
+		for _, pair := range strings.Split(*mapping, ",") {
+			column, tag, ok := strings.Cut(pair, "=")
+			if !ok {
+				log.Fatalf("Invalid mapping %q, expected column=tag", pair)
+			}
+			opts.Columns[strings.TrimSpace(column)] = strings.TrimSpace(tag)
+		}
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		log.Fatalf("Failed to open %s: %v", path, err)
+	}
+	is, report, err := timeseries.ReadCSV(file, opts)
+	file.Close()
+	if err != nil {
+		log.Fatalf("Failed to read %s: %v", path, err)
+	}
+
+	conf, err := timeseries.LoadDBConfig(*configPath)
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+	dbh, err := timeseries.NewDbHandler(conf)
+	if err != nil {
+		log.Fatalf("Failed to open database: %v", err)
+	}
+	defer dbh.Close()
+
+	points := 0
+	if report.Rows > 0 {
+		if *mode == "wide" {
+			err = dbh.InsertIntoDatabase(*table, is)
+		} else {
+			var series []timeseries.Series
+			series, err = timeseries.SeriesFromWide(is)
+			if err == nil {
+				// like wide mode the table is created, skipping existing points needs the unique key
+				err = dbh.CreateTimeseriesTableWithOptions(*table, timeseries.TimeseriesTableOptions{UniqueKey: *skipExisting})
+			}
+			if err == nil {
+				var stats timeseries.BulkStats
+				stats, err = dbh.BulkInsertSeries(series, *skipExisting, *table)
+				points = int(stats.Rows)
+			}
+		}
+	}
+
+	fmt.Printf("Read %d lines of %s\n", report.Lines, path)
+	fmt.Printf("Coerced nulls: %d\nRejected lines: %d\n", report.CoercedNulls, len(report.Rejected))
+	for i, rejection := range report.Rejected {
+		if i == maxRejectedShown {
+			fmt.Printf("  ... %d more\n", len(report.Rejected)-maxRejectedShown)
+			break
+		}
+		fmt.Printf("  line %d: %s\n", rejection.Line, rejection.Reason)
+	}
+	if err != nil {
+		dbh.Close()
+		log.Fatalf("Failed to write into %s: %v", *table, err)
+	}
+	fmt.Printf("Inserted rows: %d", report.Rows)
+	if *mode == "narrow" {
+		fmt.Printf(" (%d points)", points)
+	}
+	fmt.Println()
+}
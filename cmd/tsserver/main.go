@@ -0,0 +1,96 @@
+// tsserver accepts points over HTTP and writes them into a timeseries table.
+//
+//	tsserver -config db.json -listen :8080 -influx-listen :8086
+//	curl -X POST localhost:8080/write -d '{"Tag": "livingroom/temperature", "Timestamps": ["2023-06-01 12:00:00"], "Values": [20.5]}'
+//	curl -X POST 'localhost:8086/write?precision=s' --data-binary 'sensor,room=living temperature=20.5 1685620800'
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/pat-rohn/timeseries"
+)
+
+func main() {
+	configPath := flag.String("config", "", "database config in JSON format, default sqlite data.db")
+	listen := flag.String("listen", ":8080", "address to listen on")
+	influxListen := flag.String("influx-listen", "", "additional address for InfluxDB clients (/write, /api/v2/write), e.g. :8086")
+	table := flag.String("table", timeseries.DefaultTimeseriesTable, "timeseries table to write")
+	influxTagFormat := flag.String("influx-tag-format", timeseries.DefaultInfluxTagFormat,
+		"tag of a line protocol field, {measurement}, {field}, {tags} and {tag:<key>} are replaced")
+	influxTextAsComment := flag.Bool("influx-text-as-comment", false, "store string fields as comments instead of skipping them")
+	skipExisting := flag.Bool("skip-existing", false, "skip points which exist already (needs a unique key)")
+	maxBody := flag.Int64("max-body", 10<<20, "maximum size of a request body in bytes")
+	verbose := flag.Bool("v", false, "verbose logging")
+	flag.Parse()
+
+	log.SetLevel(log.WarnLevel)
+	if *verbose {
+		log.SetLevel(log.InfoLevel)
+	}
+	conf, err := timeseries.LoadDBConfig(*configPath)
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+	dbh, err := timeseries.NewDbHandler(conf)
+	if err != nil {
+		log.Fatalf("Failed to open database: %v", err)
+	}
+	defer dbh.Close()
+	if err := dbh.CreateTimeseriesTable(*table); err != nil {
+		dbh.Close()
+		log.Fatalf("Failed to create %s: %v", *table, err)
+	}
+
+	handler := timeseries.NewServer(dbh, timeseries.ServerConfig{
+		Table:               *table,
+		OnConflictDoNothing: *skipExisting,
+		MaxBodySize:         *maxBody,
+		Influx: timeseries.InfluxOptions{
+			Table:               *table,
+			TagFormat:           *influxTagFormat,
+			TextAsComment:       *influxTextAsComment,
+			OnConflictDoNothing: *skipExisting,
+		},
+	})
+	servers := []*http.Server{{Addr: *listen, Handler: handler, ReadHeaderTimeout: 10 * time.Second}}
+	if len(*influxListen) > 0 {
+		servers = append(servers, &http.Server{Addr: *influxListen, Handler: handler.InfluxHandler(), ReadHeaderTimeout: 10 * time.Second})
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	var wg sync.WaitGroup
+	for _, server := range servers {
+		server := server
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			log.Warnf("Listening on %s", server.Addr)
+			if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Errorf("Server on %s failed: %v", server.Addr, err)
+				stop()
+			}
+		}()
+	}
+	<-ctx.Done()
+	// wait for running requests before the database is closed
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for _, server := range servers {
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Warnf("Failed to shut down %s: %v", server.Addr, err)
+		}
+	}
+	wg.Wait()
+}
@@ -0,0 +1,73 @@
+// tsunpivot converts a wide table (one column per sensor) into the tag/value
+// format of a timeseries table. An interrupted conversion continues where it
+// stopped unless -restart is given.
+//
+//	tsunpivot -config db.json -table living -tag-format 'livingroom/{column}'
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/pat-rohn/timeseries"
+)
+
+func main() {
+	configPath := flag.String("config", "", "database config in JSON format, default sqlite data.db")
+	table := flag.String("table", "", "wide table to convert")
+	destination := flag.String("dest", timeseries.DefaultTimeseriesTable, "timeseries table")
+	tagFormat := flag.String("tag-format", timeseries.DefaultTagFormat, "tag of a column, {table} and {column} are replaced")
+	columns := flag.String("columns", "", "comma separated columns to convert, all if empty")
+	textAsComment := flag.Bool("text-as-comment", false, "store text columns as comments instead of skipping them")
+	batchSize := flag.Int("batch", 1000, "rows per transaction")
+	skipExisting := flag.Bool("skip-existing", false, "skip points which exist already (needs a unique key)")
+	restart := flag.Bool("restart", false, "ignore the progress of an earlier run")
+	verbose := flag.Bool("v", false, "verbose logging")
+	flag.Parse()
+
+	log.SetLevel(log.WarnLevel)
+	if *verbose {
+		log.SetLevel(log.InfoLevel)
+	}
+	if len(*table) == 0 {
+		fmt.Fprintln(os.Stderr, "missing -table")
+		flag.Usage()
+		os.Exit(2)
+	}
+	conf, err := timeseries.LoadDBConfig(*configPath)
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+	dbh, err := timeseries.NewDbHandler(conf)
+	if err != nil {
+		log.Fatalf("Failed to open database: %v", err)
+	}
+	defer dbh.Close()
+
+	opts := timeseries.UnpivotOptions{
+		TagFormat:           *tagFormat,
+		TextAsComment:       *textAsComment,
+		BatchSize:           *batchSize,
+		OnConflictDoNothing: *skipExisting,
+		Restart:             *restart,
+	}
+	if len(*columns) > 0 {
+		opts.Columns = strings.Split(*columns, ",")
+	}
+	result, err := dbh.Unpivot(*table, *destination, opts)
+	if result.Resumed {
+		fmt.Printf("Resumed conversion of %s\n", *table)
+	}
+	for _, column := range result.SkippedColumns {
+		fmt.Printf("Skipped text column %s\n", column)
+	}
+	fmt.Printf("Converted %d rows into %d points, last timestamp %s\n", result.Rows, result.Points, result.LastTimestamp)
+	if err != nil {
+		dbh.Close()
+		log.Fatalf("Conversion failed: %v", err)
+	}
+}
@@ -0,0 +1,215 @@
+package timeseries
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CSVOptions configures ReadCSV
+type CSVOptions struct {
+	Delimiter       rune              // ',' if 0
+	Header          bool              // the first line contains the column names
+	TimestampColumn string            // name or zero based index of the timestamp column, "0" if empty
+	TimestampLayout string            // Go layout, "unix" or "unixms", the formats of ParseTimestamp if empty
+	Location        *time.Location    // zone of timestamps without zone, UTC if nil
+	Columns         map[string]string // column (name or index) to tag, all columns named after the header if empty
+}
+
+// CSVRejection is a line which couldn't be imported
+type CSVRejection struct {
+	Line   int
+	Reason string
+}
+
+// CSVReport summarizes ReadCSV
+type CSVReport struct {
+	Lines        int // data lines without header
+	Rows         int // accepted lines
+	CoercedNulls int // empty values and values which are no numbers
+	Rejected     []CSVRejection
+}
+
+// ReadCSV reads a CSV (or with Delimiter '\t' a TSV) file into an ImportStruct
+// with one column per mapped tag. Timestamps are formatted with
+// TimestampLayout and values which are no numbers become NullValue. Lines
+// with a wrong number of fields or an invalid timestamp are rejected.
+func ReadCSV(r io.Reader, opts CSVOptions) (ImportStruct, CSVReport, error) {
+	var report CSVReport
+	reader := csv.NewReader(r)
+	reader.Comma = ','
+	if opts.Delimiter != 0 {
+		reader.Comma = opts.Delimiter
+	}
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	if reader.Comma == '\t' {
+		reader.LazyQuotes = true
+	}
+	location := opts.Location
+	if location == nil {
+		location = time.UTC
+	}
+
+	var header []string
+	if opts.Header {
+		record, err := reader.Read()
+		if err != nil {
+			return ImportStruct{}, report, fmt.Errorf("failed to read header: %v", err)
+		}
+		header = record
+	}
+	timeColumn, err := csvColumnIndex(header, opts.TimestampColumn)
+	if err != nil {
+		return ImportStruct{}, report, err
+	}
+
+	var is ImportStruct
+	var indexes []int
+	fields := -1
+	line := 0
+	if opts.Header {
+		fields = len(header)
+		line = 1
+	}
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		line++
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			report.Lines++
+			report.Rejected = append(report.Rejected, CSVRejection{Line: line, Reason: parseErr.Err.Error()})
+			continue
+		}
+		if err != nil {
+			return is, report, err
+		}
+		report.Lines++
+		if indexes == nil {
+			// the first line defines the columns if there is no header
+			if fields < 0 {
+				fields = len(record)
+			}
+			is.Names, indexes, err = csvTags(header, fields, timeColumn, opts.Columns)
+			if err != nil {
+				return is, report, err
+			}
+			is.Data = make([][]string, len(indexes))
+		}
+		if len(record) != fields {
+			report.Rejected = append(report.Rejected, CSVRejection{Line: line,
+				Reason: fmt.Sprintf("%d fields instead of %d", len(record), fields)})
+			continue
+		}
+		timestamp, err := parseCSVTimestamp(record[timeColumn], opts.TimestampLayout, location)
+		if err != nil {
+			report.Rejected = append(report.Rejected, CSVRejection{Line: line, Reason: err.Error()})
+			continue
+		}
+		is.Timestamps = append(is.Timestamps, FormatTimestamp(timestamp))
+		for i, index := range indexes {
+			value := strings.TrimSpace(record[index])
+			if parseNumber(value) == nil {
+				report.CoercedNulls++
+				value = NullValue
+			}
+			is.Data[i] = append(is.Data[i], value)
+		}
+		report.Rows++
+	}
+	return is, report, nil
+}
+
+// csvColumnIndex finds a column by name or zero based index
+func csvColumnIndex(header []string, column string) (int, error) {
+	if len(column) == 0 {
+		return 0, nil
+	}
+	for i, name := range header {
+		if strings.TrimSpace(name) == column {
+			return i, nil
+		}
+	}
+	index, err := strconv.Atoi(column)
+	if err != nil || index < 0 {
+		return 0, fmt.Errorf("unknown column %q", column)
+	}
+	return index, nil
+}
+
+// csvTags returns the tags and the indexes of the value columns
+func csvTags(header []string, fields int, timeColumn int, mapping map[string]string) ([]string, []int, error) {
+	if timeColumn >= fields {
+		return nil, nil, fmt.Errorf("timestamp column %d doesn't exist", timeColumn)
+	}
+	var tags []string
+	var indexes []int
+	if len(mapping) == 0 {
+		for i := 0; i < fields; i++ {
+			if i == timeColumn {
+				continue
+			}
+			tag := fmt.Sprintf("col%d", i)
+			if i < len(header) && len(strings.TrimSpace(header[i])) > 0 {
+				tag = strings.TrimSpace(header[i])
+			}
+			tags = append(tags, tag)
+			indexes = append(indexes, i)
+		}
+		return tags, indexes, nil
+	}
+	// keep the order of the file
+	byIndex := make(map[int]string)
+	for column, tag := range mapping {
+		index, err := csvColumnIndex(header, column)
+		if err != nil {
+			return nil, nil, err
+		}
+		if index >= fields || index == timeColumn {
+			return nil, nil, fmt.Errorf("column %q can't be mapped", column)
+		}
+		byIndex[index] = tag
+	}
+	for i := 0; i < fields; i++ {
+		if tag, ok := byIndex[i]; ok {
+			tags = append(tags, tag)
+			indexes = append(indexes, i)
+		}
+	}
+	return tags, indexes, nil
+}
+
+func parseCSVTimestamp(value string, layout string, location *time.Location) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	switch layout {
+	case "":
+		for _, l := range timestampLayouts {
+			if t, err := time.ParseInLocation(l, value, location); err == nil {
+				return t.UTC(), nil
+			}
+		}
+		return time.Time{}, fmt.Errorf("invalid timestamp %q", value)
+	case "unix", "unixms":
+		number, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid timestamp %q", value)
+		}
+		if layout == "unixms" {
+			number /= 1000
+		}
+		seconds := int64(number)
+		return time.Unix(seconds, int64((number-float64(seconds))*1e9)).UTC(), nil
+	}
+	t, err := time.ParseInLocation(layout, value, location)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid timestamp %q", value)
+	}
+	return t.UTC(), nil
+}
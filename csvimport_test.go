@@ -0,0 +1,80 @@
+package timeseries
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadCSV(t *testing.T) {
+	t.Parallel()
+	input := "Time,Temperature,Humidity,Note\n" +
+		"2023-06-01 12:00:00,20.5,40,a\n" +
+		"2023-06-01 12:00:01,,41,b\n" +
+		"yesterday,21,42,c\n" +
+		"2023-06-01 12:00:02,22\n" +
+		"2023-06-01 12:00:03,n/a,43,d\n"
+	is, report, err := ReadCSV(strings.NewReader(input), CSVOptions{
+		Header:          true,
+		TimestampColumn: "Time",
+		Columns:         map[string]string{"Humidity": "living/humidity", "1": "living/temperature"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to read: %v", err)
+	}
+	if report.Lines != 5 || report.Rows != 3 || report.CoercedNulls != 2 || len(report.Rejected) != 2 ||
+		report.Rejected[0].Line != 4 || report.Rejected[1].Line != 5 {
+		t.Errorf("Unexpected report %+v", report)
+	}
+	expected := ImportStruct{
+		Names:      []string{"living/temperature", "living/humidity"},
+		Timestamps: []string{"2023-06-01 12:00:00", "2023-06-01 12:00:01", "2023-06-01 12:00:03"},
+		Data:       [][]string{{"20.5", NullValue, NullValue}, {"40", "41", "43"}},
+	}
+	if !reflect.DeepEqual(is, expected) {
+		t.Errorf("Expected %+v but got %+v", expected, is)
+	}
+
+	if _, _, err := ReadCSV(strings.NewReader(input), CSVOptions{Header: true, TimestampColumn: "Missing"}); err == nil {
+		t.Errorf("Expected error for missing timestamp column")
+	}
+}
+
+func TestReadTSVUnix(t *testing.T) {
+	t.Parallel()
+	input := "20.5\t1685620800\n21\t1685620801.5\n"
+	is, report, err := ReadCSV(strings.NewReader(input), CSVOptions{Delimiter: '\t', TimestampColumn: "1", TimestampLayout: "unix"})
+	if err != nil {
+		t.Fatalf("Failed to read: %v", err)
+	}
+	if report.Rows != 2 || len(report.Rejected) != 0 || !reflect.DeepEqual(is.Names, []string{"col0"}) {
+		t.Errorf("Unexpected result %+v %+v", is, report)
+	}
+	timestamp, err := ParseTimestamp(is.Timestamps[1])
+	if err != nil || !timestamp.Equal(time.Date(2023, 6, 1, 12, 0, 1, 5e8, time.UTC)) {
+		t.Errorf("Unexpected timestamp %s: %v", is.Timestamps[1], err)
+	}
+}
+
+func TestInsertCSVLeadingNull(t *testing.T) {
+	t.Parallel()
+	dbh := newTestDbHandler(t)
+	input := "Time,Temperature\n2023-06-01 12:00:00,\n2023-06-01 12:00:01,21.5\n"
+	is, _, err := ReadCSV(strings.NewReader(input), CSVOptions{Header: true})
+	if err != nil {
+		t.Fatalf("Failed to read: %v", err)
+	}
+	if err := dbh.InsertIntoDatabase("living", is); err != nil {
+		t.Fatalf("Failed to insert: %v", err)
+	}
+	// the type of a column is taken from its first value which isn't missing
+	columns, err := dbh.tableColumns(context.Background(), "living")
+	if err != nil {
+		t.Fatalf("Failed to read columns: %v", err)
+	}
+	if len(columns) != 2 || !columns[1].isNumeric() {
+		t.Errorf("Expected numeric column but got %+v", columns)
+	}
+}
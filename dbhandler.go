@@ -1,11 +1,13 @@
 package timeseries
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
 	"os"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -25,43 +27,92 @@ const (
 )
 
 type DBConfig struct {
-	Name        string `json:"Name"`
-	IPOrPath    string `json:"IPOrPath"`
-	UsePostgres bool   `json:"UsePostgres"`
-	User        string `json:"User"`
-	Password    string `json:"Password"`
-	Port        int    `json:"Port"`
+	Name           string `json:"Name"`
+	IPOrPath       string `json:"IPOrPath"`
+	UsePostgres    bool   `json:"UsePostgres"`
+	User           string `json:"User"`
+	Password       string `json:"Password"`
+	Port           int    `json:"Port"`
+	SkipMigrations bool   `json:"SkipMigrations"` // don't run Up when opening
 }
 
 type DbHandler struct {
 	conf      DBConfig
 	DB        *sql.DB
-	mutex     sync.Mutex
+	lock      chan struct{} // serializes operations, a channel to be able to cancel waiting
 	semaphore chan struct{} // limit number of concurrent operations
 	timeout   time.Duration
+	metrics   *Metrics
+
+	stateMutex sync.Mutex // protects the state below
+	timescale  *bool      // cached result of HasTimescaleDB
+
+	latestCaches       map[string]bool     // tables with a last-value cache
+	latestCachesStored bool                // latestCaches are stored in LatestCacheTable
+	rollups            map[string][]Rollup // enabled rollups per table
+	rollupsStored      bool                // rollups are stored in RollupDefinitionTable
+	catalogueEnabled   bool                // register unknown tags in the tag catalogue
+	knownTags          map[string]bool     // tags which are in the catalogue
+
+	retentionRules  []RetentionRule
+	retentionCancel context.CancelFunc // stops the background retention
+	retentionDone   chan struct{}      // closed when the background retention returned
 }
 
+// ErrTimeout is returned if an operation waited longer than the handler
+// timeout for the database
+var ErrTimeout = errors.New("operation timed out")
+
 var dbhandler *DbHandler
 var once sync.Once
 
-// Singleton for dbhandler
-func DBHandler(conf DBConfig) *DbHandler {
-	once.Do(func() {
-		if dbhandler != nil {
-			log.Fatalf("DbHandler already created with config: %+v", dbhandler.conf)
+// NewDbHandler opens the database described by conf. Every call returns an
+// independent handler, so a process can e.g. keep a local sqlite buffer and a
+// remote postgres open at the same time.
+func NewDbHandler(conf DBConfig) (*DbHandler, error) {
+	dbh := &DbHandler{
+		conf:      conf,
+		lock:      make(chan struct{}, 1),
+		timeout:   time.Second * 10,
+		semaphore: make(chan struct{}, 10),
+		metrics:   newMetrics(),
+	}
+	if err := dbh.openDatabase(); err != nil {
+		return nil, err
+	}
+	if !conf.SkipMigrations {
+		if _, err := dbh.Up(false); err != nil {
+			dbh.Close()
+			return nil, fmt.Errorf("failed to migrate database: %v", err)
+		}
+		if err := dbh.loadLatestCaches(context.Background()); err != nil {
+			dbh.Close()
+			return nil, fmt.Errorf("failed to load latest value caches: %v", err)
 		}
-		dbhandler = &DbHandler{
-			conf:      conf,
-			mutex:     sync.Mutex{},
-			timeout:   time.Second * 10,
-			semaphore: make(chan struct{}, 10),
+		if err := dbh.loadRollups(context.Background()); err != nil {
+			dbh.Close()
+			return nil, fmt.Errorf("failed to load rollups: %v", err)
 		}
-		if err := dbhandler.openDatabase(); err != nil {
+	}
+	return dbh, nil
+}
+
+// Singleton for dbhandler, consider NewDbHandler for new code.
+// Later calls return the first handler even if conf differs.
+func DBHandler(conf DBConfig) *DbHandler {
+	once.Do(func() {
+		var err error
+		dbhandler, err = NewDbHandler(conf)
+		if err != nil {
 			log.WithField("package", logPkg).Fatalf(
 				"Failed to create database: %v", err)
 		}
 		log.Infof("%+v", dbhandler.conf)
 	})
+	if dbhandler.conf != conf {
+		log.WithField("package", logPkg).Warnf(
+			"DbHandler already created with config: %+v", dbhandler.conf)
+	}
 	return dbhandler
 }
 
@@ -88,9 +139,10 @@ func (dbh *DbHandler) openDatabase() error {
 			log.WithFields(logFields).Tracef("Create Folder: %v", dbh.conf.IPOrPath)
 			if _, err := os.Stat(dbh.conf.IPOrPath); err != nil {
 				if os.IsNotExist(err) {
-					err := os.MkdirAll(dbh.conf.IPOrPath, 0644)
+					err := os.MkdirAll(dbh.conf.IPOrPath, 0755)
 					if err != nil {
 						log.WithFields(logFields).Errorf("Failed to create path %v", err)
+						return fmt.Errorf("failed to create path %v", err)
 					}
 				}
 			}
@@ -110,6 +162,7 @@ func (dbh *DbHandler) openDatabase() error {
 }
 
 func (dbh *DbHandler) Close() error {
+	dbh.StopRetention()
 	err := dbh.DB.Close()
 	log.WithField("package", logPkg).Infof("Closed database %s", dbh.conf.Name)
 	if err != nil {
@@ -122,125 +175,101 @@ func (dbh *DbHandler) Close() error {
 
 // InsertIntoDatabase stores values into database
 func (dbh *DbHandler) InsertIntoDatabase(tableName string, is ImportStruct) error {
-	var str strings.Builder
-	log.WithField("package", logPkg).Tracef(
-		"Columns: %v", is.Names)
-	log.WithField("package", logPkg).Tracef(
-		"Columns: %v", len(is.Names))
-	log.WithField("package", logPkg).Tracef(
-		"Entries: %v", len(is.Data))
-	log.WithField("package", logPkg).Tracef(
-		"Values: %v", len(is.Data[0]))
-
-	log.WithField("package", logPkg).Tracef(
-		"Entries: %v", is.Data)
-	timeStampStr := "DATETIME"
-	if dbh.conf.UsePostgres {
-		timeStampStr = "TIMESTAMP"
-	}
-	str.WriteString("CREATE TABLE IF NOT EXISTS " + tableName + " (Timestamp " + timeStampStr + ", ")
-	columnsOfText := make(map[int]bool)
-	for columnNr, name := range is.Names {
-		temp := strings.TrimSpace(is.Data[columnNr][0])
-		_, errInt := strconv.ParseInt(temp, 0, 64)
-		_, errFloat := strconv.ParseFloat(temp, 64)
-		if errInt == nil || errFloat == nil || is.Data[columnNr][0] == "float" {
-			str.WriteString(name + " REAL DEFAULT NULL, ")
-			log.WithField("package", logPkg).Tracef(
-				"Is number: %v", is.Data[columnNr][0])
-			columnsOfText[columnNr] = true
-		} else {
-			str.WriteString(name + " TEXT DEFAULT NULL, ")
-			columnsOfText[columnNr] = false
-			log.WithField("package", logPkg).Tracef(
-				"Is no number: %v", is.Data[columnNr][0])
-		}
+	return dbh.InsertIntoDatabaseContext(context.Background(), tableName, is)
+}
+
+// InsertIntoDatabaseContext stores values into database
+func (dbh *DbHandler) InsertIntoDatabaseContext(ctx context.Context, tableName string, is ImportStruct) error {
+	logFields := log.Fields{"package": logPkg, "func": "InsertIntoDatabase"}
+	log.WithFields(logFields).Tracef("Columns: %v", is.Names)
+	log.WithFields(logFields).Tracef("Entries: %v", len(is.Timestamps))
+	if len(is.Timestamps) == 0 || len(is.Data) < len(is.Names) {
+		return fmt.Errorf("no data to import into %s", tableName)
 	}
 
-	sqlStr := str.String()[0 : len(str.String())-2]
-	sqlStr += ");"
-	log.WithField("package", logPkg).Tracef("create query: %s", sqlStr)
-	err := dbh.execute(func() error {
-		_, err := dbh.DB.Exec(sqlStr)
-		if err != nil {
-			log.WithField("package", logPkg).Errorf("Failed to create db %v", err)
-			return fmt.Errorf("failed to execute sql-statement: %v", err)
+	samples := make([]string, len(is.Names))
+	for columnNr := range is.Names {
+		if len(is.Data[columnNr]) < len(is.Timestamps) {
+			return fmt.Errorf("column %s has %d values for %d timestamps",
+				is.Names[columnNr], len(is.Data[columnNr]), len(is.Timestamps))
 		}
-		return nil
-	})
+		// the first value which isn't missing defines the column type
+		samples[columnNr] = is.Data[columnNr][0]
+		for _, value := range is.Data[columnNr][:len(is.Timestamps)] {
+			if !isMissingValue(value) {
+				samples[columnNr] = value
+				break
+			}
+		}
+	}
+	columnTypes, err := dbh.createWideTable(ctx, tableName, is.Names, samples, false)
 	if err != nil {
 		return err
 	}
 
-	str.Reset()
-
-	str.WriteString("INSERT INTO " + tableName + " (Timestamp, ")
-	isFirst := true
-	for _, name := range is.Names {
-		if isFirst {
-			isFirst = false
-			str.WriteString(name)
-		} else {
-			str.WriteString(", " + name)
-		}
-	}
-
-	log.WithField("package", logPkg).Infof("Insert string: %v", str.String())
-	str.WriteString(") VALUES \n")
-
+	rows := make([][]any, 0, len(is.Timestamps))
+	coerced := 0
 	for entryIndex, ts := range is.Timestamps {
-		str.WriteString("('" + ts + "', ")
-		isFirst := true
+		timestamp, err := normalizeTimestamp(ts)
+		if err != nil {
+			return err
+		}
+		row := make([]any, 0, len(is.Names)+1)
+		row = append(row, timestamp)
 		for dataIndex, columnName := range is.Names {
 			val := strings.TrimSpace(is.Data[dataIndex][entryIndex])
-			if columnsOfText[dataIndex] {
-				_, errFloat := strconv.ParseFloat(val, 64)
-				_, errInt := strconv.ParseInt(val, 0, 64)
-				if errFloat != nil && errInt != nil {
-					// it can be float or integer, db-type is set to real
-					log.WithField("package", logPkg).Warnf(
-						"Skip number in %s because parsing failed: %s", columnName, errFloat)
-					val = "null" // this can be imported in column of type real
-				}
+			if columnTypes[dataIndex] == columnTextType {
+				row = append(row, val)
+				continue
 			}
-			if !columnsOfText[dataIndex] {
-				val = "'" + val + "'"
-			}
-			if isFirst {
-				str.WriteString(val)
-				isFirst = false
-
-			} else {
-				str.WriteString(", " + val)
+			number := parseNumber(val)
+			if number == nil && !isMissingValue(val) {
+				// it can be float or integer, db-type is set to real
+				log.WithFields(logFields).Warnf(
+					"Skip number in %s because parsing failed: %s", columnName, val)
+				coerced++
 			}
+			row = append(row, number)
 		}
-		str.WriteString("),\n")
+		rows = append(rows, row)
 	}
-	log.WithField("package", logPkg).Traceln("Finished creating string")
-	sqlStr = str.String()
+	log.WithFields(logFields).Traceln("Finished creating rows")
 
-	sqlStr = sqlStr[0 : len(sqlStr)-2]
-	if err := dbh.writeToDB(sqlStr); err != nil {
-		log.WithField("package", logPkg).Errorf("Failed to execute sql-statement: %v\n", err)
+	columns := append([]string{"Timestamp"}, is.Names...)
+	if err := dbh.insertRows(ctx, tableName, columns, rows, ""); err != nil {
+		log.WithFields(logFields).Errorf("Failed to execute sql-statement: %v", err)
 		return fmt.Errorf("failed to execute sql-statement: %v", err)
 	}
-	log.WithField("package", logPkg).Infof("Succesfully imported values into table: %v", tableName)
+	dbh.metrics.addCoercedNulls(tableName, coerced)
+	log.WithFields(logFields).Infof("Succesfully imported values into table: %v", tableName)
 	return nil
 }
 
 // InsertRowsToTable imports importStructs into table and returns failed rows
 func (dbh *DbHandler) InsertRowsToTable(tableName string, importStructs []ImportRowStruct) ([]ImportRowStruct, error) {
+	return dbh.InsertRowsToTableContext(context.Background(), tableName, importStructs)
+}
+
+// InsertRowsToTableContext imports importStructs into table and returns failed rows.
+// If ctx is cancelled the remaining rows are returned as failed.
+func (dbh *DbHandler) InsertRowsToTableContext(ctx context.Context, tableName string, importStructs []ImportRowStruct) ([]ImportRowStruct, error) {
 	logFields := log.Fields{"package": logPkg, "func": "InsertRowsToTable"}
 	var failedImports []ImportRowStruct
 
-	for _, is := range importStructs {
+	for index, is := range importStructs {
 		retryCounter := 3
 		for retryCounter > 0 {
 			retryCounter--
-			err := dbh.InsertRowToTable(tableName, is)
+			err := dbh.InsertRowToTableContext(ctx, tableName, is)
 			if err != nil {
 				log.WithFields(logFields).Errorf("Failed to import row: %v", err)
-				time.Sleep(time.Millisecond * 500)
+				select {
+				case <-ctx.Done():
+					failedImports = append(failedImports, importStructs[index:]...)
+					dbh.metrics.addFailedRows(tableName, len(importStructs)-index)
+					return failedImports, ctx.Err()
+				case <-time.After(time.Millisecond * 500):
+				}
 			} else {
 				log.WithFields(logFields).Traceln("succesfully imported row")
 				break
@@ -248,6 +277,9 @@ func (dbh *DbHandler) InsertRowsToTable(tableName string, importStructs []Import
 			if retryCounter == 0 {
 				log.WithFields(logFields).Errorln("Unsuccesful rows. ")
 				failedImports = append(failedImports, is)
+				dbh.metrics.addFailedRows(tableName, 1)
+			} else {
+				dbh.metrics.addRetriedRows(tableName, 1)
 			}
 		}
 	}
@@ -260,168 +292,162 @@ func (dbh *DbHandler) InsertRowsToTable(tableName string, importStructs []Import
 
 // InsertRowToTable inserts one row into database
 func (dbh *DbHandler) InsertRowToTable(tableName string, is ImportRowStruct) error {
+	return dbh.InsertRowToTableContext(context.Background(), tableName, is)
+}
 
-	var str strings.Builder
-	log.WithField("package", logPkg).Tracef(
-		"Columns: %v", is.Names)
-	log.WithField("package", logPkg).Tracef(
-		"Columns: %v", len(is.Names))
-	log.WithField("package", logPkg).Tracef(
-		"Entries: %v", len(is.Values))
-	timeStampStr := "DATETIME"
-	if dbh.conf.UsePostgres {
-		timeStampStr = "TIMESTAMP"
-	}
-	str.WriteString("CREATE TABLE IF NOT EXISTS " + tableName + " (Timestamp " + timeStampStr + ", ")
-	columnsOfText := make(map[int]int)
-	for columnNr, name := range is.Names {
-		temp := strings.TrimSpace(is.Values[columnNr])
-		_, errInt := strconv.ParseInt(temp, 0, 64)
-		_, errFloat := strconv.ParseFloat(temp, 64)
-		if errInt == nil || errFloat == nil || is.Values[columnNr] == "float" {
-			str.WriteString(name + " REAL DEFAULT NULL, ")
-			columnsOfText[columnNr] = columnFloatType
-		} else {
-			str.WriteString(name + " TEXT DEFAULT NULL, ")
-			columnsOfText[columnNr] = columnTextType
-			log.WithField("package", logPkg).Tracef(
-				"Is no number: %v", is.Values[columnNr])
-		}
-	}
+// InsertRowToTableContext inserts one row into database
+func (dbh *DbHandler) InsertRowToTableContext(ctx context.Context, tableName string, is ImportRowStruct) error {
+	return dbh.insertWideRows(ctx, tableName, is.Names, []ImportRowStruct{is})
+}
 
-	sqlStr := str.String()[0 : len(str.String())-2]
-	sqlStr += ", Fetched INTEGER DEFAULT 0);"
-	log.WithField("package", logPkg).Tracef("create query: %s", sqlStr)
+// InvalidRowsError reports rows which were dropped because they can't be
+// written, the other rows were written.
+type InvalidRowsError struct {
+	Table  string
+	Rows   []ImportRowStruct
+	Errors []error // why each row is invalid
+}
+
+func (e *InvalidRowsError) Error() string {
+	return fmt.Sprintf("dropped %d invalid rows of %s: %v", len(e.Rows), e.Table, e.Errors[0])
+}
 
-	err := dbh.execute(func() error {
-		_, err := dbh.DB.Query(sqlStr)
+// insertWideRows inserts rows with the columns names into a wide table with
+// a Fetched column, which is created if it doesn't exist. Rows with too few
+// values or an invalid timestamp are skipped and returned in an
+// InvalidRowsError.
+func (dbh *DbHandler) insertWideRows(ctx context.Context, tableName string, names []string, importRows []ImportRowStruct) error {
+	logFields := log.Fields{"package": logPkg, "func": "InsertRowToTable"}
+	log.WithFields(logFields).Tracef("Columns: %v", names)
+	log.WithFields(logFields).Tracef("Rows: %v", len(importRows))
+	var invalid *InvalidRowsError
+	valid := make([]ImportRowStruct, 0, len(importRows))
+	timestamps := make([]string, 0, len(importRows))
+	for _, is := range importRows {
+		var timestamp string
+		var err error
+		if len(is.Values) < len(names) {
+			err = fmt.Errorf("row has %d values for %d columns", len(is.Values), len(names))
+		} else {
+			timestamp, err = normalizeTimestamp(is.Timestamp)
+		}
 		if err != nil {
-			log.WithField("package", logPkg).Errorf("Failed to create db %v", err)
-			return fmt.Errorf("failed to execute sql string: %v", err)
+			if invalid == nil {
+				invalid = &InvalidRowsError{Table: tableName}
+			}
+			invalid.Rows = append(invalid.Rows, is)
+			invalid.Errors = append(invalid.Errors, err)
+			continue
 		}
-		return nil
-	})
-	if err != nil {
-		return err
+		valid = append(valid, is)
+		timestamps = append(timestamps, timestamp)
 	}
-
-	str.Reset()
-	str.WriteString("INSERT INTO " + tableName + " (Timestamp, ")
-	isFirst := true
-	for _, name := range is.Names {
-		if isFirst {
-			isFirst = false
-			str.WriteString(name)
-		} else {
-			str.WriteString(", " + name)
+	if invalid != nil {
+		log.WithFields(logFields).Warnf("Skip %d invalid rows of %s: %v", len(invalid.Rows), tableName, invalid.Errors[0])
+		if len(valid) == 0 {
+			return invalid
 		}
-
 	}
-	str.WriteString(") VALUES \n")
-
-	str.WriteString("('" + is.Timestamp + "', ")
-	isFirst = true
-	for dataIndex := range is.Names {
-		val := strings.TrimSpace(is.Values[dataIndex])
-		if columnsOfText[dataIndex] == columnFloatType || columnsOfText[dataIndex] == columnIntegerType {
-			_, errFloat := strconv.ParseFloat(val, 64)
-			_, errInt := strconv.ParseInt(val, 0, 64)
-			if errFloat != nil && errInt != nil {
-				// we hope the db doesn't mind and accepts float for int and vice versa
-				log.WithField("package", logPkg).Warnf(
-					"Skip number because parsing failed: %s", errFloat)
-				val = "null"
+	importRows = valid
 
+	samples := make([]string, len(names))
+	for columnNr := range names {
+		// the first value which isn't missing defines the column type
+		samples[columnNr] = importRows[0].Values[columnNr]
+		for _, is := range importRows {
+			if !isMissingValue(is.Values[columnNr]) {
+				samples[columnNr] = is.Values[columnNr]
+				break
 			}
 		}
-		if columnsOfText[dataIndex] == columnTextType {
-			val = "'" + val + "'"
-		}
-		if isFirst {
-			str.WriteString(val)
-			isFirst = false
+	}
+	columnTypes, err := dbh.createWideTable(ctx, tableName, names, samples, true)
+	if err != nil {
+		return err
+	}
 
-		} else {
-			str.WriteString(", " + val)
+	rows := make([][]any, 0, len(importRows))
+	coerced := 0
+	for i, is := range importRows {
+		row := make([]any, 0, len(names)+1)
+		row = append(row, timestamps[i])
+		for dataIndex := range names {
+			val := strings.TrimSpace(is.Values[dataIndex])
+			if columnTypes[dataIndex] == columnTextType {
+				row = append(row, val)
+				continue
+			}
+			number := parseNumber(val)
+			if number == nil && !isMissingValue(val) {
+				// we hope the db doesn't mind and accepts float for int and vice versa
+				log.WithFields(logFields).Warnf(
+					"Skip number because parsing failed: %s", val)
+				coerced++
+			}
+			row = append(row, number)
 		}
+		rows = append(rows, row)
 	}
-	str.WriteString("),\n")
-	log.WithField("package", logPkg).Traceln("Finished creating string")
-	sqlStr = str.String()
-
-	sqlStr = sqlStr[0 : len(sqlStr)-2]
 
-	if err := dbh.writeToDB(sqlStr); err != nil {
-		log.WithField("package", logPkg).Errorf("Failed to execute sql-statement: %v\n", err)
-		return fmt.Errorf("failed to execute sql-statement: %v", err)
+	columns := append([]string{"Timestamp"}, names...)
+	if err := dbh.insertRows(ctx, tableName, columns, rows, ""); err != nil {
+		log.WithFields(logFields).Errorf("Failed to execute sql-statement: %v", err)
+		return fmt.Errorf("failed to execute sql-statement: %w", err)
+	}
+	dbh.metrics.addCoercedNulls(tableName, coerced)
+	if invalid != nil {
+		return invalid
 	}
 	return nil
 }
 
+// ReadTPH reads up to 1000 unfetched rows of sensor_data. Timestamps have
+// milliseconds and values six decimals, NULL values are empty strings.
+//
+// Deprecated: use ReadUnfetched and MarkFetched.
 func (dbh *DbHandler) ReadTPH() ImportStruct {
-	logFields := log.Fields{"package": logPkg, "fnct": "readTPH"}
-
-	names := []string{"Temperature", "Pressure", "Humidity"}
-	sqlstr := `SELECT TIMESTAMP, Temperature, Pressure, Humidity FROM sensor_data WHERE Fetched = 0 ORDER BY Timestamp;`
-	log.WithFields(logFields).Tracef("Select statement: %v", sqlstr)
+	return dbh.ReadTPHContext(context.Background())
+}
 
-	rows, err := dbh.DB.Query(sqlstr)
+// ReadTPHContext reads up to 1000 unfetched rows of sensor_data, see ReadTPH.
+//
+// Deprecated: use ReadUnfetchedContext and MarkFetchedContext.
+func (dbh *DbHandler) ReadTPHContext(ctx context.Context) ImportStruct {
+	batch, err := dbh.ReadUnfetchedContext(ctx, "sensor_data", []string{"Temperature", "Pressure", "Humidity"}, 1000)
 	if err != nil {
-		log.Fatal(err)
+		return ImportStruct{}
 	}
-
-	var timestamps []string
-	var Temperatures []string
-	var Pressures []string
-	var Humiditys []string
-	counter := 0
-	for rows.Next() {
-		var timestamp time.Time
-		var temperature float32
-		var pressure float32
-		var humidity float32
-		err = rows.Scan(&timestamp, &temperature, &pressure, &humidity)
-		if err != nil {
-			log.WithFields(logFields).Warn(err)
-			continue
+	// keep the format of earlier versions
+	for i, timestamp := range batch.Rows.Timestamps {
+		if t, err := ParseTimestamp(timestamp); err == nil {
+			batch.Rows.Timestamps[i] = t.Format("2006-01-02 15:04:05.000")
 		}
-		timestamps = append(timestamps, timestamp.Format("2006-01-02 15:04:05.000"))
-		Temperatures = append(Temperatures, fmt.Sprintf("%f", temperature))
-		Pressures = append(Pressures, fmt.Sprintf("%f", pressure))
-		Humiditys = append(Humiditys, fmt.Sprintf("%f", humidity))
-		if counter > 1000 {
-			log.WithFields(logFields).Warnln("1000 reached")
-			break
-		}
-		counter++
 	}
-	var data [][]string
-	data = append(data, Temperatures)
-	data = append(data, Pressures)
-	data = append(data, Humiditys)
-	rows.Close()
-
-	return ImportStruct{
-		Names:      names,
-		Timestamps: timestamps,
-		Data:       data,
+	for _, values := range batch.Rows.Data {
+		for i, value := range values {
+			if number := parseNumber(value); number != nil {
+				values[i] = fmt.Sprintf("%f", float32(number.(float64)))
+			}
+		}
 	}
+	return batch.Rows
 }
 
 func (dbh *DbHandler) ReadAllTPH() ImportStruct {
+	return dbh.ReadAllTPHContext(context.Background())
+}
+
+func (dbh *DbHandler) ReadAllTPHContext(ctx context.Context) ImportStruct {
 	logFields := log.Fields{"package": logPkg, "fnct": "readTPH"}
 
 	names := []string{"Temperature", "Pressure", "Humidity"}
 	sqlstr := `SELECT TIMESTAMP, Temperature, Pressure, Humidity FROM living;`
 	log.WithFields(logFields).Tracef("Select statement: %v", sqlstr)
 	var rows *sql.Rows
-	err := dbh.execute(func() error {
+	err := dbh.execute(ctx, func() error {
 		var err error
-		rows, err = dbh.DB.Query(sqlstr)
-		if err != nil {
-			log.Fatal(err)
-		}
-		return nil
+		rows, err = dbh.DB.QueryContext(ctx, sqlstr)
+		return err
 	})
 	if err != nil {
 		log.WithFields(logFields).Errorf("Failed to read from db: %v", err)
@@ -465,12 +491,32 @@ func (dbh *DbHandler) ReadAllTPH() ImportStruct {
 	}
 }
 
+// SetFetched marks the rows of sensor_data between both timestamps as fetched.
+// The timestamps may have any precision, e.g. those returned by ReadTPH.
+//
+// Deprecated: rows inserted in between are marked as well, use MarkFetched.
 func (dbh *DbHandler) SetFetched(firstTimestamp string, lastTimestamp string) error {
+	return dbh.SetFetchedContext(context.Background(), firstTimestamp, lastTimestamp)
+}
+
+// SetFetchedContext marks the rows of sensor_data between both timestamps as fetched.
+//
+// Deprecated: rows inserted in between are marked as well, use MarkFetchedContext.
+func (dbh *DbHandler) SetFetchedContext(ctx context.Context, firstTimestamp string, lastTimestamp string) error {
 	logFields := log.Fields{"package": logPkg, "fnct": "SetFetched"}
+	firstTimestamp, err := normalizeTimestamp(firstTimestamp)
+	if err != nil {
+		return err
+	}
+	lastTimestamp, err = normalizeTimestamp(lastTimestamp)
+	if err != nil {
+		return err
+	}
 
-	statement := "UPDATE sensor_data SET Fetched=? WHERE Timestamp<=? AND Timestamp>=?"
-	err := dbh.execute(func() error {
-		res, err := dbh.DB.Exec(statement)
+	statement := "UPDATE sensor_data SET Fetched = " + dbh.placeholder(1) +
+		" WHERE Timestamp <= " + dbh.placeholder(2) + " AND Timestamp >= " + dbh.placeholder(3)
+	err = dbh.execute(ctx, func() error {
+		res, err := dbh.DB.ExecContext(ctx, statement, 1, lastTimestamp, firstTimestamp)
 		if err != nil {
 			log.WithFields(logFields).Errorf("Failed to get affected rows ... :  %v, %v", err, statement)
 			return err
@@ -492,13 +538,26 @@ func (dbh *DbHandler) SetFetched(firstTimestamp string, lastTimestamp string) er
 
 // AddColumnToTable adds a column with type number into table (real default null))
 func (dbh *DbHandler) AddColumnToTable(tableName string, columnName string) error {
+	return dbh.AddColumnToTableContext(context.Background(), tableName, columnName)
+}
+
+// AddColumnToTableContext adds a column with type number into table (real default null))
+func (dbh *DbHandler) AddColumnToTableContext(ctx context.Context, tableName string, columnName string) error {
 	logFields := log.Fields{"package": logPkg, "func": "AddColumnToTable"}
+	table, err := dbh.quoteIdentifier(tableName)
+	if err != nil {
+		return err
+	}
+	column, err := dbh.quoteName(columnName)
+	if err != nil {
+		return err
+	}
 
-	err := dbh.execute(func() error {
+	err = dbh.execute(ctx, func() error {
 		log.WithFields(logFields).Infof("Add %v to %v", columnName, tableName)
 
-		_, err := dbh.DB.Exec(`ALTER TABLE ` + tableName +
-			` ADD COLUMN IF NOT EXISTS "` + columnName + `" REAL DEFAULT NULL;`)
+		_, err := dbh.DB.ExecContext(ctx, `ALTER TABLE `+table+
+			` ADD COLUMN IF NOT EXISTS `+column+` REAL DEFAULT NULL;`)
 		if err != nil {
 			log.WithFields(logFields).Errorf("Failed to add column to table %v: %v", tableName, err)
 			return err
@@ -511,93 +570,128 @@ func (dbh *DbHandler) AddColumnToTable(tableName string, columnName string) erro
 
 func GetDefaultDBConfig() DBConfig {
 	return DBConfig{
-		Name:        "data.db",
-		IPOrPath:    "",
-		UsePostgres: false,
-		User:        "webuser",
-		Password:    "PlottyPW",
-		Port:        5432,
+		Name:           "data.db",
+		IPOrPath:       "",
+		UsePostgres:    false,
+		User:           "webuser",
+		Password:       "PlottyPW",
+		Port:           5432,
+		SkipMigrations: false,
 	}
 }
 
+// LoadDBConfig reads a config in JSON format, missing fields keep the
+// values of GetDefaultDBConfig. An empty path returns the defaults.
+func LoadDBConfig(path string) (DBConfig, error) {
+	conf := GetDefaultDBConfig()
+	if len(path) == 0 {
+		return conf, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return conf, err
+	}
+	if err := json.Unmarshal(data, &conf); err != nil {
+		return conf, fmt.Errorf("invalid config %s: %v", path, err)
+	}
+	return conf, nil
+}
+
 // CreateTimeseriesTable creates a table for timeseries values.
-// Consider adding timescaledb features for postgres.
+// See CreateTimeseriesTableWithOptions for unique keys and timescaledb features.
 func (dbh *DbHandler) CreateTimeseriesTable(tableName string) error {
-	timeStampStr := "DATETIME"
-	if dbh.conf.UsePostgres {
-		timeStampStr = "TIMESTAMP"
+	return dbh.CreateTimeseriesTableContext(context.Background(), tableName)
+}
+
+// CreateTimeseriesTableContext creates a table for timeseries values. On
+// sqlite it has an autoincrement id which the Replicator uses as position.
+func (dbh *DbHandler) CreateTimeseriesTableContext(ctx context.Context, tableName string) error {
+	table, err := dbh.quoteIdentifier(tableName)
+	if err != nil {
+		return err
 	}
 
-	sqlStr := `CREATE TABLE IF NOT EXISTS ` + tableName + ` (
-		time ` + timeStampStr + `,
+	id := ""
+	if !dbh.conf.UsePostgres {
+		id = "id INTEGER PRIMARY KEY AUTOINCREMENT,\n\t\t"
+	}
+	sqlStr := `CREATE TABLE IF NOT EXISTS ` + table + ` (
+		` + id + `time ` + dbh.timestampType() + `,
 		tag        TEXT                NOT NULL,
 		value      DOUBLE PRECISION    NULL,
 		comment    TEXT                DEFAULT ''
 	   );
 	 `
-	return dbh.writeToDB(sqlStr)
+	return dbh.writeToDB(ctx, sqlStr)
 }
 
 // InsertTimeseries stores values into timeseries table
 func (dbh *DbHandler) InsertTimeseries(is TimeseriesImportStruct, onClonflictDoNothing bool, table string) error {
-	var str strings.Builder
-	log.WithField("package", logPkg).Tracef(
-		"Entries: %v", is.Values)
-	log.WithField("package", logPkg).Infof(
-		"Tag: %v", is.Tag)
-	str.Reset()
+	return dbh.InsertTimeseriesContext(context.Background(), is, onClonflictDoNothing, table)
+}
 
-	str.WriteString("INSERT INTO " + table + " (time, tag, value)")
-	log.WithField("package", logPkg).Infof("Insert string: %v", str.String())
-	str.WriteString(" VALUES \n")
+// InsertTimeseriesContext stores values into timeseries table
+func (dbh *DbHandler) InsertTimeseriesContext(ctx context.Context, is TimeseriesImportStruct, onClonflictDoNothing bool, table string) error {
+	logFields := log.Fields{"package": logPkg, "func": "InsertTimeseries"}
+	log.WithFields(logFields).Tracef("Entries: %v", is.Values)
+	log.WithFields(logFields).Infof("Tag: %v", is.Tag)
+	if len(is.Values) < len(is.Timestamps) {
+		return fmt.Errorf("tag %s has %d values for %d timestamps",
+			is.Tag, len(is.Values), len(is.Timestamps))
+	}
 
+	rows := make([][]any, 0, len(is.Timestamps))
+	points := make([]Point, 0, len(is.Timestamps))
+	coerced := 0
 	for entryIndex, ts := range is.Timestamps {
-		str.WriteString("('" + ts + "', '" + is.Tag + "',")
-
+		t, err := ParseTimestamp(ts)
+		if err != nil {
+			return fmt.Errorf("tag %s: %v", is.Tag, err)
+		}
+		timestamp := FormatTimestamp(t)
 		val := strings.TrimSpace(is.Values[entryIndex])
-		_, errFloat := strconv.ParseFloat(val, 64)
-		_, errInt := strconv.ParseInt(val, 0, 64)
-		if errFloat != nil && errInt != nil {
+		number := parseNumber(val)
+		if number == nil && !isMissingValue(val) {
 			// it can be float or integer, db-type is set to real
-			log.WithField("package", logPkg).Infof(
-				"Skip number in %s because parsing failed: %s", is.Values[entryIndex], errFloat)
-			val = "null" // this can be imported in column of type real
-
+			log.WithFields(logFields).Infof(
+				"Skip number in %s because parsing failed: %s", is.Tag, val)
+			coerced++
 		}
-		str.WriteString(val + "),\n")
-		if entryIndex%100000 == 0 && entryIndex != 0 {
-			sqlStr := str.String()
-			sqlStr = sqlStr[0 : len(sqlStr)-2]
-			if onClonflictDoNothing {
-				sqlStr += " on conflict do nothing"
-			}
-			err := dbh.writeToDB(sqlStr)
-			if err != nil {
-				log.WithField("package", logPkg).Errorf("%v", err)
-				return err
+		row := []any{timestamp, is.Tag, number}
+		point := Point{Time: t, Tag: is.Tag, Value: math.NaN()}
+		if number != nil {
+			point.Value = number.(float64)
+		}
+		if len(is.Comments) > 0 {
+			if entryIndex < len(is.Comments) {
+				point.Comment = is.Comments[entryIndex]
 			}
-			str.Reset()
-			str.WriteString("INSERT INTO measurements (time, tag, value)")
-			log.WithField("package", logPkg).Infof("Insert string: %v", str.String())
-			str.WriteString(" VALUES \n")
+			row = append(row, point.Comment)
 		}
+		rows = append(rows, row)
+		points = append(points, point)
 	}
-	log.WithField("package", logPkg).Traceln("Finished creating string")
-	sqlStr := str.String()
-	sqlStr = sqlStr[0 : len(sqlStr)-2]
+	log.WithFields(logFields).Traceln("Finished creating rows")
+
+	suffix := ""
 	if onClonflictDoNothing {
-		sqlStr += " on conflict  do nothing"
+		suffix = "ON CONFLICT DO NOTHING"
+	}
+	columns := []string{"time", "tag", "value"}
+	if len(is.Comments) > 0 {
+		columns = append(columns, "comment")
 	}
-	err := dbh.writeToDB(sqlStr)
+	err := dbh.insertRows(ctx, table, columns, rows, suffix)
 	if err != nil {
-		log.WithField("package", logPkg).Errorf("%v", err)
+		log.WithFields(logFields).Errorf("%v", err)
 		return err
 	}
-
+	dbh.metrics.addCoercedNulls(table, coerced)
+	dbh.afterInsert(ctx, table, points)
 	return nil
 }
 
-func (dbh *DbHandler) writeToDB(sqlStr string) error {
+func (dbh *DbHandler) writeToDB(ctx context.Context, sqlStr string) error {
 
 	if len(sqlStr) > 2000 {
 		log.WithField("package", logPkg).Tracef(
@@ -608,8 +702,10 @@ func (dbh *DbHandler) writeToDB(sqlStr string) error {
 		log.WithField("package", logPkg).Tracef(
 			"full query: %s\n", sqlStr)
 	}
-	err := dbh.execute(func() error {
-		_, err := dbh.DB.Exec(sqlStr)
+	err := dbh.execute(ctx, func() error {
+		start := time.Now()
+		_, err := dbh.DB.ExecContext(ctx, sqlStr)
+		dbh.metrics.observeQuery("exec", time.Since(start))
 		if err != nil {
 			log.WithField("package", logPkg).Error(err)
 			return err
@@ -620,6 +716,10 @@ func (dbh *DbHandler) writeToDB(sqlStr string) error {
 }
 
 func (db *DbHandler) ExecuteQuery(sqlStr string, args ...any) (*sql.Rows, error) {
+	return db.ExecuteQueryContext(context.Background(), sqlStr, args...)
+}
+
+func (db *DbHandler) ExecuteQueryContext(ctx context.Context, sqlStr string, args ...any) (*sql.Rows, error) {
 	logFields := log.Fields{"fnct": "executeQuery"}
 	log.WithFields(logFields).Infof("Execute query")
 
@@ -633,9 +733,11 @@ func (db *DbHandler) ExecuteQuery(sqlStr string, args ...any) (*sql.Rows, error)
 			"full query: %s\n", sqlStr)
 	}
 	var rows *sql.Rows
-	err := db.execute(func() error {
+	err := db.execute(ctx, func() error {
 		var err error
-		rows, err = db.DB.Query(sqlStr, args...)
+		start := time.Now()
+		rows, err = db.DB.QueryContext(ctx, sqlStr, args...)
+		db.metrics.observeQuery("query", time.Since(start))
 		if err != nil {
 			log.WithField("package", logPkg).Error(err)
 			return err
@@ -652,14 +754,37 @@ func (db *DbHandler) ExecuteQuery(sqlStr string, args ...any) (*sql.Rows, error)
 	return rows, nil
 }
 
-func (db *DbHandler) execute(operation func() error) error {
+// execute runs operation exclusively. Waiting for a free slot is aborted
+// when ctx is done or the handler timeout is reached.
+func (db *DbHandler) execute(ctx context.Context, operation func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	timer := time.NewTimer(db.timeout)
+	defer timer.Stop()
+	start := time.Now()
 	select {
 	case db.semaphore <- struct{}{}:
 		defer func() { <-db.semaphore }()
-		db.mutex.Lock()
-		defer db.mutex.Unlock()
-		return operation()
-	case <-time.After(db.timeout):
-		return errors.New("operation timed out waiting for semaphore")
-	}
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		db.metrics.addTimeout("semaphore")
+		return fmt.Errorf("%w waiting for semaphore", ErrTimeout)
+	}
+	db.metrics.observeSemaphoreWait(time.Since(start))
+	start = time.Now()
+	select {
+	case db.lock <- struct{}{}:
+		defer func() { <-db.lock }()
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		db.metrics.addTimeout("lock")
+		return fmt.Errorf("%w waiting for lock", ErrTimeout)
+	}
+	db.metrics.observeLockWait(time.Since(start))
+	start = time.Now()
+	defer func() { db.metrics.observeLockHold(time.Since(start)) }()
+	return operation()
 }
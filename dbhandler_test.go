@@ -1,16 +1,32 @@
 package timeseries
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"math/rand"
-	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
+// newTestDbHandler opens an independent sqlite database in a temp directory
+func newTestDbHandler(t *testing.T) *DbHandler {
+	t.Helper()
+	conf := GetDefaultDBConfig()
+	conf.IPOrPath = t.TempDir() + string(filepath.Separator)
+	dbh, err := NewDbHandler(conf)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	t.Cleanup(func() { dbh.Close() })
+	return dbh
+}
+
 func TestDb(t *testing.T) {
+	t.Parallel()
 	log.SetLevel(log.WarnLevel)
 	names := []string{"randFloat", "randFloat2Mix", "randInt", "randText"}
 	var timestamps []string
@@ -44,20 +60,15 @@ func TestDb(t *testing.T) {
 		Data:       data,
 	}
 
-	fmt.Printf("data:%+v", is)
-	dbh := DBHandler(GetDefaultDBConfig())
-	defer dbh.Close()
+	dbh := newTestDbHandler(t)
 	err := dbh.InsertIntoDatabase("randomtest", is)
 	if err != nil {
 		t.Fatalf("Failed to insert data:%v", err)
 	}
-	err = os.Remove("data.db")
-	if err != nil {
-		t.Errorf("Failed to remove data:%v", err)
-	}
 }
 
 func TestDBStructs(t *testing.T) {
+	t.Parallel()
 	var importRows []ImportRowStruct
 	for i := 0; i < 10; i++ {
 		names := []string{"first", "second", "third"}
@@ -69,8 +80,7 @@ func TestDBStructs(t *testing.T) {
 		}
 		importRows = append(importRows, is)
 	}
-	dbh := DBHandler(GetDefaultDBConfig())
-	defer dbh.Close()
+	dbh := newTestDbHandler(t)
 	_, err := dbh.InsertRowsToTable("migrateTest", importRows)
 	if err != nil {
 		t.Fatalf("Failed to insert data:%v", err)
@@ -79,8 +89,109 @@ func TestDBStructs(t *testing.T) {
 	if err != nil {
 		t.Errorf("Failed to insert data after CreateImportTable:%v", err)
 	}
-	err = os.Remove("data.db")
+}
+
+func TestMultipleHandlers(t *testing.T) {
+	t.Parallel()
+	first := newTestDbHandler(t)
+	second := newTestDbHandler(t)
+	if first == second || first.DB == second.DB {
+		t.Fatalf("Expected independent handlers")
+	}
+	if err := first.CreateTimeseriesTable("buffer"); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	is := TimeseriesImportStruct{
+		Tag:        "first",
+		Timestamps: []string{"2023-01-01 10:00:00.000"},
+		Values:     []string{"1.5"},
+	}
+	if err := first.InsertTimeseries(is, false, "buffer"); err != nil {
+		t.Fatalf("Failed to insert into first: %v", err)
+	}
+	if err := second.InsertTimeseries(is, false, "buffer"); err == nil {
+		t.Fatalf("Expected missing table in second database")
+	}
+}
+
+func TestInsertQuotes(t *testing.T) {
+	t.Parallel()
+	dbh := newTestDbHandler(t)
+	if err := dbh.CreateTimeseriesTable(DefaultTimeseriesTable); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	tag := "it's'); DROP TABLE measurements; --"
+	is := TimeseriesImportStruct{
+		Tag:        tag,
+		Timestamps: []string{"2023-01-01 10:00:00.000", "2023-01-01 10:01:00.000"},
+		Values:     []string{"1.5", "no number"},
+	}
+	if err := dbh.InsertTimeseries(is, false, DefaultTimeseriesTable); err != nil {
+		t.Fatalf("Failed to insert quoted tag: %v", err)
+	}
+	row := ImportRowStruct{
+		Names:     []string{"Temperature", "Note"},
+		Timestamp: "2023-01-01 10:00:00.000",
+		Values:    []string{"21.5", "it's 'quoted'"},
+	}
+	if err := dbh.InsertRowToTable("living", row); err != nil {
+		t.Fatalf("Failed to insert quoted text: %v", err)
+	}
+
+	rows, err := dbh.ExecuteQuery("SELECT tag, value FROM measurements ORDER BY time")
 	if err != nil {
-		t.Errorf("Failed to remove data:%v", err)
+		t.Fatalf("Failed to query: %v", err)
+	}
+	defer rows.Close()
+	count := 0
+	for rows.Next() {
+		var readTag string
+		var value *float64
+		if err := rows.Scan(&readTag, &value); err != nil {
+			t.Fatalf("Failed to scan: %v", err)
+		}
+		if readTag != tag {
+			t.Errorf("Expected tag %q but got %q", tag, readTag)
+		}
+		if count == 1 && value != nil {
+			t.Errorf("Expected text value to be stored as null but got %v", *value)
+		}
+		count++
+	}
+	if count != 2 {
+		t.Errorf("Expected 2 rows but got %d", count)
+	}
+	if err := dbh.InsertRowToTable("a.b.c", row); err == nil {
+		t.Errorf("Expected invalid table name to be rejected")
+	}
+}
+
+func TestExecuteContext(t *testing.T) {
+	t.Parallel()
+	dbh := newTestDbHandler(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := dbh.CreateTimeseriesTableContext(ctx, DefaultTimeseriesTable); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected cancelled context but got %v", err)
+	}
+
+	// block the handler and check that waiting for it respects the deadline
+	release := make(chan struct{})
+	started := make(chan struct{})
+	go dbh.execute(context.Background(), func() error {
+		close(started)
+		<-release
+		return nil
+	})
+	<-started
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := dbh.ExecuteQueryContext(ctx, "SELECT 1")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected deadline exceeded but got %v", err)
+	}
+	close(release)
+	if err := dbh.CreateTimeseriesTableContext(context.Background(), DefaultTimeseriesTable); err != nil {
+		t.Errorf("Failed to create table after release: %v", err)
 	}
 }
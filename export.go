@@ -0,0 +1,241 @@
+package timeseries
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ExportFormat is the file format written by ExportSeries and ExportTable
+type ExportFormat string
+
+const (
+	ExportCSV    ExportFormat = "csv"
+	ExportTSV    ExportFormat = "tsv"
+	ExportNDJSON ExportFormat = "ndjson" // one JSON object per line, infinite values are the strings "+Inf" and "-Inf"
+)
+
+// ExportOptions configures ExportSeries and ExportTable
+type ExportOptions struct {
+	Format          ExportFormat   // ExportCSV if empty
+	TimestampLayout string         // Go layout, "unix" or "unixms", TimestampLayout if empty
+	Location        *time.Location // zone of the written timestamps, UTC if nil
+	Columns         []string       // ExportTable: columns to export, all except Timestamp, id and Fetched if empty
+}
+
+// ExportSeries streams the points of the tags in [from, to) of a timeseries
+// table ordered by time and tag, with the columns time, tag, value and comment.
+// All tags are exported if tags is empty and to is open if it is zero. The
+// rows are written while they are read, so large ranges don't have to fit
+// into memory. It returns the number of written rows.
+func (dbh *DbHandler) ExportSeries(w io.Writer, table string, tags []string, from time.Time, to time.Time, opts ExportOptions) (int64, error) {
+	return dbh.ExportSeriesContext(context.Background(), w, table, tags, from, to, opts)
+}
+
+// ExportSeriesContext streams points of a timeseries table, see ExportSeries.
+func (dbh *DbHandler) ExportSeriesContext(ctx context.Context, w io.Writer, table string, tags []string, from time.Time, to time.Time, opts ExportOptions) (int64, error) {
+	quoted, err := dbh.quoteIdentifier(table)
+	if err != nil {
+		return 0, err
+	}
+	where, args := dbh.exportRange("time", from, to)
+	if len(tags) > 0 {
+		where += " AND tag IN (" + dbh.placeholders(len(args)+1, len(tags)) + ")"
+		for _, tag := range tags {
+			args = append(args, tag)
+		}
+	}
+	sqlStr := "SELECT time, tag, value, comment FROM " + quoted + where + " ORDER BY time, tag"
+	return dbh.export(ctx, w, table, sqlStr, args, []string{"time", "tag", "value", "comment"}, opts)
+}
+
+// ExportTable streams the rows of a wide table in [from, to) ordered by
+// Timestamp, see ExportSeries.
+func (dbh *DbHandler) ExportTable(w io.Writer, table string, from time.Time, to time.Time, opts ExportOptions) (int64, error) {
+	return dbh.ExportTableContext(context.Background(), w, table, from, to, opts)
+}
+
+// ExportTableContext streams the rows of a wide table, see ExportTable.
+func (dbh *DbHandler) ExportTableContext(ctx context.Context, w io.Writer, table string, from time.Time, to time.Time, opts ExportOptions) (int64, error) {
+	quotedTable, err := dbh.quoteIdentifier(table)
+	if err != nil {
+		return 0, err
+	}
+	columns, _, err := dbh.wideColumns(ctx, table, opts.Columns)
+	if err != nil {
+		return 0, err
+	}
+	quoted, err := dbh.quoteIdentifiers(columns)
+	if err != nil {
+		return 0, err
+	}
+	where, args := dbh.exportRange("Timestamp", from, to)
+	sqlStr := "SELECT Timestamp, " + strings.Join(quoted, ", ") + " FROM " + quotedTable + where + " ORDER BY Timestamp"
+	return dbh.export(ctx, w, table, sqlStr, args, append([]string{"Timestamp"}, columns...), opts)
+}
+
+// exportRange returns the condition for [from, to), to is open if it is zero
+func (dbh *DbHandler) exportRange(column string, from time.Time, to time.Time) (string, []any) {
+	where := " WHERE " + column + " >= " + dbh.placeholder(1)
+	args := []any{FormatTimestamp(from)}
+	if !to.IsZero() {
+		where += " AND " + column + " < " + dbh.placeholder(2)
+		args = append(args, FormatTimestamp(to))
+	}
+	return where, args
+}
+
+// export runs a query whose first column is a timestamp and writes every row
+func (dbh *DbHandler) export(ctx context.Context, w io.Writer, table string, sqlStr string, args []any, columns []string, opts ExportOptions) (int64, error) {
+	logFields := log.Fields{"package": logPkg, "func": "export"}
+	writer, err := newExportWriter(w, columns, opts)
+	if err != nil {
+		return 0, err
+	}
+	rows, err := dbh.ExecuteQueryContext(ctx, sqlStr, args...)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	var count int64
+	values := make([]any, len(columns))
+	dest := make([]any, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return count, err
+		}
+		timestamp, err := scanTime(values[0])
+		if err != nil {
+			return count, err
+		}
+		values[0] = timestamp
+		if err := writer.write(values); err != nil {
+			return count, err
+		}
+		count++
+	}
+	if err := rows.Err(); err != nil {
+		return count, err
+	}
+	if err := writer.flush(); err != nil {
+		return count, err
+	}
+	log.WithFields(logFields).Infof("Exported %d rows of %s", count, table)
+	return count, nil
+}
+
+// exportWriter writes rows in one of the export formats
+type exportWriter struct {
+	columns []string
+	format  ExportFormat
+	layout  string
+	loc     *time.Location
+	csv     *csv.Writer
+	json    *bufio.Writer
+	fields  []string
+}
+
+// newExportWriter creates a writer and writes the header of CSV and TSV files
+func newExportWriter(w io.Writer, columns []string, opts ExportOptions) (*exportWriter, error) {
+	writer := &exportWriter{columns: columns, format: opts.Format, layout: opts.TimestampLayout, loc: opts.Location}
+	if len(writer.format) == 0 {
+		writer.format = ExportCSV
+	}
+	if len(writer.layout) == 0 {
+		writer.layout = TimestampLayout
+	}
+	if writer.loc == nil {
+		writer.loc = time.UTC
+	}
+	switch writer.format {
+	case ExportCSV, ExportTSV:
+		writer.csv = csv.NewWriter(w)
+		if writer.format == ExportTSV {
+			writer.csv.Comma = '\t'
+		}
+		writer.fields = make([]string, len(columns))
+		return writer, writer.csv.Write(columns)
+	case ExportNDJSON:
+		writer.json = bufio.NewWriter(w)
+		return writer, nil
+	}
+	return nil, fmt.Errorf("unknown export format %q", opts.Format)
+}
+
+// write writes a row, the first value is the timestamp
+func (e *exportWriter) write(values []any) error {
+	timestamp := values[0].(time.Time)
+	if e.csv != nil {
+		e.fields[0] = e.formatTime(timestamp)
+		for i, value := range values[1:] {
+			e.fields[i+1] = formatScanned(value)
+		}
+		return e.csv.Write(e.fields)
+	}
+	e.json.WriteByte('{')
+	for i, column := range e.columns {
+		if i > 0 {
+			e.json.WriteByte(',')
+		}
+		key, _ := json.Marshal(column)
+		e.json.Write(key)
+		e.json.WriteByte(':')
+		var value []byte
+		var err error
+		switch v := values[i].(type) {
+		case time.Time:
+			value = []byte(e.formatTime(v))
+			if e.layout != "unix" && e.layout != "unixms" {
+				value, err = json.Marshal(string(value))
+			}
+		case []byte:
+			value, err = json.Marshal(string(v))
+		case float64:
+			// JSON has no infinity, it is written like in CSV
+			if math.IsInf(v, 0) || math.IsNaN(v) {
+				value, err = json.Marshal(formatScanned(v))
+			} else {
+				value, err = json.Marshal(v)
+			}
+		default:
+			value, err = json.Marshal(v)
+		}
+		if err != nil {
+			return err
+		}
+		e.json.Write(value)
+	}
+	_, err := e.json.WriteString("}\n")
+	return err
+}
+
+func (e *exportWriter) formatTime(t time.Time) string {
+	switch e.layout {
+	case "unix":
+		seconds := float64(t.UnixNano()) / 1e9
+		return strconv.FormatFloat(seconds, 'f', -1, 64)
+	case "unixms":
+		return strconv.FormatInt(t.UnixMilli(), 10)
+	}
+	return t.In(e.loc).Format(e.layout)
+}
+
+func (e *exportWriter) flush() error {
+	if e.csv != nil {
+		e.csv.Flush()
+		return e.csv.Error()
+	}
+	return e.json.Flush()
+}
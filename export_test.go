@@ -0,0 +1,98 @@
+package timeseries
+
+import (
+	"bytes"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestExportSeries(t *testing.T) {
+	t.Parallel()
+	dbh := newTestDbHandler(t)
+	start := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	series := []Series{
+		{Tag: "a", Points: []Point{{Time: start, Value: 1.5}, {Time: start.Add(time.Second), Value: math.NaN(), Comment: "off"}}},
+		{Tag: "b", Points: []Point{{Time: start, Value: 10}, {Time: start.Add(time.Hour), Value: 11}}},
+	}
+	if err := dbh.InsertSeries(series, false, DefaultTimeseriesTable); err != nil {
+		t.Fatalf("Failed to insert: %v", err)
+	}
+
+	var buf bytes.Buffer
+	rows, err := dbh.ExportSeries(&buf, DefaultTimeseriesTable, []string{"a", "b"}, start, start.Add(time.Minute), ExportOptions{})
+	if err != nil {
+		t.Fatalf("Failed to export: %v", err)
+	}
+	expected := "time,tag,value,comment\n" +
+		"2023-06-01 12:00:00,a,1.5,\n" +
+		"2023-06-01 12:00:00,b,10,\n" +
+		"2023-06-01 12:00:01,a,,off\n"
+	if rows != 3 || buf.String() != expected {
+		t.Errorf("Expected %d rows %q but got %d %q", 3, expected, rows, buf.String())
+	}
+
+	buf.Reset()
+	zurich := time.FixedZone("CEST", 2*60*60)
+	opts := ExportOptions{Format: ExportNDJSON, TimestampLayout: time.RFC3339, Location: zurich}
+	if _, err := dbh.ExportSeries(&buf, DefaultTimeseriesTable, []string{"b"}, start, time.Time{}, opts); err != nil {
+		t.Fatalf("Failed to export: %v", err)
+	}
+	expected = `{"time":"2023-06-01T14:00:00+02:00","tag":"b","value":10,"comment":""}` + "\n" +
+		`{"time":"2023-06-01T15:00:00+02:00","tag":"b","value":11,"comment":""}` + "\n"
+	if buf.String() != expected {
+		t.Errorf("Expected %q but got %q", expected, buf.String())
+	}
+
+	// infinite values don't abort the stream
+	infinite := []Point{{Time: start.Add(2 * time.Hour), Tag: "c", Value: math.Inf(1)}, {Time: start.Add(3 * time.Hour), Tag: "c", Value: math.Inf(-1)}}
+	if err := dbh.InsertPoints(infinite, false, DefaultTimeseriesTable); err != nil {
+		t.Fatalf("Failed to insert: %v", err)
+	}
+	buf.Reset()
+	if _, err := dbh.ExportSeries(&buf, DefaultTimeseriesTable, []string{"c"}, start, time.Time{}, ExportOptions{Format: ExportNDJSON}); err != nil {
+		t.Fatalf("Failed to export infinite values: %v", err)
+	}
+	expected = `{"time":"2023-06-01 14:00:00","tag":"c","value":"+Inf","comment":""}` + "\n" +
+		`{"time":"2023-06-01 15:00:00","tag":"c","value":"-Inf","comment":""}` + "\n"
+	if buf.String() != expected {
+		t.Errorf("Expected %q but got %q", expected, buf.String())
+	}
+
+	if _, err := dbh.ExportSeries(&buf, DefaultTimeseriesTable, nil, start, time.Time{}, ExportOptions{Format: "xml"}); err == nil {
+		t.Errorf("Expected error for unknown format")
+	}
+}
+
+func TestExportTable(t *testing.T) {
+	t.Parallel()
+	dbh := newTestDbHandler(t)
+	is := ImportStruct{
+		Names:      []string{"Temperature", "Room"},
+		Timestamps: []string{"2023-06-01 12:00:00", "2023-06-01 12:00:01", "2023-06-01 12:00:02"},
+		Data:       [][]string{{"20.5", "", "22"}, {"living", "kitchen", "bath"}},
+	}
+	if err := dbh.InsertIntoDatabase("living", is); err != nil {
+		t.Fatalf("Failed to insert: %v", err)
+	}
+	start := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	var buf bytes.Buffer
+	opts := ExportOptions{Format: ExportTSV, TimestampLayout: "unixms"}
+	rows, err := dbh.ExportTable(&buf, "living", start, start.Add(2*time.Second), opts)
+	if err != nil {
+		t.Fatalf("Failed to export: %v", err)
+	}
+	expected := "Timestamp\tTemperature\tRoom\n1685620800000\t20.5\tliving\n1685620801000\t\tkitchen\n"
+	if rows != 2 || buf.String() != expected {
+		t.Errorf("Expected %q but got %d %q", expected, rows, buf.String())
+	}
+
+	buf.Reset()
+	opts = ExportOptions{Format: ExportNDJSON, TimestampLayout: "unix", Columns: []string{"Temperature"}}
+	if _, err := dbh.ExportTable(&buf, "living", start.Add(2*time.Second), time.Time{}, opts); err != nil {
+		t.Fatalf("Failed to export: %v", err)
+	}
+	if expected := `{"Timestamp":1685620802,"Temperature":22}` + "\n"; buf.String() != expected {
+		t.Errorf("Expected %q but got %q", expected, buf.String())
+	}
+}
@@ -3,6 +3,7 @@ module github.com/pat-rohn/timeseries
 go 1.20
 
 require (
+	github.com/golang/snappy v0.0.4
 	github.com/lib/pq v1.10.9
 	github.com/sirupsen/logrus v1.9.0
 	modernc.org/sqlite v1.22.1
@@ -0,0 +1,366 @@
+package timeseries
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// grafanaSteps are the aggregation buckets of Grafana queries, longer
+// buckets are multiples of a day
+var grafanaSteps = []time.Duration{
+	time.Second, 2 * time.Second, 5 * time.Second, 10 * time.Second, 15 * time.Second, 30 * time.Second,
+	time.Minute, 2 * time.Minute, 5 * time.Minute, 10 * time.Minute, 15 * time.Minute, 30 * time.Minute,
+	time.Hour, 2 * time.Hour, 3 * time.Hour, 6 * time.Hour, 12 * time.Hour, 24 * time.Hour,
+}
+
+// grafanaRange is the time range of Grafana requests
+type grafanaRange struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+}
+
+// grafanaTarget is a query of a panel. The aggregate function (avg if
+// empty) is read from data (SimpleJSON) or payload (JSON datasource).
+type grafanaTarget struct {
+	Target string `json:"target"`
+	RefID  string `json:"refId"`
+	Type   string `json:"type"` // timeserie or table
+	Data   struct {
+		Aggregate AggregateFunc `json:"aggregate"`
+	} `json:"data"`
+	Payload struct {
+		Aggregate AggregateFunc `json:"aggregate"`
+	} `json:"payload"`
+}
+
+type grafanaFilter struct {
+	Key      string `json:"key"`
+	Operator string `json:"operator"`
+	Value    string `json:"value"`
+}
+
+type grafanaQuery struct {
+	Range         grafanaRange    `json:"range"`
+	IntervalMs    int64           `json:"intervalMs"`
+	MaxDataPoints int             `json:"maxDataPoints"`
+	Targets       []grafanaTarget `json:"targets"`
+	AdhocFilters  []grafanaFilter `json:"adhocFilters"`
+}
+
+type grafanaTimeserie struct {
+	Target     string   `json:"target"`
+	RefID      string   `json:"refId,omitempty"`
+	Datapoints [][2]any `json:"datapoints"` // value (null if missing) and unix milliseconds
+}
+
+type grafanaColumn struct {
+	Text string `json:"text"`
+	Type string `json:"type"`
+}
+
+type grafanaTable struct {
+	Type    string          `json:"type"`
+	RefID   string          `json:"refId,omitempty"`
+	Columns []grafanaColumn `json:"columns"`
+	Rows    [][]any         `json:"rows"`
+}
+
+type grafanaAnnotationQuery struct {
+	Range      grafanaRange `json:"range"`
+	Annotation struct {
+		Name  string `json:"name"`
+		Query string `json:"query"`
+	} `json:"annotation"`
+}
+
+// GrafanaHandler returns an http.Handler implementing the Grafana JSON
+// (SimpleJSON) datasource protocol on the timeseries table of the Server:
+//
+//	/             connection test
+//	/search       tags containing the target
+//	/query        points of tags, aggregated into buckets chosen from
+//	              intervalMs and maxDataPoints
+//	/annotations  comments of the tag given as query
+//	/tag-keys     the key tag for ad hoc filters
+//	/tag-values   the tags
+func (s *Server) GrafanaHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("/search", s.handleGrafanaSearch)
+	mux.HandleFunc("/query", s.handleGrafanaQuery)
+	mux.HandleFunc("/annotations", s.handleGrafanaAnnotations)
+	mux.HandleFunc("/tag-keys", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, []map[string]string{{"type": "string", "text": "tag"}})
+	})
+	mux.HandleFunc("/tag-values", s.handleGrafanaTagValues)
+	return mux
+}
+
+// decodeGrafanaRequest decodes the JSON body of a POST request into v
+func (s *Server) decodeGrafanaRequest(w http.ResponseWriter, r *http.Request, v any) bool {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, s.conf.MaxBodySize)).Decode(v); err != nil {
+		http.Error(w, fmt.Sprintf("invalid JSON: %v", err), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func (s *Server) handleGrafanaSearch(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Target string `json:"target"`
+	}
+	if !s.decodeGrafanaRequest(w, r, &request) {
+		return
+	}
+	tags, err := s.dbh.grafanaTags(r.Context(), s.conf.Table)
+	if err != nil {
+		http.Error(w, "failed to read tags", http.StatusInternalServerError)
+		return
+	}
+	result := []string{}
+	for _, tag := range tags {
+		if strings.Contains(strings.ToLower(tag), strings.ToLower(request.Target)) {
+			result = append(result, tag)
+		}
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+func (s *Server) handleGrafanaTagValues(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Key string `json:"key"`
+	}
+	if !s.decodeGrafanaRequest(w, r, &request) {
+		return
+	}
+	result := []map[string]string{}
+	if request.Key == "tag" {
+		tags, err := s.dbh.grafanaTags(r.Context(), s.conf.Table)
+		if err != nil {
+			http.Error(w, "failed to read tags", http.StatusInternalServerError)
+			return
+		}
+		for _, tag := range tags {
+			result = append(result, map[string]string{"text": tag})
+		}
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+func (s *Server) handleGrafanaQuery(w http.ResponseWriter, r *http.Request) {
+	logFields := log.Fields{"package": logPkg, "func": "handleGrafanaQuery"}
+	var query grafanaQuery
+	if !s.decodeGrafanaRequest(w, r, &query) {
+		return
+	}
+	if !query.Range.From.Before(query.Range.To) {
+		http.Error(w, "invalid range", http.StatusBadRequest)
+		return
+	}
+	bucket := grafanaBucket(query.Range.From, query.Range.To, time.Duration(query.IntervalMs)*time.Millisecond, query.MaxDataPoints)
+	result := []any{}
+	for _, target := range query.Targets {
+		if len(target.Target) == 0 {
+			continue
+		}
+		match, err := matchGrafanaFilters(target.Target, query.AdhocFilters)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !match {
+			continue
+		}
+		function := target.Data.Aggregate
+		if len(function) == 0 {
+			function = target.Payload.Aggregate
+		}
+		datapoints, err := s.dbh.grafanaDatapoints(r.Context(), s.conf.Table, target.Target, query.Range, bucket, function)
+		if err != nil {
+			log.WithFields(logFields).Errorf("Failed to query %s: %v", target.Target, err)
+			http.Error(w, fmt.Sprintf("failed to query %s", target.Target), http.StatusInternalServerError)
+			return
+		}
+		if target.Type == "table" {
+			table := grafanaTable{Type: "table", RefID: target.RefID, Rows: [][]any{},
+				Columns: []grafanaColumn{{Text: "Time", Type: "time"}, {Text: target.Target, Type: "number"}}}
+			for _, datapoint := range datapoints {
+				table.Rows = append(table.Rows, []any{datapoint[1], datapoint[0]})
+			}
+			result = append(result, table)
+			continue
+		}
+		result = append(result, grafanaTimeserie{Target: target.Target, RefID: target.RefID, Datapoints: datapoints})
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+func (s *Server) handleGrafanaAnnotations(w http.ResponseWriter, r *http.Request) {
+	var query grafanaAnnotationQuery
+	if !s.decodeGrafanaRequest(w, r, &query) {
+		return
+	}
+	result := []map[string]any{}
+	if len(query.Annotation.Query) == 0 {
+		writeJSON(w, http.StatusOK, result)
+		return
+	}
+	series, err := s.dbh.QueryRangeContext(r.Context(), s.conf.Table, []string{query.Annotation.Query},
+		query.Range.From, query.Range.To, QueryOptions{IncludeNulls: true})
+	if err != nil {
+		http.Error(w, "failed to read annotations", http.StatusInternalServerError)
+		return
+	}
+	for _, point := range series[0].Points {
+		if len(point.Comment) == 0 {
+			continue
+		}
+		result = append(result, map[string]any{
+			"annotation": query.Annotation,
+			"time":       point.Time.UnixMilli(),
+			"title":      point.Tag,
+			"text":       point.Comment,
+			"tags":       []string{point.Tag},
+		})
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// grafanaBucket returns the aggregation bucket for the range, it has about
+// maxDataPoints buckets and isn't shorter than interval. It returns 0 if the
+// raw points are fine grained enough.
+func grafanaBucket(from time.Time, to time.Time, interval time.Duration, maxDataPoints int) time.Duration {
+	target := interval
+	if maxDataPoints > 0 {
+		if perPoint := to.Sub(from) / time.Duration(maxDataPoints); perPoint > target {
+			target = perPoint
+		}
+	}
+	if target < time.Second {
+		return 0
+	}
+	for _, step := range grafanaSteps {
+		if step >= target {
+			return step
+		}
+	}
+	day := 24 * time.Hour
+	return (target + day - 1) / day * day
+}
+
+// grafanaDatapoints returns [value, unix milliseconds] of the raw points or
+// of the aggregated buckets if bucket isn't 0
+func (dbh *DbHandler) grafanaDatapoints(ctx context.Context, table string, tag string, r grafanaRange, bucket time.Duration, function AggregateFunc) ([][2]any, error) {
+	datapoints := [][2]any{}
+	add := func(t time.Time, value float64) {
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			datapoints = append(datapoints, [2]any{nil, t.UnixMilli()})
+			return
+		}
+		datapoints = append(datapoints, [2]any{value, t.UnixMilli()})
+	}
+	if bucket == 0 {
+		series, err := dbh.QueryRangeContext(ctx, table, []string{tag}, r.From, r.To, QueryOptions{})
+		if err != nil {
+			return nil, err
+		}
+		for _, point := range series[0].Points {
+			add(point.Time, point.Value)
+		}
+		return datapoints, nil
+	}
+	if len(function) == 0 {
+		function = AggregateAvg
+	}
+	result, err := dbh.AggregateContext(ctx, table, tag, r.From, r.To, bucket, function)
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range result.Buckets {
+		add(b.Time, b.Values[0])
+	}
+	return datapoints, nil
+}
+
+// grafanaTags returns the tags with points in table. The catalogue contains
+// the tags of all tables, its tags are only checked for points of table
+// since that can use the (tag, time) index.
+func (dbh *DbHandler) grafanaTags(ctx context.Context, table string) ([]string, error) {
+	dbh.stateMutex.Lock()
+	catalogue := dbh.catalogueEnabled
+	dbh.stateMutex.Unlock()
+	quoted, err := dbh.quoteIdentifier(table)
+	if err != nil {
+		return nil, err
+	}
+	sqlStr := "SELECT DISTINCT tag FROM " + quoted + " ORDER BY tag"
+	if catalogue {
+		sqlStr = "SELECT c.tag FROM " + TagCatalogueTable + " AS c" +
+			" WHERE EXISTS (SELECT 1 FROM " + quoted + " AS t WHERE t.tag = c.tag) ORDER BY c.tag"
+	}
+	rows, err := dbh.ExecuteQueryContext(ctx, sqlStr)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var tags []string
+	for rows.Next() {
+		var tag string
+		if err := rows.Scan(&tag); err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	return tags, rows.Err()
+}
+
+// matchGrafanaFilters reports whether tag passes the ad hoc filters on the key tag
+func matchGrafanaFilters(tag string, filters []grafanaFilter) (bool, error) {
+	for _, filter := range filters {
+		if filter.Key != "tag" {
+			continue
+		}
+		var match bool
+		switch filter.Operator {
+		case "=", "!=":
+			match = tag == filter.Value
+		case "=~", "!~":
+			pattern, err := regexp.Compile(filter.Value)
+			if err != nil {
+				return false, fmt.Errorf("invalid filter %q: %v", filter.Value, err)
+			}
+			match = pattern.MatchString(tag)
+		default:
+			return false, errors.New("unsupported filter operator " + filter.Operator)
+		}
+		if strings.HasPrefix(filter.Operator, "!") {
+			match = !match
+		}
+		if !match {
+			return false, nil
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,132 @@
+package timeseries
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGrafanaBucket(t *testing.T) {
+	t.Parallel()
+	from := time.Date(2023, 6, 1, 0, 0, 0, 0, time.UTC)
+	for _, c := range []struct {
+		span          time.Duration
+		interval      time.Duration
+		maxDataPoints int
+		expected      time.Duration
+	}{
+		{time.Minute, 100 * time.Millisecond, 1000, 0},
+		{time.Hour, 0, 1000, 5 * time.Second},
+		{time.Hour, 20 * time.Second, 1000, 30 * time.Second},
+		{24 * time.Hour, time.Minute, 720, 2 * time.Minute},
+		{365 * 24 * time.Hour, 0, 100, 4 * 24 * time.Hour},
+	} {
+		if bucket := grafanaBucket(from, from.Add(c.span), c.interval, c.maxDataPoints); bucket != c.expected {
+			t.Errorf("%v/%v/%d: expected %v but got %v", c.span, c.interval, c.maxDataPoints, c.expected, bucket)
+		}
+	}
+}
+
+func TestGrafanaHandler(t *testing.T) {
+	t.Parallel()
+	dbh := newTestDbHandler(t)
+	start := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	var points []Point
+	for i := 0; i < 120; i++ {
+		points = append(points, Point{Time: start.Add(time.Duration(i) * time.Second), Value: float64(i)})
+	}
+	points[10].Comment = "window open"
+	if err := dbh.InsertSeries([]Series{{Tag: "living/temperature", Points: points}, {Tag: "kitchen/temperature", Points: points[:5]}},
+		false, DefaultTimeseriesTable); err != nil {
+		t.Fatalf("Failed to insert: %v", err)
+	}
+	// tags of other tables are in the catalogue as well but not served
+	if err := dbh.CreateTimeseriesTable("other"); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	if err := dbh.InsertPoints([]Point{{Time: start, Tag: "living/other", Value: 1}}, false, "other"); err != nil {
+		t.Fatalf("Failed to insert: %v", err)
+	}
+	server := httptest.NewServer(NewServer(dbh, ServerConfig{}))
+	defer server.Close()
+	post := func(path string, body string, result any) {
+		t.Helper()
+		resp, err := http.Post(server.URL+"/grafana"+path, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("Failed to post: %v", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: unexpected status %d", path, resp.StatusCode)
+		}
+		if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+			t.Fatalf("%s: failed to decode: %v", path, err)
+		}
+	}
+
+	resp, err := http.Get(server.URL + "/grafana/")
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Connection test failed: %v", err)
+	}
+	resp.Body.Close()
+
+	var tags []string
+	post("/search", `{"target": "LIVING"}`, &tags)
+	if !reflect.DeepEqual(tags, []string{"living/temperature"}) {
+		t.Errorf("Unexpected tags %v", tags)
+	}
+
+	// 2 minutes with 4 data points are aggregated into 30s buckets
+	query := `{"range": {"from": "2023-06-01T12:00:00Z", "to": "2023-06-01T12:02:00Z"}, "intervalMs": 1000, "maxDataPoints": 4,
+		"targets": [{"target": "living/temperature", "refId": "A"}, {"target": "living/temperature", "refId": "B", "data": {"aggregate": "max"}},
+		{"target": "kitchen/temperature", "refId": "C", "type": "table"}]}`
+	var result []json.RawMessage
+	post("/query", query, &result)
+	if len(result) != 3 {
+		t.Fatalf("Unexpected result %s", result)
+	}
+	var avg, max grafanaTimeserie
+	var table grafanaTable
+	json.Unmarshal(result[0], &avg)
+	json.Unmarshal(result[1], &max)
+	json.Unmarshal(result[2], &table)
+	expected := [][2]any{{14.5, 1685620800000.0}, {44.5, 1685620830000.0}, {74.5, 1685620860000.0}, {104.5, 1685620890000.0}}
+	if !reflect.DeepEqual(avg.Datapoints, expected) || avg.RefID != "A" {
+		t.Errorf("Expected %v but got %+v", expected, avg)
+	}
+	if len(max.Datapoints) != 4 || max.Datapoints[0][0] != 29.0 {
+		t.Errorf("Unexpected max %+v", max)
+	}
+	if table.Type != "table" || len(table.Rows) != 1 || table.Rows[0][1] != 2.0 {
+		t.Errorf("Unexpected table %+v", table)
+	}
+
+	// raw points and an ad hoc filter which drops the kitchen
+	query = `{"range": {"from": "2023-06-01T12:00:00Z", "to": "2023-06-01T12:00:03Z"}, "intervalMs": 100, "maxDataPoints": 1000,
+		"targets": [{"target": "living/temperature"}, {"target": "kitchen/temperature"}],
+		"adhocFilters": [{"key": "tag", "operator": "=~", "value": "^living/"}]}`
+	var raw []grafanaTimeserie
+	post("/query", query, &raw)
+	if len(raw) != 1 || len(raw[0].Datapoints) != 3 || raw[0].Datapoints[2][0] != 2.0 {
+		t.Errorf("Unexpected raw points %+v", raw)
+	}
+
+	var annotations []map[string]any
+	post("/annotations", `{"range": {"from": "2023-06-01T12:00:00Z", "to": "2023-06-01T12:02:00Z"},
+		"annotation": {"name": "events", "query": "living/temperature"}}`, &annotations)
+	if len(annotations) != 1 || annotations[0]["text"] != "window open" || annotations[0]["time"] != 1685620810000.0 {
+		t.Errorf("Unexpected annotations %+v", annotations)
+	}
+
+	var keys []map[string]string
+	post("/tag-keys", `{}`, &keys)
+	var values []map[string]string
+	post("/tag-values", `{"key": "tag"}`, &values)
+	if len(keys) != 1 || keys[0]["text"] != "tag" || len(values) != 2 {
+		t.Errorf("Unexpected tag keys %v and values %v", keys, values)
+	}
+}
@@ -1,9 +1,5 @@
 package timeseries
 
-import (
-	"fmt"
-)
-
 // ImportStruct contains all data which are needed to add to a database.
 // One Timestamp can have multiple values
 type ImportStruct struct {
@@ -45,6 +41,26 @@ func CreateImportTable(importRows []ImportRowStruct) ImportStruct {
 		Timestamps: timestamps,
 		Data:       data,
 	}
-	fmt.Printf("data:%+v", is)
 	return is
 }
+
+// ImportRows splits an ImportStruct into rows, the inverse of CreateImportTable.
+// Timestamps are normalized with FormatTimestamp, invalid ones are kept and
+// rejected by the insert.
+func ImportRows(is ImportStruct) []ImportRowStruct {
+	var rows []ImportRowStruct
+	for entryIndex, ts := range is.Timestamps {
+		if timestamp, err := normalizeTimestamp(ts); err == nil {
+			ts = timestamp
+		}
+		row := ImportRowStruct{
+			Names:     is.Names,
+			Timestamp: ts,
+		}
+		for columnNr := range is.Names {
+			row.Values = append(row.Values, is.Data[columnNr][entryIndex])
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
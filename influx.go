@@ -0,0 +1,388 @@
+package timeseries
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultInfluxTagFormat names the tag of a field of a line protocol point.
+// {tags} is the tag set in line protocol form, e.g. ",host=pi,room=living".
+const DefaultInfluxTagFormat string = "{measurement}{tags}/{field}"
+
+// LineProtocolPoint is a parsed line of InfluxDB line protocol
+type LineProtocolPoint struct {
+	Measurement string
+	Tags        map[string]string
+	Fields      map[string]any // float64, int64, uint64, bool or string
+	Time        time.Time
+}
+
+// LineError is a line which couldn't be parsed, Line starts at 1
+type LineError struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+// InfluxOptions configures how line protocol is written into a timeseries table
+type InfluxOptions struct {
+	Table               string // timeseries table to write, DefaultTimeseriesTable if empty
+	TagFormat           string // tag of a field with {measurement}, {field}, {tags} and {tag:<key>}, DefaultInfluxTagFormat if empty
+	TextAsComment       bool   // store string fields as comment of a point without value, else skip them
+	OnConflictDoNothing bool   // skip points which already exist (needs a unique key)
+}
+
+var influxTagPattern = regexp.MustCompile(`\{tag:([^}]*)\}`)
+
+// ParseLineProtocol parses InfluxDB line protocol. Timestamps are integers in
+// units of precision (time.Nanosecond if 0), lines without timestamp get now.
+// Empty lines and comments are skipped, invalid lines are returned as errors.
+func ParseLineProtocol(data []byte, precision time.Duration, now time.Time) ([]LineProtocolPoint, []LineError) {
+	if precision <= 0 {
+		precision = time.Nanosecond
+	}
+	var points []LineProtocolPoint
+	var rejected []LineError
+	for n, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if trimmed := strings.TrimSpace(line); len(trimmed) == 0 || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		point, err := parseLine(strings.TrimLeft(line, " \t"), precision, now)
+		if err != nil {
+			rejected = append(rejected, LineError{Line: n + 1, Error: err.Error()})
+			continue
+		}
+		points = append(points, point)
+	}
+	return points, rejected
+}
+
+// parseLine parses measurement[,tag=value...] field=value[,field=value...] [timestamp]
+func parseLine(line string, precision time.Duration, now time.Time) (LineProtocolPoint, error) {
+	point := LineProtocolPoint{Tags: make(map[string]string), Fields: make(map[string]any)}
+	var i int
+	point.Measurement, i = readEscaped(line, 0, ", ")
+	if len(point.Measurement) == 0 {
+		return point, errors.New("missing measurement")
+	}
+	for i < len(line) && line[i] == ',' {
+		var key, value string
+		key, i = readEscaped(line, i+1, ",= ")
+		if i >= len(line) || line[i] != '=' || len(key) == 0 {
+			return point, fmt.Errorf("invalid tag at %d", i)
+		}
+		value, i = readEscaped(line, i+1, ", ")
+		if len(value) == 0 {
+			return point, fmt.Errorf("missing value of tag %s", key)
+		}
+		point.Tags[key] = value
+	}
+	if i >= len(line) || line[i] != ' ' {
+		return point, errors.New("missing fields")
+	}
+	i = skipSpaces(line, i)
+	for {
+		var key string
+		key, i = readEscaped(line, i, ",= ")
+		if i >= len(line) || line[i] != '=' || len(key) == 0 {
+			return point, fmt.Errorf("invalid field at %d", i)
+		}
+		value, next, err := readFieldValue(line, i+1)
+		if err != nil {
+			return point, fmt.Errorf("field %s: %v", key, err)
+		}
+		point.Fields[key] = value
+		i = next
+		if i >= len(line) || line[i] != ',' {
+			break
+		}
+		i++
+	}
+
+	point.Time = now.UTC()
+	rest := strings.TrimSpace(line[i:])
+	if i < len(line) && line[i] != ' ' {
+		return point, fmt.Errorf("unexpected %q at %d", line[i], i)
+	}
+	if len(rest) > 0 {
+		timestamp, err := strconv.ParseInt(rest, 10, 64)
+		if err != nil {
+			return point, fmt.Errorf("invalid timestamp %q", rest)
+		}
+		// nanoseconds since 1970 must fit into int64 (years 1677 to 2262)
+		if timestamp > math.MaxInt64/int64(precision) || timestamp < math.MinInt64/int64(precision) {
+			return point, fmt.Errorf("timestamp %d out of range", timestamp)
+		}
+		point.Time = time.Unix(0, timestamp*int64(precision)).UTC()
+	}
+	return point, nil
+}
+
+// readEscaped reads until one of the unescaped stop characters, a backslash
+// escapes comma, equal sign, space and backslash
+func readEscaped(line string, i int, stops string) (string, int) {
+	var str strings.Builder
+	for i < len(line) {
+		c := line[i]
+		if c == '\\' && i+1 < len(line) && strings.IndexByte(",= \\", line[i+1]) >= 0 {
+			str.WriteByte(line[i+1])
+			i += 2
+			continue
+		}
+		if strings.IndexByte(stops, c) >= 0 {
+			break
+		}
+		str.WriteByte(c)
+		i++
+	}
+	return str.String(), i
+}
+
+func skipSpaces(line string, i int) int {
+	for i < len(line) && line[i] == ' ' {
+		i++
+	}
+	return i
+}
+
+// readFieldValue reads a string in double quotes, a float, an integer with
+// suffix i or u or a boolean
+func readFieldValue(line string, i int) (any, int, error) {
+	if i < len(line) && line[i] == '"' {
+		var str strings.Builder
+		for i++; i < len(line); i++ {
+			c := line[i]
+			if c == '\\' && i+1 < len(line) && (line[i+1] == '"' || line[i+1] == '\\') {
+				i++
+				str.WriteByte(line[i])
+				continue
+			}
+			if c == '"' {
+				return str.String(), i + 1, nil
+			}
+			str.WriteByte(c)
+		}
+		return nil, i, errors.New("unterminated string")
+	}
+	end := i
+	for end < len(line) && line[end] != ',' && line[end] != ' ' {
+		end++
+	}
+	raw := line[i:end]
+	switch {
+	case len(raw) == 0:
+		return nil, end, errors.New("missing value")
+	case strings.HasSuffix(raw, "i"):
+		value, err := strconv.ParseInt(raw[:len(raw)-1], 10, 64)
+		if err != nil {
+			return nil, end, fmt.Errorf("invalid integer %q", raw)
+		}
+		return value, end, nil
+	case strings.HasSuffix(raw, "u"):
+		value, err := strconv.ParseUint(raw[:len(raw)-1], 10, 64)
+		if err != nil {
+			return nil, end, fmt.Errorf("invalid unsigned integer %q", raw)
+		}
+		return value, end, nil
+	}
+	switch raw {
+	case "t", "T", "true", "True", "TRUE":
+		return true, end, nil
+	case "f", "F", "false", "False", "FALSE":
+		return false, end, nil
+	}
+	value, err := strconv.ParseFloat(raw, 64)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		return nil, end, fmt.Errorf("invalid value %q", raw)
+	}
+	return value, end, nil
+}
+
+// TagName returns the tag of a field formatted with tagFormat, see
+// InfluxOptions.
+func (p LineProtocolPoint) TagName(tagFormat string, field string) string {
+	keys := make([]string, 0, len(p.Tags))
+	for key := range p.Tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var tags strings.Builder
+	for _, key := range keys {
+		tags.WriteString("," + key + "=" + p.Tags[key])
+	}
+	name := influxTagPattern.ReplaceAllStringFunc(tagFormat, func(match string) string {
+		return p.Tags[influxTagPattern.FindStringSubmatch(match)[1]]
+	})
+	return strings.NewReplacer("{measurement}", p.Measurement, "{field}", field, "{tags}", tags.String()).Replace(name)
+}
+
+// influxPoints converts the fields of line protocol points into points
+func influxPoints(lines []LineProtocolPoint, opts InfluxOptions) []Point {
+	var points []Point
+	for _, line := range lines {
+		fields := make([]string, 0, len(line.Fields))
+		for field := range line.Fields {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+		for _, field := range fields {
+			point := Point{Time: line.Time, Tag: line.TagName(opts.TagFormat, field)}
+			switch v := line.Fields[field].(type) {
+			case float64:
+				point.Value = v
+			case int64:
+				point.Value = float64(v)
+			case uint64:
+				point.Value = float64(v)
+			case bool:
+				point.Value = 0
+				if v {
+					point.Value = 1
+				}
+			case string:
+				if !opts.TextAsComment {
+					continue
+				}
+				point.Value = math.NaN()
+				point.Comment = v
+			}
+			points = append(points, point)
+		}
+	}
+	return points
+}
+
+// WriteLineProtocol parses InfluxDB line protocol and writes every field as
+// a point into a timeseries table. The valid lines are written even if others
+// are rejected. It returns the number of written points and the rejected lines.
+func (dbh *DbHandler) WriteLineProtocol(data []byte, precision time.Duration, opts InfluxOptions) (int, []LineError, error) {
+	return dbh.WriteLineProtocolContext(context.Background(), data, precision, opts)
+}
+
+// WriteLineProtocolContext writes InfluxDB line protocol, see WriteLineProtocol.
+func (dbh *DbHandler) WriteLineProtocolContext(ctx context.Context, data []byte, precision time.Duration, opts InfluxOptions) (int, []LineError, error) {
+	logFields := log.Fields{"package": logPkg, "func": "WriteLineProtocol"}
+	if len(opts.Table) == 0 {
+		opts.Table = DefaultTimeseriesTable
+	}
+	if len(opts.TagFormat) == 0 {
+		opts.TagFormat = DefaultInfluxTagFormat
+	}
+	lines, rejected := ParseLineProtocol(data, precision, time.Now())
+	points := influxPoints(lines, opts)
+	if len(points) == 0 {
+		return 0, rejected, nil
+	}
+	if err := dbh.InsertPointsContext(ctx, points, opts.OnConflictDoNothing, opts.Table); err != nil {
+		log.WithFields(logFields).Errorf("Failed to write %d points: %v", len(points), err)
+		return 0, rejected, err
+	}
+	log.WithFields(logFields).Infof("Wrote %d points of %d lines, rejected %d lines", len(points), len(lines), len(rejected))
+	return len(points), rejected, nil
+}
+
+// influxPrecision converts the precision parameter of the write endpoints
+func influxPrecision(precision string) (time.Duration, error) {
+	switch precision {
+	case "", "n", "ns":
+		return time.Nanosecond, nil
+	case "u", "us", "µs":
+		return time.Microsecond, nil
+	case "ms":
+		return time.Millisecond, nil
+	case "s":
+		return time.Second, nil
+	case "m":
+		return time.Minute, nil
+	case "h":
+		return time.Hour, nil
+	}
+	return 0, fmt.Errorf("invalid precision %q", precision)
+}
+
+// influxError is the error response of the InfluxDB write endpoints, v1
+// clients read error and v2 clients code and message.
+type influxError struct {
+	Code    string      `json:"code"`
+	Message string      `json:"message"`
+	Error   string      `json:"error"`
+	Lines   []LineError `json:"lines,omitempty"`
+}
+
+func writeInfluxError(w http.ResponseWriter, status int, code string, message string, lines []LineError) {
+	writeJSON(w, status, influxError{Code: code, Message: message, Error: message, Lines: lines})
+}
+
+// InfluxHandler returns an http.Handler with the InfluxDB endpoints
+// /write (v1), /api/v2/write and /ping, e.g. to listen on port 8086 for
+// clients which can't use the /influx prefix of the Server.
+func (s *Server) InfluxHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/write", s.handleInfluxWrite)
+	mux.HandleFunc("/api/v2/write", s.handleInfluxWrite)
+	mux.HandleFunc("/ping", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	return mux
+}
+
+// handleInfluxWrite writes line protocol. The database (v1) or bucket (v2)
+// is ignored, all points are written into the table of the Server.
+func (s *Server) handleInfluxWrite(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeInfluxError(w, http.StatusMethodNotAllowed, "method not allowed", "only POST is allowed", nil)
+		return
+	}
+	precision, err := influxPrecision(r.URL.Query().Get("precision"))
+	if err != nil {
+		writeInfluxError(w, http.StatusBadRequest, "invalid", err.Error(), nil)
+		return
+	}
+	var body io.ReadCloser = http.MaxBytesReader(w, r.Body, s.conf.MaxBodySize)
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		reader, err := gzip.NewReader(body)
+		if err != nil {
+			writeInfluxError(w, http.StatusBadRequest, "invalid", "invalid gzip body", nil)
+			return
+		}
+		defer reader.Close()
+		// the limit also applies to the decompressed body
+		body = http.MaxBytesReader(w, reader, s.conf.MaxBodySize)
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeInfluxError(w, http.StatusRequestEntityTooLarge, "request too large",
+				fmt.Sprintf("request body is larger than %d bytes", tooLarge.Limit), nil)
+			return
+		}
+		writeInfluxError(w, http.StatusBadRequest, "invalid", err.Error(), nil)
+		return
+	}
+
+	_, rejected, err := s.dbh.WriteLineProtocolContext(r.Context(), data, precision, s.conf.Influx)
+	if err != nil {
+		writeInfluxError(w, http.StatusInternalServerError, "internal error", "failed to write points", rejected)
+		return
+	}
+	if len(rejected) > 0 {
+		message := fmt.Sprintf("partial write: %d lines rejected, line %d: %s", len(rejected), rejected[0].Line, rejected[0].Error)
+		writeInfluxError(w, http.StatusBadRequest, "invalid", message, rejected)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
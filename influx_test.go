@@ -0,0 +1,150 @@
+package timeseries
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseLineProtocol(t *testing.T) {
+	t.Parallel()
+	now := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	data := "# comment\n" +
+		"weather,location=us\\,midwest,station\\ id=a\\=1 temperature=82,humidity=71i,ok=t,note=\"hot, \\\"dry\\\" day\" 1465839830100400200\r\n" +
+		"\n" +
+		"my\\ cpu usage=0.5u\n" +
+		"cpu usage=1u,count=-3i\n" +
+		"cpu\n" +
+		"cpu usage=abc\n" +
+		"cpu,host usage=1\n" +
+		"cpu usage=1 12x\n" +
+		"cpu note=\"open\n"
+	points, rejected := ParseLineProtocol([]byte(data), 0, now)
+	if len(points) != 2 {
+		t.Fatalf("Expected 2 points but got %+v", points)
+	}
+	expected := LineProtocolPoint{
+		Measurement: "weather",
+		Tags:        map[string]string{"location": "us,midwest", "station id": "a=1"},
+		Fields:      map[string]any{"temperature": 82.0, "humidity": int64(71), "ok": true, "note": `hot, "dry" day`},
+		Time:        time.Unix(0, 1465839830100400200).UTC(),
+	}
+	if !reflect.DeepEqual(points[0], expected) {
+		t.Errorf("Expected %+v but got %+v", expected, points[0])
+	}
+	if points[1].Fields["count"] != int64(-3) || points[1].Fields["usage"] != uint64(1) || !points[1].Time.Equal(now) {
+		t.Errorf("Unexpected point %+v", points[1])
+	}
+	var lines []int
+	for _, e := range rejected {
+		lines = append(lines, e.Line)
+	}
+	if !reflect.DeepEqual(lines, []int{4, 6, 7, 8, 9, 10}) {
+		t.Errorf("Unexpected rejected lines %+v", rejected)
+	}
+
+	points, _ = ParseLineProtocol([]byte("cpu usage=1 1685620800"), time.Second, now)
+	if len(points) != 1 || !points[0].Time.Equal(time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)) {
+		t.Errorf("Unexpected points with precision s %+v", points)
+	}
+	// 1e13 seconds and -1e16 milliseconds overflow int64 nanoseconds
+	points, rejected = ParseLineProtocol([]byte("cpu usage=1 10000000000000\ncpu usage=1 9223372036"), time.Second, now)
+	if len(points) != 1 || len(rejected) != 1 || rejected[0].Line != 1 {
+		t.Errorf("Expected out of range timestamp to be rejected but got %+v, %+v", points, rejected)
+	}
+	if _, rejected = ParseLineProtocol([]byte("cpu usage=1 -10000000000000000"), time.Millisecond, now); len(rejected) != 1 {
+		t.Errorf("Expected out of range timestamp to be rejected but got %+v", rejected)
+	}
+}
+
+func TestLineProtocolTagName(t *testing.T) {
+	t.Parallel()
+	point := LineProtocolPoint{Measurement: "sensor", Tags: map[string]string{"room": "living", "host": "pi"}}
+	for format, expected := range map[string]string{
+		DefaultInfluxTagFormat:         "sensor,host=pi,room=living/temperature",
+		"{tag:room}/{field}":           "living/temperature",
+		"{measurement}.{tag:missing}.": "sensor..",
+	} {
+		if name := point.TagName(format, "temperature"); name != expected {
+			t.Errorf("%s: expected %s but got %s", format, expected, name)
+		}
+	}
+}
+
+func TestServerInfluxWrite(t *testing.T) {
+	t.Parallel()
+	dbh := newTestDbHandler(t)
+	server := httptest.NewServer(NewServer(dbh, ServerConfig{Influx: InfluxOptions{TagFormat: "{tag:room}/{field}", TextAsComment: true}}))
+	defer server.Close()
+
+	body := "sensor,room=living temperature=20.5,window=\"open\" 1685620800\nsensor,room=kitchen temperature=19i,door=f 1685620800\n"
+	resp, err := http.Post(server.URL+"/influx/write?db=home&precision=s", "text/plain", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("Failed to post: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("Expected 204 but got %d", resp.StatusCode)
+	}
+	start := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	series, err := dbh.QueryRange(DefaultTimeseriesTable, []string{"living/temperature", "living/window", "kitchen/temperature", "kitchen/door"},
+		start, start.Add(time.Second), QueryOptions{IncludeNulls: true})
+	if err != nil {
+		t.Fatalf("Failed to query: %v", err)
+	}
+	for _, s := range series {
+		if len(s.Points) != 1 {
+			t.Fatalf("Expected one point of %s but got %+v", s.Tag, s.Points)
+		}
+	}
+	if series[0].Points[0].Value != 20.5 || !math.IsNaN(series[1].Points[0].Value) || series[1].Points[0].Comment != "open" ||
+		series[2].Points[0].Value != 19 || series[3].Points[0].Value != 0 {
+		t.Errorf("Unexpected series %+v", series)
+	}
+
+	// v2 with gzip, the valid line is written and the invalid one reported
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	zw.Write([]byte("sensor,room=bath temperature=23 1685620800000\nsensor,room=bath temperature\n"))
+	zw.Close()
+	req, _ := http.NewRequest(http.MethodPost, server.URL+"/influx/api/v2/write?bucket=home&precision=ms", &compressed)
+	req.Header.Set("Content-Encoding", "gzip")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to post: %v", err)
+	}
+	var response influxError
+	json.NewDecoder(resp.Body).Decode(&response)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest || len(response.Lines) != 1 || response.Lines[0].Line != 2 || response.Code != "invalid" {
+		t.Errorf("Expected rejected line 2 but got %d %+v", resp.StatusCode, response)
+	}
+	bath, err := dbh.ReadSeries(DefaultTimeseriesTable, "bath/temperature", start, start.Add(time.Second))
+	if err != nil || len(bath.Points) != 1 {
+		t.Errorf("Expected written bath temperature but got %+v: %v", bath, err)
+	}
+
+	resp, err = http.Post(server.URL+"/influx/write?precision=d", "text/plain", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("Failed to post: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 for invalid precision but got %d", resp.StatusCode)
+	}
+	resp, err = http.Get(server.URL + "/influx/ping")
+	if err != nil {
+		t.Fatalf("Failed to ping: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("Expected 204 for ping but got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,263 @@
+package timeseries
+
+import (
+	"context"
+	"math"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// latestSuffix is appended to the table name for the last-value cache
+const latestSuffix string = "_latest"
+
+// LatestCacheTable stores the tables with an enabled last-value cache
+const LatestCacheTable string = "latest_caches"
+
+// latestCacheVersion is the migration which creates LatestCacheTable
+const latestCacheVersion int = 6
+
+// LatestValues returns the newest non-null point of each tag, of all tags if
+// none are given. The points are ordered by tag. If the last-value cache of the
+// table is enabled it is read instead of the table.
+func (dbh *DbHandler) LatestValues(table string, tags ...string) ([]Point, error) {
+	return dbh.LatestValuesContext(context.Background(), table, tags...)
+}
+
+// LatestValuesContext returns the newest non-null point of each tag, see LatestValues.
+func (dbh *DbHandler) LatestValuesContext(ctx context.Context, table string, tags ...string) ([]Point, error) {
+	logFields := log.Fields{"package": logPkg, "func": "LatestValues"}
+	if dbh.hasLatestCache(table) {
+		return dbh.readLatestCache(ctx, table, tags)
+	}
+	quoted, err := dbh.quoteIdentifier(table)
+	if err != nil {
+		return nil, err
+	}
+	where := " WHERE value IS NOT NULL"
+	if len(tags) > 0 {
+		where += " AND tag IN (" + dbh.placeholders(1, len(tags)) + ")"
+	}
+	var sqlStr string
+	if dbh.conf.UsePostgres {
+		sqlStr = "SELECT DISTINCT ON (tag) tag, time, value, comment FROM " + quoted + where +
+			" ORDER BY tag, time DESC"
+	} else {
+		sqlStr = "SELECT tag, time, value, comment FROM (" +
+			"SELECT tag, time, value, comment, row_number() OVER (PARTITION BY tag ORDER BY time DESC) AS position" +
+			" FROM " + quoted + where + ") AS ranked WHERE position = 1 ORDER BY tag"
+	}
+	points, err := dbh.queryTaggedPoints(ctx, sqlStr, tags)
+	if err != nil {
+		log.WithFields(logFields).Errorf("Failed to read latest values of %s: %v", table, err)
+		return nil, err
+	}
+	return points, nil
+}
+
+// EnableLatestCache creates (or refreshes) a cache table with the newest value
+// of each tag. All inserts through this handler keep it up to date, so
+// LatestValues only reads one row per tag. The cache is stored in
+// LatestCacheTable and enabled again when the database is opened.
+func (dbh *DbHandler) EnableLatestCache(table string) error {
+	return dbh.EnableLatestCacheContext(context.Background(), table)
+}
+
+// EnableLatestCacheContext creates (or refreshes) a cache table, see EnableLatestCache.
+func (dbh *DbHandler) EnableLatestCacheContext(ctx context.Context, table string) error {
+	logFields := log.Fields{"package": logPkg, "func": "EnableLatestCache"}
+	cache, err := dbh.quoteIdentifier(table + latestSuffix)
+	if err != nil {
+		return err
+	}
+	err = dbh.writeToDB(ctx, "CREATE TABLE IF NOT EXISTS "+cache+` (
+		tag        TEXT                PRIMARY KEY,
+		time       `+dbh.timestampType()+`,
+		value      DOUBLE PRECISION    NULL,
+		comment    TEXT                DEFAULT ''
+	)`)
+	if err != nil {
+		log.WithFields(logFields).Errorf("Failed to create cache for %s: %v", table, err)
+		return err
+	}
+	// values inserted while the cache was disabled are picked up here
+	latest, err := dbh.LatestValuesContext(ctx, table)
+	if err != nil {
+		return err
+	}
+	if err := dbh.updateLatestCache(ctx, table, latest); err != nil {
+		return err
+	}
+	if dbh.storesLatestCaches() {
+		err := dbh.insertRows(ctx, LatestCacheTable, []string{"table_name", "enabled_at"},
+			[][]any{{table, FormatTimestamp(time.Now())}}, "ON CONFLICT (table_name) DO NOTHING")
+		if err != nil {
+			log.WithFields(logFields).Errorf("Failed to store cache of %s: %v", table, err)
+			return err
+		}
+	}
+	dbh.stateMutex.Lock()
+	if dbh.latestCaches == nil {
+		dbh.latestCaches = make(map[string]bool)
+	}
+	dbh.latestCaches[table] = true
+	dbh.stateMutex.Unlock()
+	log.WithFields(logFields).Infof("Enabled latest value cache for %s with %d tags", table, len(latest))
+	return nil
+}
+
+// DisableLatestCache stops maintaining the cache, the table is kept.
+func (dbh *DbHandler) DisableLatestCache(table string) error {
+	return dbh.DisableLatestCacheContext(context.Background(), table)
+}
+
+// DisableLatestCacheContext stops maintaining the cache, see DisableLatestCache.
+func (dbh *DbHandler) DisableLatestCacheContext(ctx context.Context, table string) error {
+	if dbh.storesLatestCaches() {
+		err := dbh.execute(ctx, func() error {
+			_, err := dbh.DB.ExecContext(ctx, "DELETE FROM "+LatestCacheTable+
+				" WHERE table_name = "+dbh.placeholder(1), table)
+			return err
+		})
+		if err != nil {
+			log.WithFields(log.Fields{"package": logPkg, "func": "DisableLatestCache"}).Errorf(
+				"Failed to remove cache of %s: %v", table, err)
+			return err
+		}
+	}
+	dbh.stateMutex.Lock()
+	defer dbh.stateMutex.Unlock()
+	delete(dbh.latestCaches, table)
+	return nil
+}
+
+// loadLatestCaches enables the caches stored in LatestCacheTable
+func (dbh *DbHandler) loadLatestCaches(ctx context.Context) error {
+	if !dbh.storesLatestCaches() {
+		return nil
+	}
+	rows, err := dbh.ExecuteQueryContext(ctx, "SELECT table_name FROM "+LatestCacheTable)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	caches := make(map[string]bool)
+	for rows.Next() {
+		var table string
+		if err := rows.Scan(&table); err != nil {
+			return err
+		}
+		caches[table] = true
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	dbh.stateMutex.Lock()
+	defer dbh.stateMutex.Unlock()
+	dbh.latestCaches = caches
+	return nil
+}
+
+func (dbh *DbHandler) storesLatestCaches() bool {
+	dbh.stateMutex.Lock()
+	defer dbh.stateMutex.Unlock()
+	return dbh.latestCachesStored
+}
+
+func (dbh *DbHandler) hasLatestCache(table string) bool {
+	dbh.stateMutex.Lock()
+	defer dbh.stateMutex.Unlock()
+	return dbh.latestCaches[table]
+}
+
+func (dbh *DbHandler) readLatestCache(ctx context.Context, table string, tags []string) ([]Point, error) {
+	cache, err := dbh.quoteIdentifier(table + latestSuffix)
+	if err != nil {
+		return nil, err
+	}
+	sqlStr := "SELECT tag, time, value, comment FROM " + cache
+	if len(tags) > 0 {
+		sqlStr += " WHERE tag IN (" + dbh.placeholders(1, len(tags)) + ")"
+	}
+	return dbh.queryTaggedPoints(ctx, sqlStr+" ORDER BY tag", tags)
+}
+
+// updateLatestCache stores the newest non-null point per tag if it is newer
+// than the cached one.
+func (dbh *DbHandler) updateLatestCache(ctx context.Context, table string, points []Point) error {
+	newest := make(map[string]Point)
+	for _, point := range points {
+		if math.IsNaN(point.Value) {
+			continue
+		}
+		if current, ok := newest[point.Tag]; !ok || point.Time.After(current.Time) {
+			newest[point.Tag] = point
+		}
+	}
+	if len(newest) == 0 {
+		return nil
+	}
+	cache, err := dbh.quoteIdentifier(table + latestSuffix)
+	if err != nil {
+		return err
+	}
+	rows := make([][]any, 0, len(newest))
+	for tag, point := range newest {
+		rows = append(rows, pointRow(tag, point))
+	}
+	suffix := "ON CONFLICT (tag) DO UPDATE SET time = excluded.time, value = excluded.value," +
+		" comment = excluded.comment WHERE excluded.time > " + cache + ".time"
+	return dbh.insertRows(ctx, table+latestSuffix, []string{"time", "tag", "value", "comment"}, rows, suffix)
+}
+
+// afterInsert is called with the points written into a timeseries table, or
+// with the first, last and newest non-null point of every written series.
+// The points are committed already, so failures to update the tag catalogue,
+// the latest values and the rollups are logged and don't fail the write.
+func (dbh *DbHandler) afterInsert(ctx context.Context, table string, points []Point) {
+	logFields := log.Fields{"package": logPkg, "func": "afterInsert"}
+	tags := make([]string, 0, len(points))
+	for _, point := range points {
+		tags = append(tags, point.Tag)
+	}
+	if err := dbh.registerTags(ctx, tags); err != nil {
+		log.WithFields(logFields).Errorf("Failed to register tags of %s: %v", table, err)
+	}
+	if dbh.hasLatestCache(table) {
+		if err := dbh.updateLatestCache(ctx, table, points); err != nil {
+			log.WithFields(logFields).Errorf("Failed to update latest values of %s: %v", table, err)
+		}
+	}
+	if err := dbh.updateRollups(ctx, table, points); err != nil {
+		log.WithFields(logFields).Errorf("Failed to update rollups of %s: %v", table, err)
+	}
+}
+
+// queryTaggedPoints runs a query which selects tag, time, value and comment
+func (dbh *DbHandler) queryTaggedPoints(ctx context.Context, sqlStr string, tags []string) ([]Point, error) {
+	args := make([]any, 0, len(tags))
+	for _, tag := range tags {
+		args = append(args, tag)
+	}
+	rows, err := dbh.ExecuteQueryContext(ctx, sqlStr, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var points []Point
+	for rows.Next() {
+		var tag string
+		var timestamp any
+		var value *float64
+		var comment *string
+		if err := rows.Scan(&tag, &timestamp, &value, &comment); err != nil {
+			return nil, err
+		}
+		point, err := newPoint(tag, timestamp, value, comment)
+		if err != nil {
+			return nil, err
+		}
+		points = append(points, point)
+	}
+	return points, rows.Err()
+}
@@ -0,0 +1,132 @@
+package timeseries
+
+import (
+	"context"
+	"math"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLatestValues(t *testing.T) {
+	t.Parallel()
+	dbh := newTestDbHandler(t)
+	start := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	series := []Series{
+		{Tag: "a", Points: []Point{{Time: start, Value: 1}, {Time: start.Add(time.Minute), Value: 2}}},
+		{Tag: "b", Points: []Point{{Time: start, Value: 10}, {Time: start.Add(time.Hour), Value: math.NaN()}}},
+		{Tag: "c", Points: []Point{{Time: start.Add(-time.Hour), Value: 100, Comment: "old"}}},
+	}
+	if err := dbh.InsertSeries(series, false, DefaultTimeseriesTable); err != nil {
+		t.Fatalf("Failed to insert: %v", err)
+	}
+
+	check := func(name string, tags []string, expected map[string]float64) {
+		t.Helper()
+		points, err := dbh.LatestValues(DefaultTimeseriesTable, tags...)
+		if err != nil {
+			t.Fatalf("%s: failed to read latest values: %v", name, err)
+		}
+		if len(points) != len(expected) {
+			t.Fatalf("%s: expected %d points but got %+v", name, len(expected), points)
+		}
+		for _, point := range points {
+			if value, ok := expected[point.Tag]; !ok || value != point.Value {
+				t.Errorf("%s: unexpected point %+v", name, point)
+			}
+		}
+	}
+	check("table", nil, map[string]float64{"a": 2, "b": 10, "c": 100})
+	check("table with tags", []string{"a", "c"}, map[string]float64{"a": 2, "c": 100})
+
+	if err := dbh.EnableLatestCache(DefaultTimeseriesTable); err != nil {
+		t.Fatalf("Failed to enable cache: %v", err)
+	}
+	check("cache", nil, map[string]float64{"a": 2, "b": 10, "c": 100})
+
+	// late data must not replace newer values
+	is := TimeseriesImportStruct{
+		Tag:        "a",
+		Timestamps: []string{FormatTimestamp(start.Add(-time.Minute)), FormatTimestamp(start.Add(2 * time.Minute))},
+		Values:     []string{"5", "3"},
+	}
+	if err := dbh.InsertTimeseries(is, false, DefaultTimeseriesTable); err != nil {
+		t.Fatalf("Failed to insert: %v", err)
+	}
+	late := []Point{{Time: start.Add(-2 * time.Hour), Tag: "c", Value: 50}, {Time: start, Tag: "d", Value: 7}}
+	if err := dbh.InsertPoints(late, false, DefaultTimeseriesTable); err != nil {
+		t.Fatalf("Failed to insert: %v", err)
+	}
+	expected := map[string]float64{"a": 3, "b": 10, "c": 100, "d": 7}
+	check("cache after insert", nil, expected)
+	if err := dbh.DisableLatestCache(DefaultTimeseriesTable); err != nil {
+		t.Fatalf("Failed to disable cache: %v", err)
+	}
+	check("table after insert", nil, expected)
+}
+
+func TestLatestCacheAfterReopen(t *testing.T) {
+	t.Parallel()
+	conf := GetDefaultDBConfig()
+	conf.IPOrPath = t.TempDir() + string(filepath.Separator)
+	dbh, err := NewDbHandler(conf)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	if err := dbh.EnableLatestCache(DefaultTimeseriesTable); err != nil {
+		t.Fatalf("Failed to enable cache: %v", err)
+	}
+	dbh.Close()
+
+	dbh, err = NewDbHandler(conf)
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	if !dbh.hasLatestCache(DefaultTimeseriesTable) {
+		t.Fatalf("Expected cache to be enabled after reopening")
+	}
+	points := []Point{{Time: time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC), Tag: "a", Value: 1}}
+	if err := dbh.InsertPoints(points, false, DefaultTimeseriesTable); err != nil {
+		t.Fatalf("Failed to insert: %v", err)
+	}
+	cached, err := dbh.readLatestCache(context.Background(), DefaultTimeseriesTable, nil)
+	if err != nil || len(cached) != 1 || cached[0].Value != 1 {
+		t.Errorf("Expected the cache to be maintained but got %+v (%v)", cached, err)
+	}
+
+	if err := dbh.DisableLatestCache(DefaultTimeseriesTable); err != nil {
+		t.Fatalf("Failed to disable cache: %v", err)
+	}
+	dbh.Close()
+	dbh, err = NewDbHandler(conf)
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	defer dbh.Close()
+	if dbh.hasLatestCache(DefaultTimeseriesTable) {
+		t.Errorf("Expected cache to stay disabled after reopening")
+	}
+}
+
+func TestLatestCacheFailureKeepsWrite(t *testing.T) {
+	t.Parallel()
+	dbh := newTestDbHandler(t)
+	if err := dbh.EnableLatestCache(DefaultTimeseriesTable); err != nil {
+		t.Fatalf("Failed to enable cache: %v", err)
+	}
+	if err := dbh.writeToDB(context.Background(), "DROP TABLE "+DefaultTimeseriesTable+latestSuffix); err != nil {
+		t.Fatalf("Failed to drop cache: %v", err)
+	}
+	// the points are stored even though the cache can't be updated
+	points := []Point{{Time: time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC), Tag: "a", Value: 1}}
+	if err := dbh.InsertPoints(points, false, DefaultTimeseriesTable); err != nil {
+		t.Errorf("Expected stored write to succeed but got %v", err)
+	}
+	is := TimeseriesImportStruct{Tag: "a", Timestamps: []string{"2023-06-01 12:01:00"}, Values: []string{"2"}}
+	if err := dbh.InsertTimeseries(is, false, DefaultTimeseriesTable); err != nil {
+		t.Errorf("Expected stored write to succeed but got %v", err)
+	}
+	if n := countRows(t, dbh, DefaultTimeseriesTable+" WHERE tag = 'a'"); n != 2 {
+		t.Errorf("Expected 2 points but got %d", n)
+	}
+}
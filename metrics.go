@@ -0,0 +1,221 @@
+package timeseries
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// metricBuckets are the upper bounds in seconds of the duration histograms
+var metricBuckets = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10}
+
+// Metrics collects operational metrics of a DbHandler. It is an http.Handler
+// which serves them in the Prometheus text format, every DbHandler has its
+// own Metrics, there is no global registry.
+type Metrics struct {
+	mutex         sync.Mutex
+	semaphoreWait histogram
+	lockWait      histogram
+	lockHold      histogram
+	queryDuration map[string]*histogram // by kind: query, exec or transaction
+	timeouts      map[string]float64    // by stage: semaphore or lock
+	rowsInserted  map[string]float64    // by table
+	retriedRows   map[string]float64    // by table
+	failedRows    map[string]float64    // by table
+	coercedNulls  map[string]float64    // by table
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+func newMetrics() *Metrics {
+	return &Metrics{
+		queryDuration: make(map[string]*histogram),
+		timeouts:      make(map[string]float64),
+		rowsInserted:  make(map[string]float64),
+		retriedRows:   make(map[string]float64),
+		failedRows:    make(map[string]float64),
+		coercedNulls:  make(map[string]float64),
+	}
+}
+
+// Metrics returns the operational metrics of the handler
+func (dbh *DbHandler) Metrics() *Metrics {
+	return dbh.metrics
+}
+
+func (h *histogram) observe(d time.Duration) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(metricBuckets))
+	}
+	seconds := d.Seconds()
+	for i, bound := range metricBuckets {
+		if seconds <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+// observe adds a duration to a histogram of m
+func (m *Metrics) observe(h *histogram, d time.Duration) {
+	m.mutex.Lock()
+	h.observe(d)
+	m.mutex.Unlock()
+}
+
+// add increases a counter of m
+func (m *Metrics) add(counter map[string]float64, label string, value float64) {
+	m.mutex.Lock()
+	counter[label] += value
+	m.mutex.Unlock()
+}
+
+// The recording methods below can be called on nil.
+
+func (m *Metrics) observeSemaphoreWait(d time.Duration) {
+	if m != nil {
+		m.observe(&m.semaphoreWait, d)
+	}
+}
+
+func (m *Metrics) observeLockWait(d time.Duration) {
+	if m != nil {
+		m.observe(&m.lockWait, d)
+	}
+}
+
+func (m *Metrics) observeLockHold(d time.Duration) {
+	if m != nil {
+		m.observe(&m.lockHold, d)
+	}
+}
+
+func (m *Metrics) observeQuery(kind string, d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.queryDuration[kind] == nil {
+		m.queryDuration[kind] = &histogram{}
+	}
+	m.queryDuration[kind].observe(d)
+}
+
+func (m *Metrics) addTimeout(stage string) {
+	if m != nil {
+		m.add(m.timeouts, stage, 1)
+	}
+}
+
+func (m *Metrics) addRowsInserted(table string, rows int64) {
+	if m != nil && rows > 0 {
+		m.add(m.rowsInserted, table, float64(rows))
+	}
+}
+
+func (m *Metrics) addRetriedRows(table string, rows int) {
+	if m != nil && rows > 0 {
+		m.add(m.retriedRows, table, float64(rows))
+	}
+}
+
+func (m *Metrics) addFailedRows(table string, rows int) {
+	if m != nil && rows > 0 {
+		m.add(m.failedRows, table, float64(rows))
+	}
+}
+
+func (m *Metrics) addCoercedNulls(table string, values int) {
+	if m != nil && values > 0 {
+		m.add(m.coercedNulls, table, float64(values))
+	}
+}
+
+// WriteTo writes the metrics in the Prometheus text format
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	m.mutex.Lock()
+	var str strings.Builder
+	writeHistogram(&str, "timeseries_semaphore_wait_seconds",
+		"Time operations waited for one of the concurrent operation slots.", "", map[string]*histogram{"": &m.semaphoreWait})
+	writeHistogram(&str, "timeseries_lock_wait_seconds",
+		"Time operations waited for the lock which serializes them.", "", map[string]*histogram{"": &m.lockWait})
+	writeHistogram(&str, "timeseries_lock_hold_seconds",
+		"Time operations held the lock.", "", map[string]*histogram{"": &m.lockHold})
+	writeHistogram(&str, "timeseries_query_duration_seconds",
+		"Time the database took for queries, statements and transactions.", "kind", m.queryDuration)
+	writeCounter(&str, "timeseries_operation_timeouts_total",
+		"Operations which timed out waiting for a slot or the lock.", "stage", m.timeouts)
+	writeCounter(&str, "timeseries_rows_inserted_total",
+		"Rows written by insert statements.", "table", m.rowsInserted)
+	writeCounter(&str, "timeseries_insert_retried_rows_total",
+		"Rows of InsertRowsToTable which were retried.", "table", m.retriedRows)
+	writeCounter(&str, "timeseries_insert_failed_rows_total",
+		"Rows of InsertRowsToTable which failed after all retries.", "table", m.failedRows)
+	writeCounter(&str, "timeseries_coerced_nulls_total",
+		"Values which were no numbers and stored as null.", "table", m.coercedNulls)
+	m.mutex.Unlock()
+	n, err := io.WriteString(w, str.String())
+	return int64(n), err
+}
+
+// ServeHTTP implements http.Handler
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if _, err := m.WriteTo(w); err != nil {
+		log.WithFields(log.Fields{"package": logPkg, "func": "Metrics"}).Warnf("Failed to write metrics: %v", err)
+	}
+}
+
+func writeHistogram(str *strings.Builder, name string, help string, label string, histograms map[string]*histogram) {
+	fmt.Fprintf(str, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	for _, value := range sortedKeys(histograms) {
+		h := histograms[value]
+		labels := ""
+		if len(label) > 0 {
+			labels = label + "=" + strconv.Quote(value) + ","
+		}
+		var cumulative uint64
+		for i, bound := range metricBuckets {
+			if h.counts != nil {
+				cumulative += h.counts[i]
+			}
+			fmt.Fprintf(str, "%s_bucket{%sle=\"%s\"} %d\n", name, labels, strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+		}
+		fmt.Fprintf(str, "%s_bucket{%sle=\"+Inf\"} %d\n", name, labels, h.count)
+		labels = strings.TrimSuffix(labels, ",")
+		if len(labels) > 0 {
+			labels = "{" + labels + "}"
+		}
+		fmt.Fprintf(str, "%s_sum%s %s\n%s_count%s %d\n", name, labels, strconv.FormatFloat(h.sum, 'g', -1, 64), name, labels, h.count)
+	}
+}
+
+func writeCounter(str *strings.Builder, name string, help string, label string, values map[string]float64) {
+	fmt.Fprintf(str, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+	for _, value := range sortedKeys(values) {
+		fmt.Fprintf(str, "%s{%s=%s} %s\n", name, label, strconv.Quote(value), strconv.FormatFloat(values[value], 'g', -1, 64))
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
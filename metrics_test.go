@@ -0,0 +1,91 @@
+package timeseries
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	t.Parallel()
+	dbh := newTestDbHandler(t)
+	is := ImportStruct{
+		Names:      []string{"Temperature"},
+		Timestamps: []string{"2023-06-01 12:00:00", "2023-06-01 12:00:01", "2023-06-01 12:00:02"},
+		Data:       [][]string{{"20.5", "broken", ""}},
+	}
+	if err := dbh.InsertIntoDatabase("living", is); err != nil {
+		t.Fatalf("Failed to insert: %v", err)
+	}
+	timeseries := TimeseriesImportStruct{Tag: "a", Timestamps: []string{"2023-06-01 12:00:00", "2023-06-01 12:00:01"}, Values: []string{"1", "n/a"}}
+	if err := dbh.InsertTimeseries(timeseries, false, DefaultTimeseriesTable); err != nil {
+		t.Fatalf("Failed to insert: %v", err)
+	}
+	// the row has too few values and is retried until it fails
+	rows := []ImportRowStruct{{Names: []string{"Temperature", "Humidity"}, Timestamp: "2023-06-01 12:00:03", Values: []string{"1"}}}
+	if _, err := dbh.InsertRowsToTable("living", rows); err == nil {
+		t.Errorf("Expected error for invalid row")
+	}
+	// an operation which can't get the lock times out
+	dbh.lock <- struct{}{}
+	dbh.timeout = 10 * time.Millisecond
+	if _, err := dbh.ExecuteQuery("SELECT 1"); err == nil {
+		t.Errorf("Expected timeout")
+	}
+	<-dbh.lock
+
+	server := httptest.NewServer(NewServer(dbh, ServerConfig{}))
+	defer server.Close()
+	resp, err := http.Get(server.URL + "/metrics")
+	if err != nil {
+		t.Fatalf("Failed to get metrics: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if contentType := resp.Header.Get("Content-Type"); !strings.HasPrefix(contentType, "text/plain; version=0.0.4") {
+		t.Errorf("Unexpected content type %s", contentType)
+	}
+	text := string(body)
+	for _, expected := range []string{
+		"# TYPE timeseries_semaphore_wait_seconds histogram\n",
+		`timeseries_rows_inserted_total{table="living"} 3`,
+		`timeseries_rows_inserted_total{table="measurements"} 2`,
+		`timeseries_coerced_nulls_total{table="living"} 1`,
+		`timeseries_coerced_nulls_total{table="measurements"} 1`,
+		`timeseries_insert_retried_rows_total{table="living"} 2`,
+		`timeseries_insert_failed_rows_total{table="living"} 1`,
+		`timeseries_operation_timeouts_total{stage="lock"} 1`,
+		`timeseries_lock_hold_seconds_bucket{le="+Inf"} `,
+		`timeseries_query_duration_seconds_count{kind="transaction"} `,
+		`timeseries_query_duration_seconds_bucket{kind="query",le="0.0001"} `,
+	} {
+		if !strings.Contains(text, expected) {
+			t.Errorf("Expected %q in metrics:\n%s", expected, text)
+		}
+	}
+}
+
+func TestMetricsCountCommittedRows(t *testing.T) {
+	t.Parallel()
+	dbh := newTestDbHandler(t)
+	columns := []string{"time", "tag", "value", "comment"}
+	// the first statement succeeds, the invalid last row rolls it back
+	rows := make([][]any, dbh.maxParams()/len(columns)+1)
+	for i := range rows {
+		rows[i] = pointRow("a", Point{Time: time.Unix(int64(i), 0), Value: float64(i)})
+	}
+	rows[len(rows)-1] = []any{"2023-06-01 12:00:00"}
+	if err := dbh.insertRows(context.Background(), DefaultTimeseriesTable, columns, rows, ""); err == nil {
+		t.Fatalf("Expected error for invalid row")
+	}
+	dbh.metrics.mutex.Lock()
+	inserted := dbh.metrics.rowsInserted[DefaultTimeseriesTable]
+	dbh.metrics.mutex.Unlock()
+	if inserted != 0 {
+		t.Errorf("Expected rolled back rows not to be counted but got %v", inserted)
+	}
+}
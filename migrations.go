@@ -0,0 +1,354 @@
+package timeseries
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// SchemaVersionTable stores the applied migrations
+const SchemaVersionTable string = "schema_version"
+
+// baselineVersion is recorded for databases created before migrations existed
+const baselineVersion int = 1
+
+// Migration changes the schema to Version. The statements of the dialect are
+// executed in one transaction together with recording the version.
+type Migration struct {
+	Version     int
+	Description string
+	SQLite      []string
+	Postgres    []string
+	// Apply runs after the statements for changes which depend on the
+	// existing schema, it may be nil.
+	Apply func(ctx context.Context, dbh *DbHandler, tx *sql.Tx) error
+}
+
+// MigrationReport lists the migrations applied by Up, or which would be
+// applied in a dry run.
+type MigrationReport struct {
+	DryRun      bool
+	FromVersion int
+	ToVersion   int
+	Adopted     bool // an existing deployment was adopted at the baseline version
+	Applied     []Migration
+}
+
+var (
+	migrationsMutex sync.Mutex
+	// migrations is the schema history of this package in version order,
+	// RegisterMigration adds further migrations.
+	migrations = []Migration{
+		{
+			Version:     baselineVersion,
+			Description: "create measurements table",
+			SQLite: []string{`CREATE TABLE IF NOT EXISTS measurements (
+				time       DATETIME,
+				tag        TEXT                NOT NULL,
+				value      DOUBLE PRECISION    NULL,
+				comment    TEXT                DEFAULT ''
+			)`},
+			Postgres: []string{`CREATE TABLE IF NOT EXISTS measurements (
+				time       TIMESTAMP,
+				tag        TEXT                NOT NULL,
+				value      DOUBLE PRECISION    NULL,
+				comment    TEXT                DEFAULT ''
+			)`},
+		},
+		{
+			Version:     tagCatalogueVersion,
+			Description: "create tag catalogue",
+			SQLite: []string{`CREATE TABLE IF NOT EXISTS tags (
+				tag              TEXT       PRIMARY KEY,
+				unit             TEXT       DEFAULT '',
+				description      TEXT       DEFAULT '',
+				source           TEXT       DEFAULT '',
+				sample_period_ms INTEGER    DEFAULT 0,
+				decimals         INTEGER    DEFAULT -1,
+				created_at       DATETIME
+			)`},
+			Postgres: []string{`CREATE TABLE IF NOT EXISTS tags (
+				tag              TEXT       PRIMARY KEY,
+				unit             TEXT       DEFAULT '',
+				description      TEXT       DEFAULT '',
+				source           TEXT       DEFAULT '',
+				sample_period_ms BIGINT     DEFAULT 0,
+				decimals         INTEGER    DEFAULT -1,
+				created_at       TIMESTAMP
+			)`},
+		},
+		{
+			Version:     3,
+			Description: "create replication checkpoints",
+			SQLite: []string{`CREATE TABLE IF NOT EXISTS replication_checkpoints (
+				name       TEXT       PRIMARY KEY,
+				position   INTEGER    NOT NULL,
+				updated_at DATETIME
+			)`},
+			Postgres: []string{`CREATE TABLE IF NOT EXISTS replication_checkpoints (
+				name       TEXT       PRIMARY KEY,
+				position   BIGINT     NOT NULL,
+				updated_at TIMESTAMP
+			)`},
+		},
+		{
+			Version:     4,
+			Description: "create unpivot progress",
+			SQLite: []string{`CREATE TABLE IF NOT EXISTS unpivot_progress (
+				name           TEXT       PRIMARY KEY,
+				last_timestamp TEXT       NOT NULL,
+				updated_at     DATETIME
+			)`},
+			Postgres: []string{`CREATE TABLE IF NOT EXISTS unpivot_progress (
+				name           TEXT       PRIMARY KEY,
+				last_timestamp TEXT       NOT NULL,
+				updated_at     TIMESTAMP
+			)`},
+		},
+		{
+			Version:     5,
+			Description: "add id to measurements",
+			Apply: func(ctx context.Context, dbh *DbHandler, tx *sql.Tx) error {
+				if dbh.conf.UsePostgres {
+					return nil
+				}
+				return dbh.addIDColumn(ctx, tx, DefaultTimeseriesTable)
+			},
+		},
+		{
+			Version:     latestCacheVersion,
+			Description: "create latest value caches",
+			SQLite: []string{`CREATE TABLE IF NOT EXISTS latest_caches (
+				table_name TEXT       PRIMARY KEY,
+				enabled_at DATETIME
+			)`},
+			Postgres: []string{`CREATE TABLE IF NOT EXISTS latest_caches (
+				table_name TEXT       PRIMARY KEY,
+				enabled_at TIMESTAMP
+			)`},
+		},
+		{
+			Version:     rollupDefinitionVersion,
+			Description: "create rollup definitions",
+			SQLite: []string{`CREATE TABLE IF NOT EXISTS rollup_definitions (
+				table_name     TEXT       NOT NULL,
+				name           TEXT       NOT NULL,
+				bucket_seconds INTEGER    NOT NULL,
+				funcs          TEXT       NOT NULL,
+				enabled_at     DATETIME,
+				PRIMARY KEY (table_name, name)
+			)`},
+			Postgres: []string{`CREATE TABLE IF NOT EXISTS rollup_definitions (
+				table_name     TEXT       NOT NULL,
+				name           TEXT       NOT NULL,
+				bucket_seconds BIGINT     NOT NULL,
+				funcs          TEXT       NOT NULL,
+				enabled_at     TIMESTAMP,
+				PRIMARY KEY (table_name, name)
+			)`},
+		},
+		{
+			Version:     8,
+			Description: "add id to wide tables with Fetched",
+			Apply: func(ctx context.Context, dbh *DbHandler, tx *sql.Tx) error {
+				tables, err := dbh.outboxTables(ctx, tx)
+				if err != nil {
+					return err
+				}
+				for _, table := range tables {
+					if err := dbh.addIDColumn(ctx, tx, table); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+		},
+	}
+)
+
+// RegisterMigration adds a migration which is applied by Up. It panics if
+// the version is already registered.
+func RegisterMigration(m Migration) {
+	migrationsMutex.Lock()
+	defer migrationsMutex.Unlock()
+	for _, existing := range migrations {
+		if existing.Version == m.Version {
+			panic(fmt.Sprintf("migration %d registered twice", m.Version))
+		}
+	}
+	migrations = append(migrations, m)
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+}
+
+func registeredMigrations() []Migration {
+	migrationsMutex.Lock()
+	defer migrationsMutex.Unlock()
+	return append([]Migration(nil), migrations...)
+}
+
+// Up applies all pending migrations. Databases without a schema version that
+// already contain tables of this package (measurements, sensor_data or wide
+// tables with a Fetched column) are adopted at the baseline version.
+// With dryRun nothing is changed and the report lists the pending migrations.
+func (dbh *DbHandler) Up(dryRun bool) (MigrationReport, error) {
+	return dbh.UpContext(context.Background(), dryRun)
+}
+
+// UpContext applies all pending migrations, see Up.
+func (dbh *DbHandler) UpContext(ctx context.Context, dryRun bool) (MigrationReport, error) {
+	logFields := log.Fields{"package": logPkg, "func": "Up"}
+	report := MigrationReport{DryRun: dryRun}
+	tables, err := dbh.listTables(ctx)
+	if err != nil {
+		return report, err
+	}
+	hasVersionTable := false
+	for _, table := range tables {
+		if strings.EqualFold(table, SchemaVersionTable) {
+			hasVersionTable = true
+		}
+	}
+	if hasVersionTable {
+		report.FromVersion, err = dbh.SchemaVersionContext(ctx)
+		if err != nil {
+			return report, err
+		}
+	}
+	if report.FromVersion == 0 {
+		report.Adopted, err = dbh.isExistingDeployment(ctx, tables)
+		if err != nil {
+			return report, err
+		}
+	}
+	report.ToVersion = report.FromVersion
+	if report.Adopted {
+		report.ToVersion = baselineVersion
+	}
+	for _, m := range registeredMigrations() {
+		if m.Version > report.ToVersion {
+			report.Applied = append(report.Applied, m)
+			report.ToVersion = m.Version
+		}
+	}
+	if dryRun {
+		log.WithFields(logFields).Infof("Dry run: migrate from %d to %d (adopt: %v, %d migrations)",
+			report.FromVersion, report.ToVersion, report.Adopted, len(report.Applied))
+		return report, nil
+	}
+
+	if !hasVersionTable {
+		err := dbh.writeToDB(ctx, "CREATE TABLE IF NOT EXISTS "+SchemaVersionTable+` (
+			version     INTEGER PRIMARY KEY,
+			description TEXT,
+			applied_at  `+dbh.timestampType()+`
+		)`)
+		if err != nil {
+			return report, err
+		}
+	}
+	if report.Adopted {
+		log.WithFields(logFields).Infof("Adopt existing database at version %d", baselineVersion)
+		err := dbh.applyMigration(ctx, Migration{Version: baselineVersion, Description: "adopted existing deployment"})
+		if err != nil {
+			return report, err
+		}
+	}
+	for _, m := range report.Applied {
+		log.WithFields(logFields).Infof("Apply migration %d: %s", m.Version, m.Description)
+		if err := dbh.applyMigration(ctx, m); err != nil {
+			log.WithFields(logFields).Errorf("Failed to apply migration %d: %v", m.Version, err)
+			return report, fmt.Errorf("migration %d (%s) failed: %v", m.Version, m.Description, err)
+		}
+	}
+	dbh.stateMutex.Lock()
+	dbh.catalogueEnabled = report.ToVersion >= tagCatalogueVersion
+	dbh.latestCachesStored = report.ToVersion >= latestCacheVersion
+	dbh.rollupsStored = report.ToVersion >= rollupDefinitionVersion
+	dbh.stateMutex.Unlock()
+	return report, nil
+}
+
+// SchemaVersion returns the highest applied migration, 0 if there is none.
+func (dbh *DbHandler) SchemaVersion() (int, error) {
+	return dbh.SchemaVersionContext(context.Background())
+}
+
+// SchemaVersionContext returns the highest applied migration, 0 if there is none.
+func (dbh *DbHandler) SchemaVersionContext(ctx context.Context) (int, error) {
+	rows, err := dbh.ExecuteQueryContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM "+SchemaVersionTable)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	version := 0
+	if rows.Next() {
+		if err := rows.Scan(&version); err != nil {
+			return 0, err
+		}
+	}
+	return version, rows.Err()
+}
+
+// isExistingDeployment detects tables created by earlier versions of this package
+func (dbh *DbHandler) isExistingDeployment(ctx context.Context, tables []string) (bool, error) {
+	for _, table := range tables {
+		switch strings.ToLower(table) {
+		case DefaultTimeseriesTable, "sensor_data":
+			return true, nil
+		}
+	}
+	for _, table := range tables {
+		if _, err := dbh.quoteIdentifier(table); err != nil {
+			continue // not created by this package
+		}
+		columns, err := dbh.tableColumns(ctx, table)
+		if err != nil {
+			return false, err
+		}
+		for _, column := range columns {
+			if strings.EqualFold(column.Name, "Fetched") {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+func (dbh *DbHandler) applyMigration(ctx context.Context, m Migration) error {
+	statements := m.SQLite
+	if dbh.conf.UsePostgres {
+		statements = m.Postgres
+	}
+	return dbh.execute(ctx, func() error {
+		tx, err := dbh.DB.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		for _, statement := range statements {
+			if _, err := tx.ExecContext(ctx, statement); err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+		if m.Apply != nil {
+			if err := m.Apply(ctx, dbh, tx); err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+		_, err = tx.ExecContext(ctx, "INSERT INTO "+SchemaVersionTable+
+			" (version, description, applied_at) VALUES ("+dbh.placeholders(1, 3)+")",
+			m.Version, m.Description, FormatTimestamp(time.Now()))
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		return tx.Commit()
+	})
+}
@@ -0,0 +1,87 @@
+package timeseries
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+)
+
+func TestUpNewDatabase(t *testing.T) {
+	t.Parallel()
+	dbh := newTestDbHandler(t)
+	version, err := dbh.SchemaVersion()
+	if err != nil {
+		t.Fatalf("Failed to read version: %v", err)
+	}
+	latest := registeredMigrations()[len(registeredMigrations())-1].Version
+	if version != latest {
+		t.Errorf("Expected version %d but got %d", latest, version)
+	}
+	columns, err := dbh.tableColumns(context.Background(), DefaultTimeseriesTable)
+	if err != nil || len(columns) != 5 || columns[0].Name != "id" {
+		t.Errorf("Expected measurements table with id but got %v (%v)", columns, err)
+	}
+	report, err := dbh.Up(false)
+	if err != nil {
+		t.Fatalf("Failed to run up again: %v", err)
+	}
+	if len(report.Applied) != 0 || report.FromVersion != latest || report.Adopted {
+		t.Errorf("Expected nothing to do but got %+v", report)
+	}
+}
+
+func TestUpAdoptsExistingDeployment(t *testing.T) {
+	t.Parallel()
+	conf := GetDefaultDBConfig()
+	conf.IPOrPath = t.TempDir() + string(filepath.Separator)
+	conf.SkipMigrations = true
+	dbh, err := NewDbHandler(conf)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer dbh.Close()
+	row := ImportRowStruct{Names: []string{"Temperature"}, Timestamp: "2023-01-01 10:00:00", Values: []string{"20"}}
+	if err := dbh.InsertRowToTable("living", row); err != nil {
+		t.Fatalf("Failed to insert row: %v", err)
+	}
+
+	report, err := dbh.Up(true)
+	if err != nil {
+		t.Fatalf("Failed dry run: %v", err)
+	}
+	if !report.Adopted || report.FromVersion != 0 {
+		t.Errorf("Expected adoption but got %+v", report)
+	}
+	for _, m := range report.Applied {
+		if m.Version <= baselineVersion {
+			t.Errorf("Expected baseline to be skipped but got %d", m.Version)
+		}
+	}
+	tables, err := dbh.listTables(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to list tables: %v", err)
+	}
+	if len(tables) != 1 {
+		t.Errorf("Dry run changed the database: %v", tables)
+	}
+
+	if _, err := dbh.Up(false); err != nil {
+		t.Fatalf("Failed to migrate: %v", err)
+	}
+	if version, err := dbh.SchemaVersion(); err != nil || version != report.ToVersion {
+		t.Errorf("Expected version %d but got %d (%v)", report.ToVersion, version, err)
+	}
+	columns, err := dbh.tableColumns(context.Background(), DefaultTimeseriesTable)
+	if err != nil || len(columns) != 0 {
+		t.Errorf("Expected baseline migration to be skipped but got %v (%v)", columns, err)
+	}
+}
+
+func TestMigrationsAreOrdered(t *testing.T) {
+	t.Parallel()
+	for i, m := range registeredMigrations() {
+		if m.Version != i+1 {
+			t.Errorf("Expected version %d at position %d but got %d", i+1, i, m.Version)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package timeseries
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// OutboxBatch contains unfetched rows of a wide table. Pass it to
+// MarkFetched after the rows were delivered.
+type OutboxBatch struct {
+	Table string
+	Rows  ImportStruct
+	ids   []any // id column of the rows
+}
+
+// Len returns the number of rows in the batch
+func (b OutboxBatch) Len() int {
+	return len(b.ids)
+}
+
+// ReadUnfetched reads up to limit rows of a table created by InsertRowToTable
+// which are not fetched yet, ordered by timestamp. Numbers are formatted
+// without trailing zeros and NULL values are empty strings.
+func (dbh *DbHandler) ReadUnfetched(tableName string, columns []string, limit int) (OutboxBatch, error) {
+	return dbh.ReadUnfetchedContext(context.Background(), tableName, columns, limit)
+}
+
+// ReadUnfetchedContext reads up to limit unfetched rows, see ReadUnfetched.
+func (dbh *DbHandler) ReadUnfetchedContext(ctx context.Context, tableName string, columns []string, limit int) (OutboxBatch, error) {
+	return dbh.readUnfetched(ctx, tableName, columns, limit, false)
+}
+
+// readUnfetched reads unfetched rows ordered by timestamp or by id
+func (dbh *DbHandler) readUnfetched(ctx context.Context, tableName string, columns []string, limit int, byID bool) (OutboxBatch, error) {
+	logFields := log.Fields{"package": logPkg, "func": "ReadUnfetched"}
+	batch := OutboxBatch{Table: tableName, Rows: ImportStruct{Names: columns, Data: make([][]string, len(columns))}}
+	if limit <= 0 {
+		return batch, fmt.Errorf("limit must be positive")
+	}
+	table, err := dbh.quoteIdentifier(tableName)
+	if err != nil {
+		return batch, err
+	}
+	quoted, err := dbh.quoteIdentifiers(append([]string{"id", "Timestamp", "Fetched"}, columns...))
+	if err != nil {
+		return batch, err
+	}
+	sqlStr := "SELECT " + quoted[0] + ", " + quoted[1]
+	for _, column := range quoted[3:] {
+		sqlStr += ", " + column
+	}
+	order := quoted[1] + ", " + quoted[0]
+	if byID {
+		order = quoted[0]
+	}
+	sqlStr += " FROM " + table + " WHERE " + quoted[2] + " = 0 ORDER BY " + order + " LIMIT " + strconv.Itoa(limit)
+
+	rows, err := dbh.ExecuteQueryContext(ctx, sqlStr)
+	if err != nil {
+		log.WithFields(logFields).Errorf("Failed to read unfetched rows of %s: %v", tableName, err)
+		return batch, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		values := make([]any, len(columns)+2)
+		dest := make([]any, len(values))
+		for i := range values {
+			dest[i] = &values[i]
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return batch, err
+		}
+		batch.ids = append(batch.ids, values[0])
+		batch.Rows.Timestamps = append(batch.Rows.Timestamps, formatScanned(values[1]))
+		for i, value := range values[2:] {
+			batch.Rows.Data[i] = append(batch.Rows.Data[i], formatScanned(value))
+		}
+	}
+	return batch, rows.Err()
+}
+
+// MarkFetched sets Fetched of exactly the rows of batch in one transaction.
+// Nothing is changed if one of the rows was fetched or deleted in between.
+func (dbh *DbHandler) MarkFetched(batch OutboxBatch) error {
+	return dbh.MarkFetchedContext(context.Background(), batch)
+}
+
+// MarkFetchedContext sets Fetched of the rows of batch, see MarkFetched.
+func (dbh *DbHandler) MarkFetchedContext(ctx context.Context, batch OutboxBatch) error {
+	return dbh.markBatch(ctx, batch, 1)
+}
+
+// markBatch sets Fetched of exactly the unfetched rows of batch to fetched
+func (dbh *DbHandler) markBatch(ctx context.Context, batch OutboxBatch, fetched int64) error {
+	logFields := log.Fields{"package": logPkg, "func": "MarkFetched"}
+	if len(batch.ids) == 0 {
+		return nil
+	}
+	table, err := dbh.quoteIdentifier(batch.Table)
+	if err != nil {
+		return err
+	}
+	quoted, err := dbh.quoteIdentifiers([]string{"id", "Fetched"})
+	if err != nil {
+		return err
+	}
+	id, column := quoted[0], quoted[1]
+	return dbh.execute(ctx, func() error {
+		tx, err := dbh.DB.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		var affected int64
+		// one parameter is the value of Fetched
+		chunk := dbh.maxParams() - 1
+		for start := 0; start < len(batch.ids); start += chunk {
+			end := start + chunk
+			if end > len(batch.ids) {
+				end = len(batch.ids)
+			}
+			ids := batch.ids[start:end]
+			sqlStr := "UPDATE " + table + " SET " + column + " = " + dbh.placeholder(1) + " WHERE " + column + " = 0" +
+				" AND " + id + " IN (" + dbh.placeholders(2, len(ids)) + ")"
+			res, err := tx.ExecContext(ctx, sqlStr, append([]any{fetched}, ids...)...)
+			if err != nil {
+				tx.Rollback()
+				log.WithFields(logFields).Errorf("Failed to mark rows of %s: %v", batch.Table, err)
+				return err
+			}
+			n, err := res.RowsAffected()
+			if err != nil {
+				tx.Rollback()
+				return err
+			}
+			affected += n
+		}
+		if affected != int64(len(batch.ids)) {
+			tx.Rollback()
+			return fmt.Errorf("only %d of %d rows of %s are unfetched", affected, len(batch.ids), batch.Table)
+		}
+		log.WithFields(logFields).Infof("Marked %d rows of %s with %d", affected, batch.Table, fetched)
+		return tx.Commit()
+	})
+}
+
+// outboxTables returns the tables with a Fetched column but without id
+func (dbh *DbHandler) outboxTables(ctx context.Context, tx *sql.Tx) ([]string, error) {
+	sqlStr := "SELECT m.name, EXISTS (SELECT 1 FROM pragma_table_info(m.name) WHERE lower(name) = 'id')" +
+		" FROM sqlite_master AS m WHERE m.type = 'table'" +
+		" AND EXISTS (SELECT 1 FROM pragma_table_info(m.name) WHERE lower(name) = 'fetched')"
+	if dbh.conf.UsePostgres {
+		sqlStr = "SELECT c.table_name, EXISTS (SELECT 1 FROM information_schema.columns AS i" +
+			" WHERE i.table_schema = c.table_schema AND i.table_name = c.table_name AND i.column_name = 'id')" +
+			" FROM information_schema.columns AS c WHERE c.table_schema = current_schema() AND c.column_name = 'fetched'"
+	}
+	rows, err := tx.QueryContext(ctx, sqlStr)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var tables []string
+	for rows.Next() {
+		var table string
+		var hasID bool
+		if err := rows.Scan(&table, &hasID); err != nil {
+			return nil, err
+		}
+		if hasID {
+			log.WithField("package", logPkg).Warnf("Outbox of %s uses its existing id column", table)
+			continue
+		}
+		tables = append(tables, table)
+	}
+	return tables, rows.Err()
+}
+
+// formatScanned converts a value scanned into any to a string
+func formatScanned(value any) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case []byte:
+		return string(v)
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case time.Time:
+		return FormatTimestamp(v)
+	}
+	return fmt.Sprint(value)
+}
@@ -0,0 +1,141 @@
+package timeseries
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestOutbox(t *testing.T) {
+	t.Parallel()
+	dbh := newTestDbHandler(t)
+	names := []string{"Temperature", "Room"}
+	rows := []ImportRowStruct{
+		{Names: names, Timestamp: "2023-06-01 12:00:02", Values: []string{"21.5", "kitchen"}},
+		{Names: names, Timestamp: "2023-06-01 12:00:00", Values: []string{"20", "living"}},
+		{Names: names, Timestamp: "2023-06-01 12:00:01", Values: []string{"", "bath"}},
+	}
+	if failed, err := dbh.InsertRowsToTable("outbox", rows); err != nil {
+		t.Fatalf("Failed to insert %v: %v", failed, err)
+	}
+
+	batch, err := dbh.ReadUnfetched("outbox", names, 2)
+	if err != nil {
+		t.Fatalf("Failed to read: %v", err)
+	}
+	expected := ImportStruct{
+		Names:      names,
+		Timestamps: []string{"2023-06-01 12:00:00", "2023-06-01 12:00:01"},
+		Data:       [][]string{{"20", ""}, {"living", "bath"}},
+	}
+	if batch.Len() != 2 || !reflect.DeepEqual(batch.Rows, expected) {
+		t.Fatalf("Expected %+v but got %+v", expected, batch.Rows)
+	}
+	if err := dbh.MarkFetched(batch); err != nil {
+		t.Fatalf("Failed to mark fetched: %v", err)
+	}
+	if err := dbh.MarkFetched(batch); err == nil {
+		t.Errorf("Expected error when marking rows twice")
+	}
+
+	rest, err := dbh.ReadUnfetched("outbox", names, 10)
+	if err != nil {
+		t.Fatalf("Failed to read: %v", err)
+	}
+	if rest.Len() != 1 || rest.Rows.Data[1][0] != "kitchen" || rest.Rows.Data[0][0] != "21.5" {
+		t.Fatalf("Expected the remaining row but got %+v", rest.Rows)
+	}
+	if err := dbh.MarkFetched(rest); err != nil {
+		t.Fatalf("Failed to mark fetched: %v", err)
+	}
+	if empty, err := dbh.ReadUnfetched("outbox", names, 10); err != nil || empty.Len() != 0 {
+		t.Errorf("Expected no rows but got %+v, %v", empty.Rows, err)
+	}
+	if _, err := dbh.ReadUnfetched("outbox", []string{""}, 10); err == nil {
+		t.Errorf("Expected error for invalid column")
+	}
+}
+
+func TestSetFetched(t *testing.T) {
+	t.Parallel()
+	dbh := newTestDbHandler(t)
+	names := []string{"Temperature", "Pressure", "Humidity"}
+	for _, timestamp := range []string{"2023-06-01 12:00:00", "2023-06-01 13:00:00", "2023-06-01 14:00:00"} {
+		row := ImportRowStruct{Names: names, Timestamp: timestamp, Values: []string{"20", "1000", "40"}}
+		if err := dbh.InsertRowToTable("sensor_data", row); err != nil {
+			t.Fatalf("Failed to insert: %v", err)
+		}
+	}
+	if err := dbh.SetFetched("2023-06-01 12:00:00", "2023-06-01 13:00:00"); err != nil {
+		t.Fatalf("Failed to set fetched: %v", err)
+	}
+	is := dbh.ReadTPH()
+	if !reflect.DeepEqual(is.Timestamps, []string{"2023-06-01 14:00:00.000"}) || is.Data[1][0] != "1000.000000" {
+		t.Errorf("Expected only the last row but got %+v", is)
+	}
+	// the bounds returned by ReadTPH have milliseconds
+	if err := dbh.SetFetched(is.Timestamps[0], "2023-06-01 14:00:00.000"); err != nil {
+		t.Fatalf("Failed to set fetched: %v", err)
+	}
+	if is := dbh.ReadTPH(); len(is.Timestamps) != 0 {
+		t.Errorf("Expected no rows but got %+v", is)
+	}
+	if err := dbh.SetFetched("yesterday", "2023-06-01 14:00:00"); err == nil {
+		t.Errorf("Expected error for invalid timestamp")
+	}
+}
+
+func TestOutboxUpgrade(t *testing.T) {
+	t.Parallel()
+	conf := GetDefaultDBConfig()
+	conf.IPOrPath = t.TempDir() + string(filepath.Separator)
+	conf.SkipMigrations = true
+	dbh, err := NewDbHandler(conf)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer dbh.Close()
+	ctx := context.Background()
+	// an outbox of an earlier version without id
+	err = dbh.writeToDB(ctx, "CREATE TABLE outbox (Timestamp DATETIME, Temperature REAL DEFAULT NULL, Fetched INTEGER DEFAULT 0)")
+	if err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	err = dbh.writeToDB(ctx, "INSERT INTO outbox (Timestamp, Temperature) VALUES ('2023-06-01 12:00:00', 1), ('2023-06-01 13:00:00', 2)")
+	if err != nil {
+		t.Fatalf("Failed to insert: %v", err)
+	}
+	if _, err := dbh.Up(false); err != nil {
+		t.Fatalf("Failed to migrate: %v", err)
+	}
+	columns, err := dbh.tableColumns(ctx, "outbox")
+	if err != nil || len(columns) != 4 || columns[0].Name != "id" {
+		t.Fatalf("Expected outbox with id but got %v (%v)", columns, err)
+	}
+
+	batch, err := dbh.ReadUnfetched("outbox", []string{"Temperature"}, 1)
+	if err != nil || batch.Len() != 1 || batch.ids[0] != int64(1) {
+		t.Fatalf("Expected the first row but got %+v (%v)", batch, err)
+	}
+	// ids of deleted rows aren't reused
+	if err := dbh.writeToDB(ctx, "DELETE FROM outbox WHERE id = 2"); err != nil {
+		t.Fatalf("Failed to delete: %v", err)
+	}
+	row := ImportRowStruct{Names: []string{"Temperature"}, Timestamp: "2023-06-01 14:00:00", Values: []string{"3"}}
+	if err := dbh.InsertRowToTable("outbox", row); err != nil {
+		t.Fatalf("Failed to insert: %v", err)
+	}
+	if err := dbh.MarkFetched(batch); err != nil {
+		t.Fatalf("Failed to mark fetched: %v", err)
+	}
+	rest, err := dbh.ReadUnfetched("outbox", []string{"Temperature"}, 10)
+	if err != nil || rest.Len() != 1 || rest.ids[0] != int64(3) || rest.Rows.Data[0][0] != "3" {
+		t.Errorf("Expected the new row with id 3 but got %+v (%v)", rest, err)
+	}
+
+	reserved := ImportRowStruct{Names: []string{"id"}, Timestamp: "2023-06-01 14:00:00", Values: []string{"3"}}
+	if err := dbh.InsertRowToTable("other", reserved); err == nil {
+		t.Errorf("Expected error for column id")
+	}
+}
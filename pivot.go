@@ -0,0 +1,128 @@
+package timeseries
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// PivotAlignment defines how the points of different tags are aligned
+type PivotAlignment int
+
+const (
+	// PivotExact creates a row per distinct timestamp, tags without a point
+	// at that time are NullValue.
+	PivotExact PivotAlignment = iota
+	// PivotRound rounds the timestamps to the nearest multiple of Interval
+	// (aligned to the unix epoch), the last point of a tag per row is used.
+	// Points which round to a time outside [from, to) are dropped.
+	PivotRound
+	// PivotAsOf carries the last observation of every tag forward. The rows
+	// are the distinct timestamps or, if Interval is set, a regular grid.
+	PivotAsOf
+)
+
+// PivotOptions configures Pivot
+type PivotOptions struct {
+	Alignment PivotAlignment
+	Interval  time.Duration // whole seconds, needed for PivotRound and the grid of PivotAsOf
+	MaxAge    time.Duration // PivotAsOf: older observations are not carried forward, no limit if 0
+}
+
+// Pivot reads the tags in [from, to) from a timeseries table and returns them
+// as one column per tag (Names are the tags) on a shared time axis.
+func (dbh *DbHandler) Pivot(table string, tags []string, from time.Time, to time.Time, opts PivotOptions) (ImportStruct, error) {
+	return dbh.PivotContext(context.Background(), table, tags, from, to, opts)
+}
+
+// PivotContext returns the tags as columns on a shared time axis, see Pivot.
+func (dbh *DbHandler) PivotContext(ctx context.Context, table string, tags []string, from time.Time, to time.Time, opts PivotOptions) (ImportStruct, error) {
+	if opts.Alignment == PivotRound || (opts.Alignment == PivotAsOf && opts.Interval != 0) {
+		if opts.Interval < time.Second || opts.Interval%time.Second != 0 {
+			return ImportStruct{}, fmt.Errorf("interval %v is not a multiple of seconds", opts.Interval)
+		}
+	}
+	// null values are no observations which can be carried forward
+	series, err := dbh.QueryRangeContext(ctx, table, tags, from, to, QueryOptions{IncludeNulls: opts.Alignment != PivotAsOf})
+	if err != nil {
+		return ImportStruct{}, err
+	}
+	switch opts.Alignment {
+	case PivotExact:
+		return WideFromSeries(series), nil
+	case PivotRound:
+		for n, s := range series {
+			points := s.Points[:0]
+			for _, point := range s.Points {
+				point.Time = bucketStart(point.Time.Add(opts.Interval/2), opts.Interval)
+				if !point.Time.Before(from) && point.Time.Before(to) {
+					points = append(points, point)
+				}
+			}
+			series[n].Points = points
+		}
+		return WideFromSeries(series), nil
+	case PivotAsOf:
+		// the observations before from are carried into the range
+		since := time.Time{}
+		if opts.MaxAge > 0 {
+			since = from.Add(-opts.MaxAge)
+		}
+		previous, err := dbh.QueryRangeContext(ctx, table, tags, since, from,
+			QueryOptions{Limit: 1, Descending: true})
+		if err != nil {
+			return ImportStruct{}, err
+		}
+		return asOfFromSeries(series, previous, from, to, opts), nil
+	}
+	return ImportStruct{}, fmt.Errorf("unknown alignment %d", opts.Alignment)
+}
+
+// asOfFromSeries aligns the series with the last observation carried forward.
+// previous contains the last point before from of each series.
+func asOfFromSeries(series []Series, previous []Series, from time.Time, to time.Time, opts PivotOptions) ImportStruct {
+	var times []time.Time
+	if opts.Interval > 0 {
+		for t := bucketStart(from, opts.Interval); t.Before(to); t = t.Add(opts.Interval) {
+			if !t.Before(from) {
+				times = append(times, t)
+			}
+		}
+	} else {
+		seen := make(map[time.Time]bool)
+		for _, s := range series {
+			for _, point := range s.Points {
+				if t := point.Time.UTC(); !seen[t] {
+					seen[t] = true
+					times = append(times, t)
+				}
+			}
+		}
+		sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+	}
+
+	is := ImportStruct{Timestamps: make([]string, len(times))}
+	for i, t := range times {
+		is.Timestamps[i] = FormatTimestamp(t)
+	}
+	for n, s := range series {
+		points := append(previous[n].Points, s.Points...)
+		column := make([]string, len(times))
+		next := 0
+		var last *Point
+		for i, t := range times {
+			for next < len(points) && !points[next].Time.After(t) {
+				last = &points[next]
+				next++
+			}
+			column[i] = NullValue
+			if last != nil && (opts.MaxAge == 0 || t.Sub(last.Time) <= opts.MaxAge) {
+				column[i] = FormatValue(last.Value)
+			}
+		}
+		is.Names = append(is.Names, s.Tag)
+		is.Data = append(is.Data, column)
+	}
+	return is
+}
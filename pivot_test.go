@@ -0,0 +1,89 @@
+package timeseries
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPivot(t *testing.T) {
+	t.Parallel()
+	dbh := newTestDbHandler(t)
+	start := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	at := func(seconds int) time.Time { return start.Add(time.Duration(seconds) * time.Second) }
+	series := []Series{
+		{Tag: "a", Points: []Point{{Time: at(-30), Value: 0}, {Time: at(0), Value: 1}, {Time: at(61), Value: 2}}},
+		{Tag: "b", Points: []Point{{Time: at(2), Value: 10}, {Time: at(61), Value: 11}, {Time: at(118), Value: 12}}},
+	}
+	if err := dbh.InsertSeries(series, false, DefaultTimeseriesTable); err != nil {
+		t.Fatalf("Failed to insert: %v", err)
+	}
+	check := func(name string, opts PivotOptions, expected ImportStruct) {
+		t.Helper()
+		is, err := dbh.Pivot(DefaultTimeseriesTable, []string{"a", "b"}, start, at(180), opts)
+		if err != nil {
+			t.Fatalf("%s: failed to pivot: %v", name, err)
+		}
+		if !reflect.DeepEqual(is, expected) {
+			t.Errorf("%s: expected %+v but got %+v", name, expected, is)
+		}
+	}
+	names := []string{"a", "b"}
+	check("exact", PivotOptions{}, ImportStruct{
+		Names:      names,
+		Timestamps: []string{FormatTimestamp(at(0)), FormatTimestamp(at(2)), FormatTimestamp(at(61)), FormatTimestamp(at(118))},
+		Data:       [][]string{{"1", NullValue, "2", NullValue}, {NullValue, "10", "11", "12"}},
+	})
+	check("round", PivotOptions{Alignment: PivotRound, Interval: time.Minute}, ImportStruct{
+		Names:      names,
+		Timestamps: []string{FormatTimestamp(at(0)), FormatTimestamp(at(60)), FormatTimestamp(at(120))},
+		Data:       [][]string{{"1", "2", NullValue}, {"10", "11", "12"}},
+	})
+	check("as of", PivotOptions{Alignment: PivotAsOf}, ImportStruct{
+		Names:      names,
+		Timestamps: []string{FormatTimestamp(at(0)), FormatTimestamp(at(2)), FormatTimestamp(at(61)), FormatTimestamp(at(118))},
+		Data:       [][]string{{"1", "1", "2", "2"}, {NullValue, "10", "11", "12"}},
+	})
+	check("as of grid", PivotOptions{Alignment: PivotAsOf, Interval: time.Minute, MaxAge: 90 * time.Second}, ImportStruct{
+		Names:      names,
+		Timestamps: []string{FormatTimestamp(at(0)), FormatTimestamp(at(60)), FormatTimestamp(at(120))},
+		Data:       [][]string{{"1", "1", "2"}, {NullValue, "10", "12"}},
+	})
+	check("as of before range", PivotOptions{Alignment: PivotAsOf, Interval: time.Minute, MaxAge: 20 * time.Second}, ImportStruct{
+		Names:      names,
+		Timestamps: []string{FormatTimestamp(at(0)), FormatTimestamp(at(60)), FormatTimestamp(at(120))},
+		Data:       [][]string{{"1", NullValue, NullValue}, {NullValue, NullValue, "12"}},
+	})
+
+	if _, err := dbh.Pivot(DefaultTimeseriesTable, names, start, at(180), PivotOptions{Alignment: PivotRound}); err == nil {
+		t.Errorf("Expected error for round without interval")
+	}
+}
+
+func TestPivotRoundEdges(t *testing.T) {
+	t.Parallel()
+	dbh := newTestDbHandler(t)
+	start := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	at := func(seconds int) time.Time { return start.Add(time.Duration(seconds) * time.Second) }
+	// 15s rounds to 0s before from, 160s rounds to 180s at to
+	series := []Series{
+		{Tag: "a", Points: []Point{{Time: at(15), Value: 1}, {Time: at(40), Value: 2}}},
+		{Tag: "b", Points: []Point{{Time: at(100), Value: 3}, {Time: at(160), Value: 4}}},
+	}
+	if err := dbh.InsertSeries(series, false, DefaultTimeseriesTable); err != nil {
+		t.Fatalf("Failed to insert: %v", err)
+	}
+	is, err := dbh.Pivot(DefaultTimeseriesTable, []string{"a", "b"}, at(10), at(180),
+		PivotOptions{Alignment: PivotRound, Interval: time.Minute})
+	if err != nil {
+		t.Fatalf("Failed to pivot: %v", err)
+	}
+	expected := ImportStruct{
+		Names:      []string{"a", "b"},
+		Timestamps: []string{FormatTimestamp(at(60)), FormatTimestamp(at(120))},
+		Data:       [][]string{{"2", NullValue}, {NullValue, "3"}},
+	}
+	if !reflect.DeepEqual(is, expected) {
+		t.Errorf("Expected %+v but got %+v", expected, is)
+	}
+}
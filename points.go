@@ -0,0 +1,284 @@
+package timeseries
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// TimestampLayout is used to store typed timestamps. They are stored as UTC
+// without zone so sqlite, which compares them as text, orders them correctly.
+const TimestampLayout string = "2006-01-02 15:04:05.999999999"
+
+// NullValue is the string representation of a missing value
+const NullValue string = "null"
+
+var timestampLayouts = []string{
+	TimestampLayout,
+	"2006-01-02T15:04:05.999999999",
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999 -0700 MST",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+// Point is one value of a tag. A NaN value is stored as null.
+type Point struct {
+	Time    time.Time
+	Tag     string
+	Value   float64
+	Comment string
+}
+
+// Series contains the points of one tag ordered by time.
+type Series struct {
+	Tag    string
+	Points []Point
+}
+
+// ParseTimestamp parses the timestamp formats used in this package.
+// Timestamps without zone are interpreted as UTC.
+func ParseTimestamp(timestamp string) (time.Time, error) {
+	timestamp = strings.TrimSpace(timestamp)
+	for _, layout := range timestampLayouts {
+		if t, err := time.Parse(layout, timestamp); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid timestamp %q", timestamp)
+}
+
+// FormatTimestamp formats t with TimestampLayout in UTC.
+func FormatTimestamp(t time.Time) string {
+	return t.UTC().Format(TimestampLayout)
+}
+
+// normalizeTimestamp parses timestamp and formats it with FormatTimestamp, so
+// sqlite compares the stored text like postgres compares times.
+func normalizeTimestamp(timestamp string) (string, error) {
+	t, err := ParseTimestamp(timestamp)
+	if err != nil {
+		return "", err
+	}
+	return FormatTimestamp(t), nil
+}
+
+// FormatValue formats a value without losing precision, NaN becomes NullValue.
+func FormatValue(value float64) string {
+	if math.IsNaN(value) {
+		return NullValue
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// ParseValue parses a value, everything which is not a number becomes NaN.
+func ParseValue(value string) float64 {
+	number := parseNumber(value)
+	if number == nil {
+		return math.NaN()
+	}
+	return number.(float64)
+}
+
+// SeriesFromImportStruct converts a string based timeseries into a Series.
+func SeriesFromImportStruct(is TimeseriesImportStruct) (Series, error) {
+	if len(is.Values) < len(is.Timestamps) {
+		return Series{}, fmt.Errorf("tag %s has %d values for %d timestamps",
+			is.Tag, len(is.Values), len(is.Timestamps))
+	}
+	series := Series{Tag: is.Tag, Points: make([]Point, 0, len(is.Timestamps))}
+	for i, timestamp := range is.Timestamps {
+		t, err := ParseTimestamp(timestamp)
+		if err != nil {
+			return Series{}, err
+		}
+		point := Point{Time: t, Tag: is.Tag, Value: ParseValue(is.Values[i])}
+		if i < len(is.Comments) {
+			point.Comment = is.Comments[i]
+		}
+		series.Points = append(series.Points, point)
+	}
+	return series, nil
+}
+
+// ImportStruct converts the series into the string based TimeseriesImportStruct.
+func (s Series) ImportStruct() TimeseriesImportStruct {
+	is := TimeseriesImportStruct{
+		Tag:        s.Tag,
+		Timestamps: make([]string, 0, len(s.Points)),
+		Values:     make([]string, 0, len(s.Points)),
+		Comments:   make([]string, 0, len(s.Points)),
+	}
+	for _, point := range s.Points {
+		is.Timestamps = append(is.Timestamps, FormatTimestamp(point.Time))
+		is.Values = append(is.Values, FormatValue(point.Value))
+		is.Comments = append(is.Comments, point.Comment)
+	}
+	return is
+}
+
+// SeriesFromWide converts every column of a wide ImportStruct into a Series
+// named after the column.
+func SeriesFromWide(is ImportStruct) ([]Series, error) {
+	times := make([]time.Time, 0, len(is.Timestamps))
+	for _, timestamp := range is.Timestamps {
+		t, err := ParseTimestamp(timestamp)
+		if err != nil {
+			return nil, err
+		}
+		times = append(times, t)
+	}
+	var series []Series
+	for columnNr, name := range is.Names {
+		if columnNr >= len(is.Data) || len(is.Data[columnNr]) < len(times) {
+			return nil, fmt.Errorf("column %s has not enough values", name)
+		}
+		s := Series{Tag: name, Points: make([]Point, 0, len(times))}
+		for i, t := range times {
+			s.Points = append(s.Points, Point{Time: t, Tag: name, Value: ParseValue(is.Data[columnNr][i])})
+		}
+		series = append(series, s)
+	}
+	return series, nil
+}
+
+// WideFromSeries aligns the series on their timestamps and returns one column
+// per series. Missing values are NullValue.
+func WideFromSeries(series []Series) ImportStruct {
+	var times []time.Time
+	seen := make(map[time.Time]bool)
+	for _, s := range series {
+		for _, point := range s.Points {
+			t := point.Time.UTC()
+			if !seen[t] {
+				seen[t] = true
+				times = append(times, t)
+			}
+		}
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+	index := make(map[time.Time]int, len(times))
+	is := ImportStruct{Timestamps: make([]string, len(times))}
+	for i, t := range times {
+		index[t] = i
+		is.Timestamps[i] = FormatTimestamp(t)
+	}
+	for _, s := range series {
+		column := make([]string, len(times))
+		for i := range column {
+			column[i] = NullValue
+		}
+		for _, point := range s.Points {
+			column[index[point.Time.UTC()]] = FormatValue(point.Value)
+		}
+		is.Names = append(is.Names, s.Tag)
+		is.Data = append(is.Data, column)
+	}
+	return is
+}
+
+// InsertPoints stores typed points into timeseries table
+func (dbh *DbHandler) InsertPoints(points []Point, onConflictDoNothing bool, table string) error {
+	return dbh.InsertPointsContext(context.Background(), points, onConflictDoNothing, table)
+}
+
+// InsertPointsContext stores typed points into timeseries table
+func (dbh *DbHandler) InsertPointsContext(ctx context.Context, points []Point, onConflictDoNothing bool, table string) error {
+	logFields := log.Fields{"package": logPkg, "func": "InsertPoints"}
+	rows := make([][]any, 0, len(points))
+	for _, point := range points {
+		rows = append(rows, pointRow(point.Tag, point))
+	}
+	suffix := ""
+	if onConflictDoNothing {
+		suffix = "ON CONFLICT DO NOTHING"
+	}
+	err := dbh.insertRows(ctx, table, []string{"time", "tag", "value", "comment"}, rows, suffix)
+	if err != nil {
+		log.WithFields(logFields).Errorf("Failed to insert points: %v", err)
+		return err
+	}
+	dbh.afterInsert(ctx, table, points)
+	return nil
+}
+
+// InsertSeries stores typed series into timeseries table
+func (dbh *DbHandler) InsertSeries(series []Series, onConflictDoNothing bool, table string) error {
+	return dbh.InsertSeriesContext(context.Background(), series, onConflictDoNothing, table)
+}
+
+// InsertSeriesContext stores typed series into timeseries table
+func (dbh *DbHandler) InsertSeriesContext(ctx context.Context, series []Series, onConflictDoNothing bool, table string) error {
+	var points []Point
+	for _, s := range series {
+		for _, point := range s.Points {
+			point.Tag = s.Tag
+			points = append(points, point)
+		}
+	}
+	return dbh.InsertPointsContext(ctx, points, onConflictDoNothing, table)
+}
+
+// pointRow returns the time, tag, value and comment columns of a point
+func pointRow(tag string, point Point) []any {
+	var value any
+	if !math.IsNaN(point.Value) {
+		value = point.Value
+	}
+	return []any{FormatTimestamp(point.Time), tag, value, point.Comment}
+}
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// scanPoint scans time, value and comment of a row
+func scanPoint(row rowScanner, tag string) (Point, error) {
+	var timestamp any
+	var value *float64
+	var comment *string
+	if err := row.Scan(&timestamp, &value, &comment); err != nil {
+		return Point{}, err
+	}
+	return newPoint(tag, timestamp, value, comment)
+}
+
+// newPoint creates a point from scanned columns
+func newPoint(tag string, timestamp any, value *float64, comment *string) (Point, error) {
+	t, err := scanTime(timestamp)
+	if err != nil {
+		return Point{}, err
+	}
+	point := Point{Time: t, Tag: tag, Value: math.NaN()}
+	if value != nil {
+		point.Value = *value
+	}
+	if comment != nil {
+		point.Comment = *comment
+	}
+	return point, nil
+}
+
+// scanTime converts a scanned timestamp column, sqlite returns text if the
+// column type is not known.
+func scanTime(timestamp any) (time.Time, error) {
+	switch t := timestamp.(type) {
+	case time.Time:
+		return t.UTC(), nil
+	case string:
+		return ParseTimestamp(t)
+	case []byte:
+		return ParseTimestamp(string(t))
+	case int64:
+		return time.Unix(t, 0).UTC(), nil
+	default:
+		return time.Time{}, fmt.Errorf("unsupported timestamp %v (%T)", timestamp, timestamp)
+	}
+}
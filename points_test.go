@@ -0,0 +1,110 @@
+package timeseries
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestSeriesConverters(t *testing.T) {
+	is := TimeseriesImportStruct{
+		Tag:        "temperature",
+		Timestamps: []string{"2023-01-01 10:00:00.000", "2023-01-01T10:01:00.123456789Z", "2023-01-01 12:02:00+02:00"},
+		Values:     []string{"21.5", "no number", "0.1"},
+		Comments:   []string{"", "broken", ""},
+	}
+	series, err := SeriesFromImportStruct(is)
+	if err != nil {
+		t.Fatalf("Failed to convert: %v", err)
+	}
+	if len(series.Points) != 3 {
+		t.Fatalf("Expected 3 points but got %d", len(series.Points))
+	}
+	if !math.IsNaN(series.Points[1].Value) || series.Points[1].Comment != "broken" {
+		t.Errorf("Expected null value with comment but got %+v", series.Points[1])
+	}
+	expected := time.Date(2023, 1, 1, 10, 2, 0, 0, time.UTC)
+	if !series.Points[2].Time.Equal(expected) {
+		t.Errorf("Expected %v but got %v", expected, series.Points[2].Time)
+	}
+
+	back, err := SeriesFromImportStruct(series.ImportStruct())
+	if err != nil {
+		t.Fatalf("Failed to convert back: %v", err)
+	}
+	for i, point := range back.Points {
+		original := series.Points[i]
+		if !point.Time.Equal(original.Time) || point.Comment != original.Comment ||
+			(point.Value != original.Value && !math.IsNaN(original.Value)) {
+			t.Errorf("Round trip changed %+v to %+v", original, point)
+		}
+	}
+
+	wide := WideFromSeries([]Series{series, {Tag: "humidity", Points: []Point{{Time: expected, Value: 40}}}})
+	if len(wide.Timestamps) != 3 || len(wide.Names) != 2 {
+		t.Fatalf("Unexpected wide struct %+v", wide)
+	}
+	if wide.Data[1][0] != NullValue || wide.Data[1][2] != "40" {
+		t.Errorf("Unexpected humidity column %v", wide.Data[1])
+	}
+	rows := ImportRows(wide)
+	again, err := SeriesFromWide(CreateImportTable(rows))
+	if err != nil {
+		t.Fatalf("Failed to convert rows: %v", err)
+	}
+	if len(again) != 2 || again[0].Points[0].Value != 21.5 || !again[1].Points[0].Time.Equal(series.Points[0].Time) {
+		t.Errorf("Unexpected series from rows %+v", again)
+	}
+}
+
+func TestInsertAndReadSeries(t *testing.T) {
+	t.Parallel()
+	dbh := newTestDbHandler(t)
+	if err := dbh.CreateTimeseriesTable(DefaultTimeseriesTable); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	start := time.Date(2023, 5, 1, 0, 0, 0, 0, time.UTC)
+	series := Series{Tag: "pressure"}
+	for i := 0; i < 10; i++ {
+		series.Points = append(series.Points, Point{
+			Time:  start.Add(time.Duration(i) * time.Minute),
+			Value: float64(i) + 0.25,
+		})
+	}
+	series.Points[3].Value = math.NaN()
+	series.Points[4].Comment = "it's a comment"
+	if err := dbh.InsertSeries([]Series{series}, false, DefaultTimeseriesTable); err != nil {
+		t.Fatalf("Failed to insert series: %v", err)
+	}
+	// string based inserts of the same tag have to be readable as well
+	if err := dbh.InsertTimeseries(TimeseriesImportStruct{
+		Tag:        "pressure",
+		Timestamps: []string{"2023-05-01 00:10:00.000"},
+		Values:     []string{"10.25"},
+	}, false, DefaultTimeseriesTable); err != nil {
+		t.Fatalf("Failed to insert strings: %v", err)
+	}
+
+	read, err := dbh.ReadSeries(DefaultTimeseriesTable, "pressure", start.Add(time.Minute), start.Add(time.Hour))
+	if err != nil {
+		t.Fatalf("Failed to read series: %v", err)
+	}
+	if len(read.Points) != 10 {
+		t.Fatalf("Expected 10 points but got %d", len(read.Points))
+	}
+	for i, point := range read.Points {
+		expected := start.Add(time.Duration(i+1) * time.Minute)
+		if !point.Time.Equal(expected) {
+			t.Errorf("Expected time %v but got %v", expected, point.Time)
+		}
+	}
+	if !math.IsNaN(read.Points[2].Value) {
+		t.Errorf("Expected null value but got %v", read.Points[2].Value)
+	}
+	if read.Points[3].Comment != "it's a comment" || read.Points[3].Value != 4.25 {
+		t.Errorf("Unexpected point %+v", read.Points[3])
+	}
+	if read.Points[9].Value != 10.25 {
+		t.Errorf("Expected string insert to be read but got %+v", read.Points[9])
+	}
+}
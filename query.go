@@ -0,0 +1,91 @@
+package timeseries
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// QueryOptions configures QueryRange
+type QueryOptions struct {
+	Limit        int  // maximum number of points per tag, no limit if 0
+	Descending   bool // newest points first
+	IncludeNulls bool // return points with null value (as NaN)
+}
+
+// QueryRange reads the points of the tags in [from, to) from a timeseries
+// table. It returns one series per tag in the order of tags, the points are
+// ordered by time.
+func (dbh *DbHandler) QueryRange(table string, tags []string, from time.Time, to time.Time, opts QueryOptions) ([]Series, error) {
+	return dbh.QueryRangeContext(context.Background(), table, tags, from, to, opts)
+}
+
+// QueryRangeContext reads the points of the tags in [from, to), see QueryRange.
+func (dbh *DbHandler) QueryRangeContext(ctx context.Context, table string, tags []string, from time.Time, to time.Time, opts QueryOptions) ([]Series, error) {
+	logFields := log.Fields{"package": logPkg, "func": "QueryRange"}
+	quoted, err := dbh.quoteIdentifier(table)
+	if err != nil {
+		return nil, err
+	}
+	// timestamps are bound as text in TimestampLayout, sqlite compares them as
+	// text and postgres converts them to TIMESTAMP
+	sqlStr := "SELECT time, value, comment FROM " + quoted +
+		" WHERE tag = " + dbh.placeholder(1) +
+		" AND time >= " + dbh.placeholder(2) + " AND time < " + dbh.placeholder(3)
+	if !opts.IncludeNulls {
+		sqlStr += " AND value IS NOT NULL"
+	}
+	if opts.Descending {
+		sqlStr += " ORDER BY time DESC"
+	} else {
+		sqlStr += " ORDER BY time"
+	}
+	if opts.Limit > 0 {
+		sqlStr += " LIMIT " + strconv.Itoa(opts.Limit)
+	}
+
+	result := make([]Series, 0, len(tags))
+	for _, tag := range tags {
+		series, err := dbh.querySeries(ctx, sqlStr, tag, FormatTimestamp(from), FormatTimestamp(to))
+		if err != nil {
+			log.WithFields(logFields).Errorf("Failed to read %s: %v", tag, err)
+			return nil, err
+		}
+		result = append(result, series)
+	}
+	return result, nil
+}
+
+// ReadSeries reads all points of tag in [from, to) ordered by time.
+func (dbh *DbHandler) ReadSeries(table string, tag string, from time.Time, to time.Time) (Series, error) {
+	return dbh.ReadSeriesContext(context.Background(), table, tag, from, to)
+}
+
+// ReadSeriesContext reads all points of tag in [from, to) ordered by time.
+func (dbh *DbHandler) ReadSeriesContext(ctx context.Context, table string, tag string, from time.Time, to time.Time) (Series, error) {
+	series, err := dbh.QueryRangeContext(ctx, table, []string{tag}, from, to, QueryOptions{IncludeNulls: true})
+	if err != nil {
+		return Series{}, err
+	}
+	return series[0], nil
+}
+
+// querySeries runs a query which selects time, value and comment of tag
+func (dbh *DbHandler) querySeries(ctx context.Context, sqlStr string, tag string, args ...any) (Series, error) {
+	rows, err := dbh.ExecuteQueryContext(ctx, sqlStr, append([]any{tag}, args...)...)
+	if err != nil {
+		return Series{}, err
+	}
+	defer rows.Close()
+	series := Series{Tag: tag}
+	for rows.Next() {
+		point, err := scanPoint(rows, tag)
+		if err != nil {
+			return Series{}, err
+		}
+		series.Points = append(series.Points, point)
+	}
+	return series, rows.Err()
+}
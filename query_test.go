@@ -0,0 +1,102 @@
+package timeseries
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestQueryRange(t *testing.T) {
+	t.Parallel()
+	dbh := newTestDbHandler(t)
+	start := time.Date(2022, 12, 31, 23, 0, 0, 0, time.UTC)
+	var series []Series
+	for _, tag := range []string{"temperature", "humidity"} {
+		s := Series{Tag: tag}
+		for i := 0; i < 120; i++ {
+			value := float64(i)
+			if i%10 == 5 {
+				value = math.NaN()
+			}
+			s.Points = append(s.Points, Point{Time: start.Add(time.Duration(i) * time.Minute), Value: value})
+		}
+		series = append(series, s)
+	}
+	if err := dbh.InsertSeries(series, false, DefaultTimeseriesTable); err != nil {
+		t.Fatalf("Failed to insert: %v", err)
+	}
+
+	from := start.Add(30 * time.Minute)
+	to := start.Add(90 * time.Minute)
+	result, err := dbh.QueryRange(DefaultTimeseriesTable, []string{"humidity", "missing", "temperature"}, from, to, QueryOptions{})
+	if err != nil {
+		t.Fatalf("Failed to query: %v", err)
+	}
+	if len(result) != 3 || result[0].Tag != "humidity" || result[1].Tag != "missing" || len(result[1].Points) != 0 {
+		t.Fatalf("Unexpected result %+v", result)
+	}
+	if len(result[0].Points) != 54 {
+		t.Errorf("Expected 54 points without nulls but got %d", len(result[0].Points))
+	}
+	if !result[2].Points[0].Time.Equal(from) || result[2].Points[0].Value != 30 {
+		t.Errorf("Unexpected first point %+v", result[2].Points[0])
+	}
+
+	result, err = dbh.QueryRange(DefaultTimeseriesTable, []string{"temperature"}, from, to,
+		QueryOptions{Limit: 10, Descending: true, IncludeNulls: true})
+	if err != nil {
+		t.Fatalf("Failed to query: %v", err)
+	}
+	points := result[0].Points
+	if len(points) != 10 || points[0].Value != 89 || !math.IsNaN(points[4].Value) {
+		t.Errorf("Unexpected descending points %+v", points)
+	}
+	for i := 1; i < len(points); i++ {
+		if !points[i].Time.Before(points[i-1].Time) {
+			t.Errorf("Points are not descending at %d", i)
+		}
+	}
+}
+
+func TestQueryRangeTimestampFormats(t *testing.T) {
+	t.Parallel()
+	dbh := newTestDbHandler(t)
+	is := TimeseriesImportStruct{
+		Tag:        "zoned",
+		Timestamps: []string{"2023-05-01T10:00:00Z", "2023-05-01 10:00:00+02:00", "2023-05-01T10:30:00.5+00:00"},
+		Values:     []string{"1", "2", "3"},
+	}
+	if err := dbh.InsertTimeseries(is, false, DefaultTimeseriesTable); err != nil {
+		t.Fatalf("Failed to insert: %v", err)
+	}
+	from := time.Date(2023, 5, 1, 9, 0, 0, 0, time.UTC)
+	result, err := dbh.QueryRange(DefaultTimeseriesTable, []string{"zoned"}, from, from.Add(2*time.Hour), QueryOptions{})
+	if err != nil {
+		t.Fatalf("Failed to query: %v", err)
+	}
+	points := result[0].Points
+	if len(points) != 2 || points[0].Value != 1 || points[1].Value != 3 ||
+		!points[1].Time.Equal(time.Date(2023, 5, 1, 10, 30, 0, 5e8, time.UTC)) {
+		t.Errorf("Expected the points at 10:00 and 10:30 UTC but got %+v", points)
+	}
+
+	rows := ImportRows(ImportStruct{Names: []string{"Temperature"},
+		Timestamps: []string{"2023-05-01T12:00:00+02:00"}, Data: [][]string{{"20"}}})
+	if len(rows) != 1 || rows[0].Timestamp != "2023-05-01 10:00:00" {
+		t.Errorf("Expected normalized row but got %+v", rows)
+	}
+	if err := dbh.InsertRowToTable("zoned", rows[0]); err != nil {
+		t.Fatalf("Failed to insert row: %v", err)
+	}
+	if err := dbh.InsertIntoDatabase("zoned", ImportStruct{Names: []string{"Temperature"},
+		Timestamps: []string{"2023-05-01T11:00:00+02:00"}, Data: [][]string{{"21"}}}); err != nil {
+		t.Fatalf("Failed to insert: %v", err)
+	}
+	if n := countRows(t, dbh, "zoned WHERE Timestamp = '2023-05-01 09:00:00'"); n != 1 {
+		t.Errorf("Expected normalized wide timestamp but got %d rows", n)
+	}
+	if err := dbh.InsertTimeseries(TimeseriesImportStruct{Tag: "zoned", Timestamps: []string{"yesterday"}, Values: []string{"1"}},
+		false, DefaultTimeseriesTable); err == nil {
+		t.Errorf("Expected error for invalid timestamp")
+	}
+}
@@ -0,0 +1,261 @@
+package timeseries
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/snappy"
+	log "github.com/sirupsen/logrus"
+)
+
+// PrometheusLabel is a label of a Prometheus series
+type PrometheusLabel struct {
+	Name  string
+	Value string
+}
+
+// PrometheusSample is a sample of a Prometheus series, Timestamp is in milliseconds
+type PrometheusSample struct {
+	Value     float64
+	Timestamp int64
+}
+
+// PrometheusSeries is a series of a Prometheus remote write request
+type PrometheusSeries struct {
+	Labels  []PrometheusLabel
+	Samples []PrometheusSample
+}
+
+// DecodeRemoteWrite decodes a snappy compressed protobuf WriteRequest of the
+// Prometheus remote write protocol. Metadata, exemplars and native histograms
+// are ignored.
+func DecodeRemoteWrite(body []byte, maxSize int) ([]PrometheusSeries, error) {
+	size, err := snappy.DecodedLen(body)
+	if err != nil {
+		return nil, fmt.Errorf("invalid snappy body: %w", err)
+	}
+	if maxSize > 0 && size > maxSize {
+		return nil, fmt.Errorf("decompressed body is larger than %d bytes", maxSize)
+	}
+	data, err := snappy.Decode(nil, body)
+	if err != nil {
+		return nil, fmt.Errorf("invalid snappy body: %w", err)
+	}
+	var series []PrometheusSeries
+	// WriteRequest: repeated TimeSeries timeseries = 1
+	err = readProtoFields(data, func(field int, wireType int, value []byte, _ uint64) error {
+		if field != 1 || wireType != protoBytes {
+			return nil
+		}
+		s, err := decodePrometheusSeries(value)
+		if err != nil {
+			return err
+		}
+		series = append(series, s)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid WriteRequest: %w", err)
+	}
+	return series, nil
+}
+
+// decodePrometheusSeries decodes a TimeSeries:
+// repeated Label labels = 1, repeated Sample samples = 2
+func decodePrometheusSeries(data []byte) (PrometheusSeries, error) {
+	var series PrometheusSeries
+	err := readProtoFields(data, func(field int, wireType int, value []byte, _ uint64) error {
+		if wireType != protoBytes {
+			return nil
+		}
+		switch field {
+		case 1:
+			// Label: string name = 1, string value = 2
+			var label PrometheusLabel
+			err := readProtoFields(value, func(field int, wireType int, value []byte, _ uint64) error {
+				if wireType == protoBytes && field == 1 {
+					label.Name = string(value)
+				} else if wireType == protoBytes && field == 2 {
+					label.Value = string(value)
+				}
+				return nil
+			})
+			series.Labels = append(series.Labels, label)
+			return err
+		case 2:
+			// Sample: double value = 1, int64 timestamp = 2
+			var sample PrometheusSample
+			err := readProtoFields(value, func(field int, wireType int, _ []byte, number uint64) error {
+				if wireType == protoFixed64 && field == 1 {
+					sample.Value = math.Float64frombits(number)
+				} else if wireType == protoVarint && field == 2 {
+					sample.Timestamp = int64(number)
+				}
+				return nil
+			})
+			series.Samples = append(series.Samples, sample)
+			return err
+		}
+		return nil
+	})
+	return series, err
+}
+
+// protobuf wire types
+const (
+	protoVarint  = 0
+	protoFixed64 = 1
+	protoBytes   = 2
+	protoFixed32 = 5
+)
+
+// readProtoFields calls fn for every field of a protobuf message with the
+// content of length delimited fields or the number of the other types
+func readProtoFields(data []byte, fn func(field int, wireType int, value []byte, number uint64) error) error {
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errors.New("invalid field key")
+		}
+		data = data[n:]
+		field, wireType := int(key>>3), int(key&7)
+		var value []byte
+		var number uint64
+		switch wireType {
+		case protoVarint:
+			number, n = binary.Uvarint(data)
+			if n <= 0 {
+				return errors.New("invalid varint")
+			}
+			data = data[n:]
+		case protoFixed64:
+			if len(data) < 8 {
+				return errors.New("truncated fixed64")
+			}
+			number = binary.LittleEndian.Uint64(data)
+			data = data[8:]
+		case protoBytes:
+			length, n := binary.Uvarint(data)
+			if n <= 0 || length > uint64(len(data)-n) {
+				return errors.New("invalid length")
+			}
+			value = data[n : n+int(length)]
+			data = data[n+int(length):]
+		case protoFixed32:
+			if len(data) < 4 {
+				return errors.New("truncated fixed32")
+			}
+			number = uint64(binary.LittleEndian.Uint32(data))
+			data = data[4:]
+		default:
+			return fmt.Errorf("unsupported wire type %d", wireType)
+		}
+		if err := fn(field, wireType, value, number); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PrometheusTagName returns the tag of a label set in the notation of
+// Prometheus with sorted labels, e.g. up{instance="pi:9100",job="node"}.
+func PrometheusTagName(labels []PrometheusLabel) string {
+	name := ""
+	sorted := make([]PrometheusLabel, 0, len(labels))
+	for _, label := range labels {
+		if label.Name == "__name__" {
+			name = label.Value
+		} else if len(label.Value) > 0 {
+			sorted = append(sorted, label)
+		}
+	}
+	if len(sorted) == 0 {
+		return name
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+	var str strings.Builder
+	str.WriteString(name + "{")
+	for i, label := range sorted {
+		if i > 0 {
+			str.WriteByte(',')
+		}
+		str.WriteString(label.Name + "=" + strconv.Quote(label.Value))
+	}
+	str.WriteByte('}')
+	return str.String()
+}
+
+// WriteRemoteWrite stores the samples of Prometheus series into a timeseries
+// table with the tags of PrometheusTagName. NaN samples (e.g. staleness
+// markers) are skipped. It returns the number of written points.
+func (dbh *DbHandler) WriteRemoteWrite(series []PrometheusSeries, onConflictDoNothing bool, table string) (int, error) {
+	return dbh.WriteRemoteWriteContext(context.Background(), series, onConflictDoNothing, table)
+}
+
+// WriteRemoteWriteContext stores Prometheus series, see WriteRemoteWrite.
+func (dbh *DbHandler) WriteRemoteWriteContext(ctx context.Context, series []PrometheusSeries, onConflictDoNothing bool, table string) (int, error) {
+	logFields := log.Fields{"package": logPkg, "func": "WriteRemoteWrite"}
+	var points []Point
+	for _, s := range series {
+		tag := PrometheusTagName(s.Labels)
+		for _, sample := range s.Samples {
+			if math.IsNaN(sample.Value) {
+				continue
+			}
+			points = append(points, Point{Time: time.UnixMilli(sample.Timestamp).UTC(), Tag: tag, Value: sample.Value})
+		}
+	}
+	if len(points) == 0 {
+		return 0, nil
+	}
+	if err := dbh.InsertPointsContext(ctx, points, onConflictDoNothing, table); err != nil {
+		log.WithFields(logFields).Errorf("Failed to write %d samples: %v", len(points), err)
+		return 0, err
+	}
+	log.WithFields(logFields).Infof("Wrote %d samples of %d series", len(points), len(series))
+	return len(points), nil
+}
+
+// handleRemoteWrite receives Prometheus remote write requests. Invalid
+// requests are answered with 400 so Prometheus doesn't retry them, database
+// errors with 500 so they are retried.
+func (s *Server) handleRemoteWrite(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if encoding := r.Header.Get("Content-Encoding"); len(encoding) > 0 && encoding != "snappy" {
+		http.Error(w, "content encoding must be snappy", http.StatusUnsupportedMediaType)
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, s.conf.MaxBodySize))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, fmt.Sprintf("request body is larger than %d bytes", tooLarge.Limit), http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	series, err := DecodeRemoteWrite(body, int(s.conf.MaxBodySize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err := s.dbh.WriteRemoteWriteContext(r.Context(), series, s.conf.OnConflictDoNothing, s.conf.Table); err != nil {
+		http.Error(w, "failed to write samples", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
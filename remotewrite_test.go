@@ -0,0 +1,101 @@
+package timeseries
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+)
+
+// testdata/remote_write_node.snappy is a WriteRequest encoded with the prompb
+// package of Prometheus v0.45.0 and snappy, it contains node exporter series,
+// a staleness marker and metadata.
+func readRemoteWritePayload(t *testing.T) []byte {
+	t.Helper()
+	payload, err := os.ReadFile("testdata/remote_write_node.snappy")
+	if err != nil {
+		t.Fatalf("Failed to read payload: %v", err)
+	}
+	return payload
+}
+
+func TestDecodeRemoteWrite(t *testing.T) {
+	t.Parallel()
+	series, err := DecodeRemoteWrite(readRemoteWritePayload(t), 0)
+	if err != nil {
+		t.Fatalf("Failed to decode: %v", err)
+	}
+	if len(series) != 3 || len(series[0].Labels) != 5 || len(series[1].Samples) != 2 {
+		t.Fatalf("Unexpected series %+v", series)
+	}
+	expected := []PrometheusSample{{Value: 1234.5, Timestamp: 1685620800000}, {Value: 1244.75, Timestamp: 1685620815000}}
+	if !reflect.DeepEqual(series[0].Samples, expected) {
+		t.Errorf("Expected %+v but got %+v", expected, series[0].Samples)
+	}
+	for i, expected := range []string{
+		`node_cpu_seconds_total{cpu="0",instance="pi:9100",job="node",mode="idle"}`,
+		`node_load1{instance="pi:9100",job="node"}`,
+		`up{instance="pi:9100",job="node",note="a \"quoted\"\nvalue"}`,
+	} {
+		if tag := PrometheusTagName(series[i].Labels); tag != expected {
+			t.Errorf("Expected tag %s but got %s", expected, tag)
+		}
+	}
+	// the order of the labels doesn't change the tag
+	labels := []PrometheusLabel{{Name: "job", Value: "node"}, {Name: "__name__", Value: "up"}, {Name: "instance", Value: "pi:9100"}}
+	if tag := PrometheusTagName(labels); tag != `up{instance="pi:9100",job="node"}` {
+		t.Errorf("Unexpected tag %s", tag)
+	}
+
+	if _, err := DecodeRemoteWrite(readRemoteWritePayload(t), 100); err == nil {
+		t.Errorf("Expected error for size limit")
+	}
+	if _, err := DecodeRemoteWrite(snappy.Encode(nil, []byte{0x0a, 0x10, 0x01}), 0); err == nil {
+		t.Errorf("Expected error for truncated message")
+	}
+}
+
+func TestServerRemoteWrite(t *testing.T) {
+	t.Parallel()
+	dbh := newTestDbHandler(t)
+	server := httptest.NewServer(NewServer(dbh, ServerConfig{}))
+	defer server.Close()
+
+	post := func(body []byte) int {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodPost, server.URL+"/api/v1/write", bytes.NewReader(body))
+		req.Header.Set("Content-Encoding", "snappy")
+		req.Header.Set("Content-Type", "application/x-protobuf")
+		req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to post: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if status := post(readRemoteWritePayload(t)); status != http.StatusNoContent {
+		t.Fatalf("Expected 204 but got %d", status)
+	}
+	start := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	tags := []string{`node_cpu_seconds_total{cpu="0",instance="pi:9100",job="node",mode="idle"}`, `node_load1{instance="pi:9100",job="node"}`,
+		`up{instance="pi:9100",job="node",note="a \"quoted\"\nvalue"}`}
+	series, err := dbh.QueryRange(DefaultTimeseriesTable, tags, start, start.Add(time.Minute), QueryOptions{IncludeNulls: true})
+	if err != nil {
+		t.Fatalf("Failed to query: %v", err)
+	}
+	// the staleness marker of node_load1 is skipped
+	if len(series[0].Points) != 2 || len(series[1].Points) != 1 || len(series[2].Points) != 1 ||
+		!series[2].Points[0].Time.Equal(start.Add(123*time.Millisecond)) {
+		t.Errorf("Unexpected series %+v", series)
+	}
+
+	if status := post([]byte("not snappy")); status != http.StatusBadRequest {
+		t.Errorf("Expected 400 but got %d", status)
+	}
+}
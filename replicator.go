@@ -0,0 +1,452 @@
+package timeseries
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ReplicationCheckpointTable stores in the destination up to which source
+// row or batch a Replicator has shipped.
+const ReplicationCheckpointTable string = "replication_checkpoints"
+
+// ReplicationTable is a table which is shipped by a Replicator
+type ReplicationTable struct {
+	Table       string
+	Columns     []string // columns of a wide table with a Fetched column, nil for a timeseries table
+	Destination string   // table in the destination, Table if empty
+}
+
+// ReplicatorConfig configures a Replicator
+type ReplicatorConfig struct {
+	Name       string // identifies the source in the checkpoints of the destination
+	Tables     []ReplicationTable
+	BatchSize  int           // rows per transaction, 500 if 0
+	Interval   time.Duration // wait time after everything was shipped, 1 minute if 0
+	MinBackoff time.Duration // wait time after the first failure, 1 second if 0
+	MaxBackoff time.Duration // maximum wait time after failures, 5 minutes if 0
+}
+
+// Replicator ships rows from a local sqlite database to another database,
+// typically a central postgres. Each batch is written in one destination
+// transaction together with a checkpoint, so a batch is never shipped twice
+// even if the source couldn't be updated after the destination committed.
+//
+// Timeseries tables are shipped as they grow, the checkpoint is the highest
+// shipped id (see addIDColumn). Rows of wide tables are taken from the outbox
+// (Fetched = 0): they are marked with the negative batch number before they
+// are shipped and as fetched after the destination committed. Marked rows of
+// batches up to the checkpoint are shipped, the others are shipped again.
+type Replicator struct {
+	source      *DbHandler
+	destination *DbHandler
+	conf        ReplicatorConfig
+}
+
+// NewReplicator creates a replicator from source to destination. The source
+// has to be sqlite. A source table should be shipped by one replicator only.
+func NewReplicator(source *DbHandler, destination *DbHandler, conf ReplicatorConfig) (*Replicator, error) {
+	if source.conf.UsePostgres {
+		return nil, errors.New("replication source must be sqlite")
+	}
+	if len(conf.Name) == 0 {
+		return nil, errors.New("replicator needs a name")
+	}
+	conf.Tables = append([]ReplicationTable(nil), conf.Tables...)
+	for i, table := range conf.Tables {
+		if len(table.Destination) == 0 {
+			conf.Tables[i].Destination = table.Table
+		}
+		if _, err := source.quoteIdentifier(table.Table); err != nil {
+			return nil, err
+		}
+		if _, err := destination.quoteIdentifier(conf.Tables[i].Destination); err != nil {
+			return nil, err
+		}
+		if _, err := source.quoteIdentifiers(table.Columns); err != nil {
+			return nil, err
+		}
+	}
+	if conf.BatchSize <= 0 {
+		conf.BatchSize = 500
+	}
+	if conf.Interval <= 0 {
+		conf.Interval = time.Minute
+	}
+	if conf.MinBackoff <= 0 {
+		conf.MinBackoff = time.Second
+	}
+	if conf.MaxBackoff <= 0 {
+		conf.MaxBackoff = 5 * time.Minute
+	}
+	return &Replicator{source: source, destination: destination, conf: conf}, nil
+}
+
+// Run replicates every interval until ctx is done. Failed runs are retried
+// with exponential backoff. It returns the error of ctx.
+func (r *Replicator) Run(ctx context.Context) error {
+	logFields := log.Fields{"package": logPkg, "func": "Run"}
+	backoff := r.conf.MinBackoff
+	for {
+		wait := r.conf.Interval
+		shipped, err := r.RunOnceContext(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			log.WithFields(logFields).Warnf("Replication %s failed, retry in %v: %v", r.conf.Name, backoff, err)
+			wait = backoff
+			backoff *= 2
+			if backoff > r.conf.MaxBackoff {
+				backoff = r.conf.MaxBackoff
+			}
+		} else {
+			backoff = r.conf.MinBackoff
+			log.WithFields(logFields).Tracef("Replication %s shipped %d rows", r.conf.Name, shipped)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// RunOnce ships all pending rows and returns how many were shipped.
+func (r *Replicator) RunOnce() (int, error) {
+	return r.RunOnceContext(context.Background())
+}
+
+// RunOnceContext ships all pending rows, see RunOnce.
+func (r *Replicator) RunOnceContext(ctx context.Context) (int, error) {
+	shipped := 0
+	for _, table := range r.conf.Tables {
+		n, err := r.replicateTable(ctx, table)
+		shipped += n
+		if err != nil {
+			log.WithField("package", logPkg).Errorf("Failed to replicate %s: %v", table.Table, err)
+			return shipped, err
+		}
+	}
+	return shipped, nil
+}
+
+func (r *Replicator) checkpointName(table ReplicationTable) string {
+	return r.conf.Name + ":" + table.Table + ":" + table.Destination
+}
+
+func (r *Replicator) replicateTable(ctx context.Context, table ReplicationTable) (int, error) {
+	position, err := r.checkpoint(ctx, table)
+	if err != nil {
+		return 0, err
+	}
+	var columnTypes []int
+	if table.Columns != nil {
+		// batches which were marked before the last run stopped
+		if err := r.recoverBatches(ctx, table, position); err != nil {
+			return 0, err
+		}
+		if columnTypes, err = r.createWideDestination(ctx, table); err != nil {
+			return 0, err
+		}
+	} else {
+		if err := r.prepareTimeseriesSource(ctx, table, position); err != nil {
+			return 0, err
+		}
+		if err := r.destination.CreateTimeseriesTableContext(ctx, table.Destination); err != nil {
+			return 0, err
+		}
+	}
+
+	shipped := 0
+	for {
+		var n int
+		if table.Columns != nil {
+			n, position, err = r.shipWideBatch(ctx, table, columnTypes, position)
+		} else {
+			n, position, err = r.shipTimeseriesBatch(ctx, table, position)
+		}
+		shipped += n
+		if err != nil || n < r.conf.BatchSize {
+			return shipped, err
+		}
+	}
+}
+
+// checkpoint returns the highest shipped id or batch of table, 0 if none was shipped
+func (r *Replicator) checkpoint(ctx context.Context, table ReplicationTable) (int64, error) {
+	rows, err := r.destination.ExecuteQueryContext(ctx, "SELECT position FROM "+ReplicationCheckpointTable+
+		" WHERE name = "+r.destination.placeholder(1), r.checkpointName(table))
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	var position int64
+	if rows.Next() {
+		if err := rows.Scan(&position); err != nil {
+			return 0, err
+		}
+	}
+	return position, rows.Err()
+}
+
+// commit writes rows and the checkpoint into the destination in one transaction
+func (r *Replicator) commit(ctx context.Context, table ReplicationTable, columns []string, rows [][]any, position int64) error {
+	var inserted int64
+	err := r.destination.inTransaction(ctx, func(tx *sql.Tx) error {
+		var err error
+		if inserted, err = r.destination.insertRowsTx(ctx, tx, table.Destination, columns, rows, ""); err != nil {
+			return err
+		}
+		_, err = r.destination.insertRowsTx(ctx, tx, ReplicationCheckpointTable,
+			[]string{"name", "position", "updated_at"},
+			[][]any{{r.checkpointName(table), position, FormatTimestamp(time.Now())}},
+			"ON CONFLICT (name) DO UPDATE SET position = excluded.position, updated_at = excluded.updated_at")
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	r.destination.metrics.addRowsInserted(table.Destination, inserted)
+	return nil
+}
+
+// recoverBatches resolves the rows of wide tables which are marked with a
+// batch number: batches up to position were committed and are fetched, the
+// rows of later batches are unfetched again.
+func (r *Replicator) recoverBatches(ctx context.Context, table ReplicationTable, position int64) error {
+	logFields := log.Fields{"package": logPkg, "func": "recoverBatches"}
+	quoted, err := r.source.quoteIdentifier(table.Table)
+	if err != nil {
+		return err
+	}
+	return r.source.inTransaction(ctx, func(tx *sql.Tx) error {
+		res, err := tx.ExecContext(ctx, "UPDATE "+quoted+" SET Fetched = 1 WHERE Fetched < 0 AND Fetched >= ?", -position)
+		if err != nil {
+			return err
+		}
+		if affected, err := res.RowsAffected(); err == nil && affected > 0 {
+			log.WithFields(logFields).Infof("Marked %d already shipped rows of %s as fetched", affected, table.Table)
+		}
+		res, err = tx.ExecContext(ctx, "UPDATE "+quoted+" SET Fetched = 0 WHERE Fetched < ?", -position)
+		if err != nil {
+			return err
+		}
+		if affected, err := res.RowsAffected(); err == nil && affected > 0 {
+			log.WithFields(logFields).Infof("%d rows of %s weren't shipped and are sent again", affected, table.Table)
+		}
+		return nil
+	})
+}
+
+// prepareTimeseriesSource adds the id column to a timeseries table created by
+// an earlier version and makes sure that new ids are above position.
+func (r *Replicator) prepareTimeseriesSource(ctx context.Context, table ReplicationTable, position int64) error {
+	return r.source.inTransaction(ctx, func(tx *sql.Tx) error {
+		if err := r.source.addIDColumn(ctx, tx, table.Table); err != nil {
+			return err
+		}
+		// rowids used as checkpoint before the upgrade may have been reused
+		name := table.Table[strings.LastIndex(table.Table, ".")+1:]
+		_, err := tx.ExecContext(ctx, "INSERT INTO sqlite_sequence (name, seq) SELECT ?, 0"+
+			" WHERE NOT EXISTS (SELECT 1 FROM sqlite_sequence WHERE name = ?)", name, name)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, "UPDATE sqlite_sequence SET seq = ? WHERE name = ? AND seq < ?", position, name, position)
+		return err
+	})
+}
+
+// addIDColumn adds the id column created by CreateTimeseriesTable and
+// InsertRowToTable to a table of an earlier version. Ids are never reused,
+// unlike rowids which are reused after the newest rows were deleted and
+// renumbered by VACUUM. Sqlite tables are rebuilt, the rowids become the ids
+// and the indexes are created again. Nothing is done if the table doesn't
+// exist or has an id.
+func (dbh *DbHandler) addIDColumn(ctx context.Context, tx *sql.Tx, tableName string) error {
+	table, err := dbh.quoteIdentifier(tableName)
+	if err != nil {
+		return err
+	}
+	if dbh.conf.UsePostgres {
+		log.WithField("package", logPkg).Infof("Add id column to %s", tableName)
+		_, err := tx.ExecContext(ctx, "ALTER TABLE "+table+" ADD COLUMN IF NOT EXISTS id BIGSERIAL PRIMARY KEY")
+		return err
+	}
+	name := tableName[strings.LastIndex(tableName, ".")+1:]
+	var createSQL string
+	err = tx.QueryRowContext(ctx, "SELECT sql FROM sqlite_master WHERE type = 'table' AND name = ?", name).Scan(&createSQL)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if strings.Contains(strings.ToUpper(createSQL), "AUTOINCREMENT") {
+		return nil
+	}
+
+	var columns, indexes []string
+	rows, err := tx.QueryContext(ctx, "SELECT name FROM pragma_table_info(?) ORDER BY cid", name)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var column string
+		if err := rows.Scan(&column); err != nil {
+			rows.Close()
+			return err
+		}
+		if strings.EqualFold(column, "id") {
+			rows.Close()
+			return fmt.Errorf("table %s has a column id which isn't an autoincrement key", tableName)
+		}
+		columns = append(columns, column)
+	}
+	rows.Close()
+	rows, err = tx.QueryContext(ctx, "SELECT sql FROM sqlite_master WHERE type = 'index' AND tbl_name = ? AND sql IS NOT NULL", name)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var index string
+		if err := rows.Scan(&index); err != nil {
+			rows.Close()
+			return err
+		}
+		indexes = append(indexes, index)
+	}
+	rows.Close()
+	quoted, err := dbh.quoteIdentifiers(columns)
+	if err != nil {
+		return err
+	}
+	old, err := dbh.quoteIdentifier(name + "_without_id")
+	if err != nil {
+		return err
+	}
+
+	log.WithField("package", logPkg).Infof("Add id column to %s", tableName)
+	statements := []string{
+		"ALTER TABLE " + table + " RENAME TO " + old,
+		strings.Replace(createSQL, "(", "(id INTEGER PRIMARY KEY AUTOINCREMENT, ", 1),
+		"INSERT INTO " + table + " (id, " + strings.Join(quoted, ", ") + ") SELECT rowid, " +
+			strings.Join(quoted, ", ") + " FROM " + old + " ORDER BY rowid",
+		"DROP TABLE " + old,
+	}
+	for _, statement := range append(statements, indexes...) {
+		if _, err := tx.ExecContext(ctx, statement); err != nil {
+			return fmt.Errorf("failed to add id to %s: %v", tableName, err)
+		}
+	}
+	return nil
+}
+
+// createWideDestination creates the destination table with the column
+// types of the source
+func (r *Replicator) createWideDestination(ctx context.Context, table ReplicationTable) ([]int, error) {
+	sourceColumns, err := r.source.tableColumns(ctx, table.Table)
+	if err != nil {
+		return nil, err
+	}
+	samples := make([]string, len(table.Columns))
+	for i, column := range table.Columns {
+		samples[i] = "text"
+		for _, sourceColumn := range sourceColumns {
+			if strings.EqualFold(sourceColumn.Name, column) && sourceColumn.isNumeric() {
+				samples[i] = "float"
+			}
+		}
+	}
+	return r.destination.createWideTable(ctx, table.Destination, table.Columns, samples, false)
+}
+
+func (r *Replicator) shipWideBatch(ctx context.Context, table ReplicationTable, columnTypes []int, position int64) (int, int64, error) {
+	batch, err := r.source.readUnfetched(ctx, table.Table, table.Columns, r.conf.BatchSize, true)
+	if err != nil || batch.Len() == 0 {
+		return 0, position, err
+	}
+	next := position + 1
+	if err := r.source.markBatch(ctx, batch, -next); err != nil {
+		return 0, position, err
+	}
+	rows := make([][]any, 0, batch.Len())
+	for i, timestamp := range batch.Rows.Timestamps {
+		row := []any{timestamp}
+		for c := range table.Columns {
+			value := batch.Rows.Data[c][i]
+			if columnTypes[c] == columnTextType {
+				row = append(row, value)
+			} else {
+				row = append(row, parseNumber(value))
+			}
+		}
+		rows = append(rows, row)
+	}
+	columns := append([]string{"Timestamp"}, table.Columns...)
+	// if this fails the rows are unfetched again by recoverBatches in the next run
+	if err := r.commit(ctx, table, columns, rows, next); err != nil {
+		return 0, position, err
+	}
+	// if this fails the rows are marked by recoverBatches in the next run
+	quoted, err := r.source.quoteIdentifier(table.Table)
+	if err != nil {
+		return batch.Len(), next, err
+	}
+	err = r.source.execute(ctx, func() error {
+		_, err := r.source.DB.ExecContext(ctx, "UPDATE "+quoted+" SET Fetched = 1 WHERE Fetched = ?", -next)
+		return err
+	})
+	return batch.Len(), next, err
+}
+
+func (r *Replicator) shipTimeseriesBatch(ctx context.Context, table ReplicationTable, position int64) (int, int64, error) {
+	quoted, err := r.source.quoteIdentifier(table.Table)
+	if err != nil {
+		return 0, position, err
+	}
+	rows, err := r.source.ExecuteQueryContext(ctx, "SELECT id, tag, time, value, comment FROM "+quoted+
+		" WHERE id > ? ORDER BY id LIMIT ?", position, r.conf.BatchSize)
+	if err != nil {
+		return 0, position, err
+	}
+	var points []Point
+	next := position
+	for rows.Next() {
+		var id int64
+		var tag string
+		var timestamp any
+		var value *float64
+		var comment *string
+		if err := rows.Scan(&id, &tag, &timestamp, &value, &comment); err != nil {
+			rows.Close()
+			return 0, position, err
+		}
+		point, err := newPoint(tag, timestamp, value, comment)
+		if err != nil {
+			rows.Close()
+			return 0, position, err
+		}
+		points = append(points, point)
+		next = id
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil || len(points) == 0 {
+		return 0, position, err
+	}
+	values := make([][]any, 0, len(points))
+	for _, point := range points {
+		values = append(values, pointRow(point.Tag, point))
+	}
+	if err := r.commit(ctx, table, []string{"time", "tag", "value", "comment"}, values, next); err != nil {
+		return 0, position, err
+	}
+	r.destination.afterInsert(ctx, table.Destination, points)
+	return len(points), next, nil
+}
@@ -0,0 +1,184 @@
+package timeseries
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func countRows(t *testing.T, dbh *DbHandler, table string) int {
+	t.Helper()
+	rows, err := dbh.ExecuteQuery("SELECT count(*) FROM " + table)
+	if err != nil {
+		t.Fatalf("Failed to count rows of %s: %v", table, err)
+	}
+	defer rows.Close()
+	count := 0
+	if rows.Next() {
+		if err := rows.Scan(&count); err != nil {
+			t.Fatalf("Failed to count rows of %s: %v", table, err)
+		}
+	}
+	return count
+}
+
+func TestReplicator(t *testing.T) {
+	t.Parallel()
+	source := newTestDbHandler(t)
+	destination := newTestDbHandler(t)
+	names := []string{"Temperature", "Room"}
+	for i := 0; i < 7; i++ {
+		row := ImportRowStruct{Names: names, Timestamp: fmt.Sprintf("2023-06-01 12:00:0%d", i),
+			Values: []string{fmt.Sprint(20 + i), "living"}}
+		if err := source.InsertRowToTable("sensor_data", row); err != nil {
+			t.Fatalf("Failed to insert: %v", err)
+		}
+	}
+	start := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	var points []Point
+	for i := 0; i < 5; i++ {
+		points = append(points, Point{Time: start.Add(time.Duration(i) * time.Minute), Tag: "a", Value: float64(i)})
+	}
+	if err := source.InsertPoints(points, false, DefaultTimeseriesTable); err != nil {
+		t.Fatalf("Failed to insert: %v", err)
+	}
+
+	conf := ReplicatorConfig{
+		Name: "device1",
+		Tables: []ReplicationTable{
+			{Table: "sensor_data", Columns: names, Destination: "device1_sensor_data"},
+			{Table: DefaultTimeseriesTable},
+		},
+		BatchSize: 3,
+	}
+	if _, err := NewReplicator(source, destination, ReplicatorConfig{Tables: conf.Tables}); err == nil {
+		t.Errorf("Expected error for replicator without name")
+	}
+	replicator, err := NewReplicator(source, destination, conf)
+	if err != nil {
+		t.Fatalf("Failed to create replicator: %v", err)
+	}
+	shipped, err := replicator.RunOnce()
+	if err != nil || shipped != 12 {
+		t.Fatalf("Expected 12 shipped rows but got %d: %v", shipped, err)
+	}
+	if count := countRows(t, destination, "device1_sensor_data"); count != 7 {
+		t.Errorf("Expected 7 rows in destination but got %d", count)
+	}
+	if values, err := destination.QueryRange(DefaultTimeseriesTable, []string{"a"}, start, start.Add(time.Hour), QueryOptions{}); err != nil ||
+		len(values[0].Points) != 5 || values[0].Points[4].Value != 4 {
+		t.Errorf("Unexpected points in destination %+v: %v", values, err)
+	}
+	if batch, err := source.ReadUnfetched("sensor_data", names, 10); err != nil || batch.Len() != 0 {
+		t.Errorf("Expected all rows to be fetched but got %d: %v", batch.Len(), err)
+	}
+
+	// batch 3 was committed but marking the source failed, batch 4 was
+	// marked but the destination didn't commit
+	row := ImportRowStruct{Names: names, Timestamp: "2023-06-01 12:00:09", Values: []string{"30", "kitchen"}}
+	if err := source.InsertRowToTable("sensor_data", row); err != nil {
+		t.Fatalf("Failed to insert: %v", err)
+	}
+	for _, sqlStr := range []string{
+		"UPDATE sensor_data SET Fetched = -3 WHERE rowid IN (6, 7)",
+		"UPDATE sensor_data SET Fetched = -4 WHERE rowid = 8",
+		// deleted rows must not make the ids of new points look shipped
+		"DELETE FROM measurements",
+	} {
+		if err := source.writeToDB(context.Background(), sqlStr); err != nil {
+			t.Fatalf("Failed to prepare source: %v", err)
+		}
+	}
+	var late []Point
+	for i := 0; i < 3; i++ {
+		late = append(late, Point{Time: start.Add(time.Hour + time.Duration(i)*time.Minute), Tag: "b", Value: float64(i)})
+	}
+	if err := source.InsertPoints(late, false, DefaultTimeseriesTable); err != nil {
+		t.Fatalf("Failed to insert: %v", err)
+	}
+	shipped, err = replicator.RunOnce()
+	if err != nil || shipped != 4 {
+		t.Fatalf("Expected 4 shipped rows but got %d: %v", shipped, err)
+	}
+	if count := countRows(t, destination, "device1_sensor_data"); count != 8 {
+		t.Errorf("Expected 8 rows in destination but got %d", count)
+	}
+	if count := countRows(t, destination, DefaultTimeseriesTable); count != 8 {
+		t.Errorf("Expected 8 points in destination but got %d", count)
+	}
+	if count := countRows(t, source, "sensor_data WHERE Fetched <> 1"); count != 0 {
+		t.Errorf("Expected all rows to be fetched but got %d", count)
+	}
+
+	// rowids of deleted outbox rows are reused
+	if err := source.writeToDB(context.Background(), "DELETE FROM sensor_data"); err != nil {
+		t.Fatalf("Failed to clean outbox: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		row := ImportRowStruct{Names: names, Timestamp: fmt.Sprintf("2023-06-01 13:00:0%d", i), Values: []string{"25", "bath"}}
+		if err := source.InsertRowToTable("sensor_data", row); err != nil {
+			t.Fatalf("Failed to insert: %v", err)
+		}
+	}
+	shipped, err = replicator.RunOnce()
+	if err != nil || shipped != 2 {
+		t.Fatalf("Expected 2 shipped rows but got %d: %v", shipped, err)
+	}
+	if count := countRows(t, destination, "device1_sensor_data WHERE Room = 'bath'"); count != 2 {
+		t.Errorf("Expected 2 new rows in destination but got %d", count)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := replicator.Run(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected deadline exceeded but got %v", err)
+	}
+}
+
+func TestReplicatorUpgradesTimeseriesTable(t *testing.T) {
+	t.Parallel()
+	source := newTestDbHandler(t)
+	destination := newTestDbHandler(t)
+	// a table of an earlier version without id which was shipped up to rowid 5
+	for _, sqlStr := range []string{
+		"CREATE TABLE legacy (time DATETIME, tag TEXT NOT NULL, value DOUBLE PRECISION NULL, comment TEXT DEFAULT '')",
+		"CREATE UNIQUE INDEX legacy_time_tag_key ON legacy (time, tag)",
+	} {
+		if err := source.writeToDB(context.Background(), sqlStr); err != nil {
+			t.Fatalf("Failed to create legacy table: %v", err)
+		}
+	}
+	start := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	points := []Point{{Time: start, Tag: "a", Value: 1}, {Time: start.Add(time.Minute), Tag: "a", Value: 2}}
+	if err := source.InsertPoints(points, false, "legacy"); err != nil {
+		t.Fatalf("Failed to insert: %v", err)
+	}
+	replicator, err := NewReplicator(source, destination, ReplicatorConfig{Name: "device1", Tables: []ReplicationTable{{Table: "legacy"}}})
+	if err != nil {
+		t.Fatalf("Failed to create replicator: %v", err)
+	}
+	if err := destination.CreateTimeseriesTable("legacy"); err != nil {
+		t.Fatalf("Failed to create destination: %v", err)
+	}
+	err = replicator.commit(context.Background(), replicator.conf.Tables[0], []string{"time", "tag", "value", "comment"}, nil, 5)
+	if err != nil {
+		t.Fatalf("Failed to write checkpoint: %v", err)
+	}
+
+	if shipped, err := replicator.RunOnce(); err != nil || shipped != 0 {
+		t.Fatalf("Expected nothing to ship but got %d: %v", shipped, err)
+	}
+	if count := countRows(t, source, "legacy WHERE id = 2 AND value = 2"); count != 1 {
+		t.Errorf("Expected rowids to become ids")
+	}
+	if count := countRows(t, source, "sqlite_master WHERE name = 'legacy_time_tag_key'"); count != 1 {
+		t.Errorf("Expected unique key to be kept")
+	}
+	if err := source.InsertPoints([]Point{{Time: start.Add(time.Hour), Tag: "a", Value: 3}}, false, "legacy"); err != nil {
+		t.Fatalf("Failed to insert: %v", err)
+	}
+	if shipped, err := replicator.RunOnce(); err != nil || shipped != 1 {
+		t.Fatalf("Expected new point to be shipped but got %d: %v", shipped, err)
+	}
+}
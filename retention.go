@@ -0,0 +1,265 @@
+package timeseries
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultRetentionBatchSize is the number of rows deleted per statement
+const defaultRetentionBatchSize int = 1000
+
+// defaultRetentionInterval is used by StartRetention if no interval is given
+const defaultRetentionInterval time.Duration = time.Hour
+
+// RetentionRule deletes the points of Table which are older than MaxAge.
+// Table is a timeseries table with time and tag columns, wide tables aren't
+// supported.
+// Rules are independent, a point is deleted as soon as one rule matches.
+// The latest value cache of Table is left alone, so it keeps the last value
+// of tags whose points were all deleted.
+type RetentionRule struct {
+	Table      string
+	TagPattern string        // tags to delete, '*' matches any characters, all tags if empty
+	MaxAge     time.Duration // keep points newer than this
+	BatchSize  int           // rows deleted per statement, 1000 if 0
+}
+
+// RetentionResult reports what RunRetention deleted for one rule
+type RetentionResult struct {
+	Rule          RetentionRule
+	Cutoff        time.Time
+	Deleted       int64 // rows deleted by statements, rows of dropped chunks are not counted
+	DroppedChunks int   // chunks removed with TimescaleDB drop_chunks
+}
+
+// AddRetentionRule adds a rule which is applied by RunRetention and the
+// background enforcement started with StartRetention. If the table exists
+// already it must be a timeseries table.
+func (dbh *DbHandler) AddRetentionRule(rule RetentionRule) error {
+	columns, err := dbh.tableColumns(context.Background(), rule.Table)
+	if err != nil {
+		return err
+	}
+	if len(columns) > 0 {
+		names := make(map[string]bool, len(columns))
+		for _, column := range columns {
+			names[strings.ToLower(column.Name)] = true
+		}
+		if !names["time"] || !names["tag"] {
+			return fmt.Errorf("%s has no time and tag columns, retention only supports timeseries tables", rule.Table)
+		}
+	}
+	if rule.MaxAge <= 0 {
+		return fmt.Errorf("max age of retention rule for %s must be positive", rule.Table)
+	}
+	if rule.BatchSize < 0 {
+		return fmt.Errorf("batch size of retention rule for %s must not be negative", rule.Table)
+	}
+	dbh.stateMutex.Lock()
+	defer dbh.stateMutex.Unlock()
+	dbh.retentionRules = append(dbh.retentionRules, rule)
+	return nil
+}
+
+// RemoveRetentionRule removes a rule added with AddRetentionRule, it returns
+// false if the rule doesn't exist.
+func (dbh *DbHandler) RemoveRetentionRule(rule RetentionRule) bool {
+	dbh.stateMutex.Lock()
+	defer dbh.stateMutex.Unlock()
+	for i, existing := range dbh.retentionRules {
+		if existing == rule {
+			dbh.retentionRules = append(dbh.retentionRules[:i], dbh.retentionRules[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// RetentionRules returns the configured rules
+func (dbh *DbHandler) RetentionRules() []RetentionRule {
+	dbh.stateMutex.Lock()
+	defer dbh.stateMutex.Unlock()
+	return append([]RetentionRule(nil), dbh.retentionRules...)
+}
+
+// RunRetention applies all rules once and reports the deleted rows per rule.
+// Table-wide rules of hypertables drop whole chunks with drop_chunks first.
+func (dbh *DbHandler) RunRetention() ([]RetentionResult, error) {
+	return dbh.RunRetentionContext(context.Background())
+}
+
+// RunRetentionContext applies all rules once, see RunRetention.
+func (dbh *DbHandler) RunRetentionContext(ctx context.Context) ([]RetentionResult, error) {
+	logFields := log.Fields{"package": logPkg, "func": "RunRetention"}
+	var results []RetentionResult
+	for _, rule := range dbh.RetentionRules() {
+		result, err := dbh.applyRetentionRule(ctx, rule, time.Now())
+		if err != nil {
+			log.WithFields(logFields).Errorf("Failed to apply retention to %s: %v", rule.Table, err)
+			return results, err
+		}
+		if result.Deleted > 0 || result.DroppedChunks > 0 {
+			log.WithFields(logFields).Infof("Deleted %d rows and %d chunks of %s (tags: %q) before %v",
+				result.Deleted, result.DroppedChunks, rule.Table, rule.TagPattern, result.Cutoff)
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// StartRetention runs RunRetention every interval (an hour if it isn't
+// positive) in a goroutine of the handler until StopRetention or Close is
+// called. A running enforcement is replaced.
+func (dbh *DbHandler) StartRetention(interval time.Duration) {
+	if interval <= 0 {
+		log.WithField("package", logPkg).Warnf("Invalid retention interval %v, use %v", interval, defaultRetentionInterval)
+		interval = defaultRetentionInterval
+	}
+	dbh.StopRetention()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	dbh.stateMutex.Lock()
+	dbh.retentionCancel = cancel
+	dbh.retentionDone = done
+	dbh.stateMutex.Unlock()
+
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if _, err := dbh.RunRetentionContext(ctx); err != nil && ctx.Err() == nil {
+				log.WithField("package", logPkg).Warnf("Retention failed: %v", err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// StopRetention stops the background enforcement and waits until a running
+// batch is finished.
+func (dbh *DbHandler) StopRetention() {
+	dbh.stateMutex.Lock()
+	cancel, done := dbh.retentionCancel, dbh.retentionDone
+	dbh.retentionCancel, dbh.retentionDone = nil, nil
+	dbh.stateMutex.Unlock()
+	if cancel != nil {
+		cancel()
+		<-done
+	}
+}
+
+func (dbh *DbHandler) applyRetentionRule(ctx context.Context, rule RetentionRule, now time.Time) (RetentionResult, error) {
+	result := RetentionResult{Rule: rule, Cutoff: now.Add(-rule.MaxAge).UTC()}
+	table, err := dbh.quoteIdentifier(rule.Table)
+	if err != nil {
+		return result, err
+	}
+	if len(rule.TagPattern) == 0 {
+		result.DroppedChunks, err = dbh.dropChunks(ctx, rule.Table, result.Cutoff)
+		if err != nil {
+			return result, err
+		}
+	}
+	batchSize := rule.BatchSize
+	if batchSize == 0 {
+		batchSize = defaultRetentionBatchSize
+	}
+
+	where := " WHERE time < " + dbh.placeholder(1)
+	args := []any{FormatTimestamp(result.Cutoff)}
+	if len(rule.TagPattern) > 0 {
+		where += " AND " + dbh.tagPatternCondition(2)
+		args = append(args, dbh.tagPattern(rule.TagPattern))
+	}
+	// (time, tag) selects the same rows on tables and hypertables, duplicates
+	// of a selected row are deleted as well since they also match
+	sqlStr := fmt.Sprintf("DELETE FROM %s WHERE (time, tag) IN (SELECT time, tag FROM %s%s LIMIT %d)",
+		table, table, where, batchSize)
+	for {
+		var affected int64
+		err := dbh.execute(ctx, func() error {
+			res, err := dbh.DB.ExecContext(ctx, sqlStr, args...)
+			if err != nil {
+				return err
+			}
+			affected, err = res.RowsAffected()
+			return err
+		})
+		if err != nil {
+			return result, err
+		}
+		result.Deleted += affected
+		if affected < int64(batchSize) {
+			break
+		}
+	}
+	return result, nil
+}
+
+// dropChunks removes the chunks of a hypertable which only contain points
+// before cutoff. It does nothing if table is no hypertable.
+func (dbh *DbHandler) dropChunks(ctx context.Context, table string, cutoff time.Time) (int, error) {
+	hasTimescale, err := dbh.HasTimescaleDBContext(ctx)
+	if err != nil || !hasTimescale {
+		return 0, err
+	}
+	regclass := strings.ToLower(table)
+	rows, err := dbh.ExecuteQueryContext(ctx, "SELECT count(*) FROM timescaledb_information.hypertables"+
+		" WHERE format('%I.%I', hypertable_schema, hypertable_name)::regclass = $1::regclass", regclass)
+	if err != nil {
+		return 0, err
+	}
+	isHypertable := false
+	for rows.Next() {
+		var count int
+		if err := rows.Scan(&count); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		isHypertable = count > 0
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil || !isHypertable {
+		return 0, err
+	}
+
+	rows, err = dbh.ExecuteQueryContext(ctx, "SELECT drop_chunks($1::regclass, older_than => $2::timestamp)",
+		regclass, FormatTimestamp(cutoff))
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	dropped := 0
+	for rows.Next() {
+		dropped++
+	}
+	return dropped, rows.Err()
+}
+
+// tagPatternCondition matches tag against the pattern returned by tagPattern
+func (dbh *DbHandler) tagPatternCondition(index int) string {
+	if dbh.conf.UsePostgres {
+		return "tag LIKE " + dbh.placeholder(index) + ` ESCAPE '\'`
+	}
+	// GLOB is case sensitive like LIKE on postgres
+	return "tag GLOB " + dbh.placeholder(index)
+}
+
+// tagPattern converts a pattern where only '*' is special into a LIKE
+// pattern on postgres and a GLOB pattern on sqlite.
+func (dbh *DbHandler) tagPattern(pattern string) string {
+	if dbh.conf.UsePostgres {
+		escaped := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(pattern)
+		return strings.ReplaceAll(escaped, "*", "%")
+	}
+	return strings.NewReplacer("[", "[[]", "?", "[?]").Replace(pattern)
+}
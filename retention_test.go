@@ -0,0 +1,127 @@
+package timeseries
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetention(t *testing.T) {
+	t.Parallel()
+	dbh := newTestDbHandler(t)
+	if err := dbh.EnableLatestCache(DefaultTimeseriesTable); err != nil {
+		t.Fatalf("Failed to enable cache: %v", err)
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	var points []Point
+	for day := 0; day < 10; day++ {
+		timestamp := now.Add(-time.Duration(day) * 24 * time.Hour)
+		points = append(points,
+			Point{Time: timestamp, Tag: "raw", Value: float64(day)},
+			Point{Time: timestamp, Tag: "debug_x", Value: float64(day)},
+			Point{Time: timestamp, Tag: "debugXy", Value: float64(day)})
+	}
+	points = append(points, Point{Time: now.Add(-20 * 24 * time.Hour), Tag: "old", Value: 1})
+	if err := dbh.InsertPoints(points, false, DefaultTimeseriesTable); err != nil {
+		t.Fatalf("Failed to insert: %v", err)
+	}
+
+	if err := dbh.AddRetentionRule(RetentionRule{Table: DefaultTimeseriesTable}); err == nil {
+		t.Errorf("Expected error for rule without max age")
+	}
+	if err := dbh.AddRetentionRule(RetentionRule{Table: "a.b.c", MaxAge: time.Hour}); err == nil {
+		t.Errorf("Expected error for invalid table")
+	}
+	row := ImportRowStruct{Names: []string{"Temperature"}, Timestamp: "2023-01-01 10:00:00", Values: []string{"20"}}
+	if err := dbh.InsertRowToTable("living", row); err != nil {
+		t.Fatalf("Failed to insert row: %v", err)
+	}
+	if err := dbh.AddRetentionRule(RetentionRule{Table: "living", MaxAge: time.Hour}); err == nil {
+		t.Errorf("Expected error for wide table")
+	}
+	tagRule := RetentionRule{Table: DefaultTimeseriesTable, TagPattern: "debug_*", MaxAge: 36 * time.Hour, BatchSize: 3}
+	tableRule := RetentionRule{Table: DefaultTimeseriesTable, MaxAge: 8*24*time.Hour + time.Hour}
+	for _, rule := range []RetentionRule{tagRule, tableRule} {
+		if err := dbh.AddRetentionRule(rule); err != nil {
+			t.Fatalf("Failed to add rule: %v", err)
+		}
+	}
+
+	results, err := dbh.RunRetention()
+	if err != nil {
+		t.Fatalf("Retention failed: %v", err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("Expected 2 results but got %+v", results)
+	}
+	// debug_x of days 2..9; debugXy doesn't match since '_' is no wildcard
+	if results[0].Deleted != 8 {
+		t.Errorf("Expected 8 deleted rows for tag rule but got %d", results[0].Deleted)
+	}
+	// day 9 of raw and debugXy and the old point
+	if results[1].Deleted != 3 {
+		t.Errorf("Expected 3 deleted rows for table rule but got %d", results[1].Deleted)
+	}
+
+	tags, err := dbh.ListTags(DefaultTimeseriesTable)
+	if err != nil {
+		t.Fatalf("Failed to list tags: %v", err)
+	}
+	counts := make(map[string]int64)
+	for _, tag := range tags {
+		counts[tag.Tag] = tag.Count
+	}
+	expected := map[string]int64{"raw": 9, "debug_x": 2, "debugXy": 9, "old": 0}
+	for tag, count := range expected {
+		if counts[tag] != count {
+			t.Errorf("Expected %d points of %s but got %d", count, tag, counts[tag])
+		}
+	}
+	latest, err := dbh.LatestValues(DefaultTimeseriesTable, "old")
+	if err != nil {
+		t.Fatalf("Failed to read latest values: %v", err)
+	}
+	// the cache keeps the last value of tags without points
+	if len(latest) != 1 || latest[0].Value != 1 {
+		t.Errorf("Expected cached value of deleted point but got %+v", latest)
+	}
+
+	if results, err := dbh.RunRetention(); err != nil || results[0].Deleted+results[1].Deleted != 0 {
+		t.Errorf("Expected nothing to delete but got %+v, %v", results, err)
+	}
+	if !dbh.RemoveRetentionRule(tagRule) || dbh.RemoveRetentionRule(tagRule) {
+		t.Errorf("Expected rule to be removed once")
+	}
+	if len(dbh.RetentionRules()) != 1 {
+		t.Errorf("Expected one rule left but got %+v", dbh.RetentionRules())
+	}
+}
+
+func TestRetentionBackground(t *testing.T) {
+	t.Parallel()
+	dbh := newTestDbHandler(t)
+	points := []Point{{Time: time.Now().Add(-time.Hour), Tag: "a", Value: 1}}
+	if err := dbh.InsertPoints(points, false, DefaultTimeseriesTable); err != nil {
+		t.Fatalf("Failed to insert: %v", err)
+	}
+	if err := dbh.AddRetentionRule(RetentionRule{Table: DefaultTimeseriesTable, MaxAge: time.Minute}); err != nil {
+		t.Fatalf("Failed to add rule: %v", err)
+	}
+	// an invalid interval falls back to the default
+	dbh.StartRetention(0)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		latest, err := dbh.LatestValues(DefaultTimeseriesTable)
+		if err != nil {
+			t.Fatalf("Failed to read latest values: %v", err)
+		}
+		if len(latest) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Background retention didn't delete %+v", latest)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	dbh.StopRetention()
+	dbh.StopRetention()
+}
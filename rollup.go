@@ -0,0 +1,436 @@
+package timeseries
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// RollupDefinitionTable stores the enabled rollups
+const RollupDefinitionTable string = "rollup_definitions"
+
+// rollupDefinitionVersion is the migration which creates RollupDefinitionTable
+const rollupDefinitionVersion int = 7
+
+// Rollup is a companion table of a timeseries table which stores the
+// aggregated values of every tag per time bucket.
+type Rollup struct {
+	Name   string          // table of the rollup, <table>_<bucket> (e.g. measurements_1h) if empty
+	Bucket time.Duration   // whole seconds, buckets are aligned to the unix epoch
+	Funcs  []AggregateFunc // avg, min, max and count if empty
+}
+
+// rollupColumn is the column of f in a rollup table
+func rollupColumn(f AggregateFunc) string {
+	return "value_" + string(f)
+}
+
+// rollupName returns the default table name of a rollup
+func rollupName(table string, bucket time.Duration) string {
+	switch {
+	case bucket%(24*time.Hour) == 0:
+		return fmt.Sprintf("%s_%dd", table, bucket/(24*time.Hour))
+	case bucket%time.Hour == 0:
+		return fmt.Sprintf("%s_%dh", table, bucket/time.Hour)
+	case bucket%time.Minute == 0:
+		return fmt.Sprintf("%s_%dm", table, bucket/time.Minute)
+	}
+	return fmt.Sprintf("%s_%ds", table, bucket/time.Second)
+}
+
+// EnableRollup creates the rollup table of table and keeps it up to date on
+// every insert through this handler. Buckets touched by inserted points are
+// recomputed from the table, so late and backfilled points are included.
+// A new rollup table is filled with all points of table, for an existing one
+// only buckets from its newest bucket on are recomputed. Use RefreshRollup
+// for points which were backfilled while the rollup was disabled. The rollup
+// is stored in RollupDefinitionTable and enabled again when the database is
+// opened.
+func (dbh *DbHandler) EnableRollup(table string, rollup Rollup) error {
+	return dbh.EnableRollupContext(context.Background(), table, rollup)
+}
+
+// EnableRollupContext creates and maintains the rollup table, see EnableRollup.
+func (dbh *DbHandler) EnableRollupContext(ctx context.Context, table string, rollup Rollup) error {
+	logFields := log.Fields{"package": logPkg, "func": "EnableRollup"}
+	if len(rollup.Funcs) == 0 {
+		rollup.Funcs = []AggregateFunc{AggregateAvg, AggregateMin, AggregateMax, AggregateCount}
+	}
+	if rollup.Bucket < time.Second || rollup.Bucket%time.Second != 0 {
+		return fmt.Errorf("bucket %v is not a multiple of seconds", rollup.Bucket)
+	}
+	if len(rollup.Name) == 0 {
+		rollup.Name = rollupName(table, rollup.Bucket)
+	}
+	// validates table and funcs
+	if _, err := dbh.aggregateQuery(table, int64(rollup.Bucket/time.Second), rollup.Funcs, false); err != nil {
+		return err
+	}
+	quoted, err := dbh.quoteIdentifier(rollup.Name)
+	if err != nil {
+		return err
+	}
+	tables, err := dbh.listTables(ctx)
+	if err != nil {
+		return err
+	}
+	var newestBucket []time.Time
+	for _, existing := range tables {
+		if strings.EqualFold(existing, rollup.Name) {
+			if newestBucket, err = dbh.timeRange(ctx, rollup.Name); err != nil {
+				return err
+			}
+		}
+	}
+
+	columns := make([]string, 0, len(rollup.Funcs))
+	for _, f := range rollup.Funcs {
+		columns = append(columns, rollupColumn(f)+" DOUBLE PRECISION NULL")
+	}
+	err = dbh.writeToDB(ctx, "CREATE TABLE IF NOT EXISTS "+quoted+" (\n"+
+		"time "+dbh.timestampType()+" NOT NULL,\n"+
+		"tag TEXT NOT NULL,\n"+
+		strings.Join(columns, ",\n")+")")
+	if err != nil {
+		log.WithFields(logFields).Errorf("Failed to create rollup %s: %v", rollup.Name, err)
+		return err
+	}
+	baseName := rollup.Name[strings.LastIndex(rollup.Name, ".")+1:]
+	index, err := dbh.quoteIdentifier(baseName + "_time_tag_key")
+	if err != nil {
+		return err
+	}
+	if err := dbh.writeToDB(ctx, "CREATE UNIQUE INDEX IF NOT EXISTS "+index+" ON "+quoted+" (time, tag)"); err != nil {
+		log.WithFields(logFields).Errorf("Failed to create unique key on %s: %v", rollup.Name, err)
+		return err
+	}
+
+	source, err := dbh.timeRange(ctx, table)
+	if err != nil {
+		return err
+	}
+	if source != nil {
+		from := source[0]
+		if newestBucket != nil {
+			from = newestBucket[1]
+		}
+		if err := dbh.refreshRollup(ctx, table, rollup, from, source[1].Add(time.Nanosecond)); err != nil {
+			return err
+		}
+	}
+
+	if dbh.storesRollups() {
+		funcs := make([]string, 0, len(rollup.Funcs))
+		for _, f := range rollup.Funcs {
+			funcs = append(funcs, string(f))
+		}
+		err := dbh.insertRows(ctx, RollupDefinitionTable,
+			[]string{"table_name", "name", "bucket_seconds", "funcs", "enabled_at"},
+			[][]any{{table, rollup.Name, int64(rollup.Bucket / time.Second), strings.Join(funcs, ","), FormatTimestamp(time.Now())}},
+			"ON CONFLICT (table_name, name) DO UPDATE SET bucket_seconds = excluded.bucket_seconds,"+
+				" funcs = excluded.funcs, enabled_at = excluded.enabled_at")
+		if err != nil {
+			log.WithFields(logFields).Errorf("Failed to store rollup %s: %v", rollup.Name, err)
+			return err
+		}
+	}
+
+	dbh.stateMutex.Lock()
+	defer dbh.stateMutex.Unlock()
+	dbh.addRollup(table, rollup)
+	log.WithFields(logFields).Infof("Enabled rollup %s of %s", rollup.Name, table)
+	return nil
+}
+
+// addRollup replaces the rollup with the same name, stateMutex must be held
+func (dbh *DbHandler) addRollup(table string, rollup Rollup) {
+	if dbh.rollups == nil {
+		dbh.rollups = make(map[string][]Rollup)
+	}
+	rollups := dbh.rollups[table][:0:0]
+	for _, existing := range dbh.rollups[table] {
+		if existing.Name != rollup.Name {
+			rollups = append(rollups, existing)
+		}
+	}
+	dbh.rollups[table] = append(rollups, rollup)
+}
+
+// DisableRollup stops maintaining the rollup with name, the table is kept.
+func (dbh *DbHandler) DisableRollup(table string, name string) error {
+	return dbh.DisableRollupContext(context.Background(), table, name)
+}
+
+// DisableRollupContext stops maintaining the rollup, see DisableRollup.
+func (dbh *DbHandler) DisableRollupContext(ctx context.Context, table string, name string) error {
+	if dbh.storesRollups() {
+		err := dbh.execute(ctx, func() error {
+			_, err := dbh.DB.ExecContext(ctx, "DELETE FROM "+RollupDefinitionTable+
+				" WHERE table_name = "+dbh.placeholder(1)+" AND name = "+dbh.placeholder(2), table, name)
+			return err
+		})
+		if err != nil {
+			log.WithFields(log.Fields{"package": logPkg, "func": "DisableRollup"}).Errorf(
+				"Failed to remove rollup %s: %v", name, err)
+			return err
+		}
+	}
+	dbh.stateMutex.Lock()
+	defer dbh.stateMutex.Unlock()
+	rollups := dbh.rollups[table][:0:0]
+	for _, existing := range dbh.rollups[table] {
+		if existing.Name != name {
+			rollups = append(rollups, existing)
+		}
+	}
+	dbh.rollups[table] = rollups
+	return nil
+}
+
+// loadRollups enables the rollups stored in RollupDefinitionTable
+func (dbh *DbHandler) loadRollups(ctx context.Context) error {
+	if !dbh.storesRollups() {
+		return nil
+	}
+	rows, err := dbh.ExecuteQueryContext(ctx, "SELECT table_name, name, bucket_seconds, funcs FROM "+
+		RollupDefinitionTable+" ORDER BY table_name, name")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	dbh.stateMutex.Lock()
+	defer dbh.stateMutex.Unlock()
+	dbh.rollups = nil
+	for rows.Next() {
+		var table, funcs string
+		var bucket int64
+		rollup := Rollup{}
+		if err := rows.Scan(&table, &rollup.Name, &bucket, &funcs); err != nil {
+			return err
+		}
+		rollup.Bucket = time.Duration(bucket) * time.Second
+		for _, f := range strings.Split(funcs, ",") {
+			rollup.Funcs = append(rollup.Funcs, AggregateFunc(f))
+		}
+		dbh.addRollup(table, rollup)
+	}
+	return rows.Err()
+}
+
+func (dbh *DbHandler) storesRollups() bool {
+	dbh.stateMutex.Lock()
+	defer dbh.stateMutex.Unlock()
+	return dbh.rollupsStored
+}
+
+// Rollups returns the enabled rollups of table with the defaults filled in
+func (dbh *DbHandler) Rollups(table string) []Rollup {
+	dbh.stateMutex.Lock()
+	defer dbh.stateMutex.Unlock()
+	return append([]Rollup(nil), dbh.rollups[table]...)
+}
+
+// RefreshRollup recomputes all buckets of an enabled rollup which overlap
+// [from, to). Buckets are computed from the points in table, buckets without
+// points are kept.
+func (dbh *DbHandler) RefreshRollup(table string, name string, from time.Time, to time.Time) error {
+	return dbh.RefreshRollupContext(context.Background(), table, name, from, to)
+}
+
+// RefreshRollupContext recomputes the buckets in [from, to), see RefreshRollup.
+func (dbh *DbHandler) RefreshRollupContext(ctx context.Context, table string, name string, from time.Time, to time.Time) error {
+	rollup, err := dbh.findRollup(table, name)
+	if err != nil {
+		return err
+	}
+	return dbh.refreshRollup(ctx, table, rollup, from, to)
+}
+
+func (dbh *DbHandler) refreshRollup(ctx context.Context, table string, rollup Rollup, from time.Time, to time.Time) error {
+	quoted, err := dbh.quoteIdentifier(table)
+	if err != nil {
+		return err
+	}
+	from = bucketStart(from, rollup.Bucket)
+	rows, err := dbh.ExecuteQueryContext(ctx, "SELECT DISTINCT tag FROM "+quoted+
+		" WHERE time >= "+dbh.placeholder(1)+" AND time < "+dbh.placeholder(2),
+		FormatTimestamp(from), FormatTimestamp(to))
+	if err != nil {
+		return err
+	}
+	var tags []string
+	for rows.Next() {
+		var tag string
+		if err := rows.Scan(&tag); err != nil {
+			rows.Close()
+			return err
+		}
+		tags = append(tags, tag)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		if err := dbh.refreshRollupBuckets(ctx, table, rollup, tag, from, to); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// QueryRollup reads the buckets of tag in [from, to) from an enabled rollup.
+func (dbh *DbHandler) QueryRollup(table string, name string, tag string, from time.Time, to time.Time) (AggregateResult, error) {
+	return dbh.QueryRollupContext(context.Background(), table, name, tag, from, to)
+}
+
+// QueryRollupContext reads the buckets of tag from a rollup, see QueryRollup.
+func (dbh *DbHandler) QueryRollupContext(ctx context.Context, table string, name string, tag string, from time.Time, to time.Time) (AggregateResult, error) {
+	rollup, err := dbh.findRollup(table, name)
+	if err != nil {
+		return AggregateResult{}, err
+	}
+	result := AggregateResult{Tag: tag, Bucket: rollup.Bucket, Funcs: rollup.Funcs}
+	quoted, err := dbh.quoteIdentifier(rollup.Name)
+	if err != nil {
+		return result, err
+	}
+	columns := make([]string, 0, len(rollup.Funcs))
+	for _, f := range rollup.Funcs {
+		columns = append(columns, rollupColumn(f))
+	}
+	rows, err := dbh.ExecuteQueryContext(ctx, "SELECT time, "+strings.Join(columns, ", ")+" FROM "+quoted+
+		" WHERE tag = "+dbh.placeholder(1)+" AND time >= "+dbh.placeholder(2)+" AND time < "+dbh.placeholder(3)+
+		" ORDER BY time", tag, FormatTimestamp(from), FormatTimestamp(to))
+	if err != nil {
+		log.WithField("package", logPkg).Errorf("Failed to query rollup %s: %v", rollup.Name, err)
+		return result, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var timestamp any
+		values := make([]*float64, len(rollup.Funcs))
+		dest := []any{&timestamp}
+		for i := range values {
+			dest = append(dest, &values[i])
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return result, err
+		}
+		b := Bucket{Values: make([]float64, len(values))}
+		if b.Time, err = scanTime(timestamp); err != nil {
+			return result, err
+		}
+		for i, value := range values {
+			b.Values[i] = math.NaN()
+			if value != nil {
+				b.Values[i] = *value
+			}
+		}
+		result.Buckets = append(result.Buckets, b)
+	}
+	return result, rows.Err()
+}
+
+func (dbh *DbHandler) findRollup(table string, name string) (Rollup, error) {
+	for _, rollup := range dbh.Rollups(table) {
+		if rollup.Name == name {
+			return rollup, nil
+		}
+	}
+	return Rollup{}, fmt.Errorf("rollup %s of %s is not enabled", name, table)
+}
+
+// updateRollups recomputes the buckets touched by points in all rollups of table
+func (dbh *DbHandler) updateRollups(ctx context.Context, table string, points []Point) error {
+	rollups := dbh.Rollups(table)
+	if len(rollups) == 0 {
+		return nil
+	}
+	type timeRange struct{ first, last time.Time }
+	ranges := make(map[string]timeRange)
+	for _, point := range points {
+		r, ok := ranges[point.Tag]
+		if !ok || point.Time.Before(r.first) {
+			r.first = point.Time
+		}
+		if !ok || point.Time.After(r.last) {
+			r.last = point.Time
+		}
+		ranges[point.Tag] = r
+	}
+	for _, rollup := range rollups {
+		for tag, r := range ranges {
+			to := bucketStart(r.last, rollup.Bucket).Add(rollup.Bucket)
+			if err := dbh.refreshRollupBuckets(ctx, table, rollup, tag, r.first, to); err != nil {
+				return fmt.Errorf("failed to update rollup %s: %v", rollup.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// refreshRollupBuckets aggregates tag in the buckets overlapping [from, to)
+// and upserts them into the rollup table.
+func (dbh *DbHandler) refreshRollupBuckets(ctx context.Context, table string, rollup Rollup, tag string, from time.Time, to time.Time) error {
+	result, err := dbh.AggregateContext(ctx, table, tag, bucketStart(from, rollup.Bucket), to, rollup.Bucket, rollup.Funcs...)
+	if err != nil || len(result.Buckets) == 0 {
+		return err
+	}
+	columns := []string{"time", "tag"}
+	updates := make([]string, 0, len(rollup.Funcs))
+	for _, f := range rollup.Funcs {
+		columns = append(columns, rollupColumn(f))
+		updates = append(updates, rollupColumn(f)+" = excluded."+rollupColumn(f))
+	}
+	rows := make([][]any, 0, len(result.Buckets))
+	for _, b := range result.Buckets {
+		row := []any{FormatTimestamp(b.Time), tag}
+		for _, value := range b.Values {
+			if math.IsNaN(value) {
+				row = append(row, nil)
+			} else {
+				row = append(row, value)
+			}
+		}
+		rows = append(rows, row)
+	}
+	return dbh.insertRows(ctx, rollup.Name, columns, rows,
+		"ON CONFLICT (time, tag) DO UPDATE SET "+strings.Join(updates, ", "))
+}
+
+// timeRange returns the first and last timestamp of table, nil if it is empty
+func (dbh *DbHandler) timeRange(ctx context.Context, table string) ([]time.Time, error) {
+	quoted, err := dbh.quoteIdentifier(table)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := dbh.ExecuteQueryContext(ctx, "SELECT min(time), max(time) FROM "+quoted)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return nil, rows.Err()
+	}
+	var first, last any
+	if err := rows.Scan(&first, &last); err != nil {
+		return nil, err
+	}
+	if first == nil || last == nil {
+		return nil, nil
+	}
+	firstTime, err := scanTime(first)
+	if err != nil {
+		return nil, err
+	}
+	lastTime, err := scanTime(last)
+	if err != nil {
+		return nil, err
+	}
+	return []time.Time{firstTime, lastTime}, nil
+}
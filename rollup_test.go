@@ -0,0 +1,135 @@
+package timeseries
+
+import (
+	"math"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRollup(t *testing.T) {
+	t.Parallel()
+	dbh := newTestDbHandler(t)
+	start := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	existing := []Point{
+		{Time: start, Tag: "a", Value: 1},
+		{Time: start.Add(30 * time.Second), Tag: "a", Value: 3},
+		{Time: start.Add(time.Minute), Tag: "b", Value: 10},
+	}
+	if err := dbh.InsertPoints(existing, false, DefaultTimeseriesTable); err != nil {
+		t.Fatalf("Failed to insert: %v", err)
+	}
+	if err := dbh.EnableRollup(DefaultTimeseriesTable, Rollup{Bucket: 1500 * time.Millisecond}); err == nil {
+		t.Errorf("Expected error for bucket which isn't whole seconds")
+	}
+	if err := dbh.EnableRollup(DefaultTimeseriesTable, Rollup{Bucket: time.Minute}); err != nil {
+		t.Fatalf("Failed to enable rollup: %v", err)
+	}
+	hourly := Rollup{Name: "hourly", Bucket: time.Hour, Funcs: []AggregateFunc{AggregateSum, AggregateLast}}
+	if err := dbh.EnableRollup(DefaultTimeseriesTable, hourly); err != nil {
+		t.Fatalf("Failed to enable rollup: %v", err)
+	}
+	rollups := dbh.Rollups(DefaultTimeseriesTable)
+	if len(rollups) != 2 || rollups[0].Name != "measurements_1m" || len(rollups[0].Funcs) != 4 {
+		t.Fatalf("Unexpected rollups %+v", rollups)
+	}
+
+	check := func(name string, rollup string, tag string, expected map[time.Time][]float64) {
+		t.Helper()
+		result, err := dbh.QueryRollup(DefaultTimeseriesTable, rollup, tag, start.Add(-time.Hour), start.Add(time.Hour))
+		if err != nil {
+			t.Fatalf("%s: failed to query rollup: %v", name, err)
+		}
+		if len(result.Buckets) != len(expected) {
+			t.Fatalf("%s: expected %d buckets but got %+v", name, len(expected), result.Buckets)
+		}
+		for _, b := range result.Buckets {
+			values, ok := expected[b.Time]
+			if !ok {
+				t.Errorf("%s: unexpected bucket %+v", name, b)
+				continue
+			}
+			for i, value := range values {
+				if value != b.Values[i] && !(math.IsNaN(value) && math.IsNaN(b.Values[i])) {
+					t.Errorf("%s: expected %v in bucket %v but got %v", name, values, b.Time, b.Values)
+					break
+				}
+			}
+		}
+	}
+	check("backfill", "measurements_1m", "a", map[time.Time][]float64{start: {2, 1, 3, 2}})
+	check("backfill", "hourly", "b", map[time.Time][]float64{start: {10, 10}})
+
+	// a late point, a new bucket and a null value
+	late := []Point{
+		{Time: start.Add(10 * time.Second), Tag: "a", Value: 8},
+		{Time: start.Add(-time.Minute), Tag: "a", Value: 4},
+		{Time: start.Add(2 * time.Minute), Tag: "a", Value: math.NaN()},
+	}
+	if err := dbh.InsertPoints(late, false, DefaultTimeseriesTable); err != nil {
+		t.Fatalf("Failed to insert: %v", err)
+	}
+	check("late data", "measurements_1m", "a", map[time.Time][]float64{
+		start.Add(-time.Minute):    {4, 4, 4, 1},
+		start:                      {4, 1, 8, 3},
+		start.Add(2 * time.Minute): {math.NaN(), math.NaN(), math.NaN(), 0},
+	})
+	check("late data", "hourly", "a", map[time.Time][]float64{
+		start.Add(-time.Hour): {4, 4},
+		start:                 {12, math.NaN()},
+	})
+
+	if err := dbh.RefreshRollup(DefaultTimeseriesTable, "missing", start, start.Add(time.Hour)); err == nil {
+		t.Errorf("Expected error for unknown rollup")
+	}
+	if err := dbh.DisableRollup(DefaultTimeseriesTable, "hourly"); err != nil {
+		t.Fatalf("Failed to disable rollup: %v", err)
+	}
+	if _, err := dbh.QueryRollup(DefaultTimeseriesTable, "hourly", "a", start, start.Add(time.Hour)); err == nil {
+		t.Errorf("Expected error for disabled rollup")
+	}
+}
+
+func TestRollupAfterReopen(t *testing.T) {
+	t.Parallel()
+	conf := GetDefaultDBConfig()
+	conf.IPOrPath = t.TempDir() + string(filepath.Separator)
+	dbh, err := NewDbHandler(conf)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	hourly := Rollup{Name: "hourly", Bucket: time.Hour, Funcs: []AggregateFunc{AggregateSum, AggregateCount}}
+	if err := dbh.EnableRollup(DefaultTimeseriesTable, hourly); err != nil {
+		t.Fatalf("Failed to enable rollup: %v", err)
+	}
+	if err := dbh.EnableRollup(DefaultTimeseriesTable, Rollup{Bucket: time.Minute}); err != nil {
+		t.Fatalf("Failed to enable rollup: %v", err)
+	}
+	if err := dbh.DisableRollup(DefaultTimeseriesTable, "measurements_1m"); err != nil {
+		t.Fatalf("Failed to disable rollup: %v", err)
+	}
+	dbh.Close()
+
+	dbh, err = NewDbHandler(conf)
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	defer dbh.Close()
+	rollups := dbh.Rollups(DefaultTimeseriesTable)
+	if len(rollups) != 1 || rollups[0].Name != "hourly" || rollups[0].Bucket != time.Hour ||
+		len(rollups[0].Funcs) != 2 || rollups[0].Funcs[1] != AggregateCount {
+		t.Fatalf("Expected the hourly rollup after reopening but got %+v", rollups)
+	}
+	start := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	points := []Point{{Time: start, Tag: "a", Value: 1}, {Time: start.Add(time.Minute), Tag: "a", Value: 2}}
+	if err := dbh.InsertPoints(points, false, DefaultTimeseriesTable); err != nil {
+		t.Fatalf("Failed to insert: %v", err)
+	}
+	result, err := dbh.QueryRollup(DefaultTimeseriesTable, "hourly", "a", start, start.Add(time.Hour))
+	if err != nil {
+		t.Fatalf("Failed to query rollup: %v", err)
+	}
+	if len(result.Buckets) != 1 || result.Value(0, AggregateSum) != 3 || result.Value(0, AggregateCount) != 2 {
+		t.Errorf("Expected the rollup to be maintained but got %+v", result.Buckets)
+	}
+}
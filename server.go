@@ -0,0 +1,229 @@
+package timeseries
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultMaxBodySize limits the size of a request body
+const defaultMaxBodySize int64 = 10 << 20
+
+// ServerConfig configures the HTTP server of NewServer
+type ServerConfig struct {
+	Table               string        // timeseries table to write, DefaultTimeseriesTable if empty
+	OnConflictDoNothing bool          // skip points which already exist (needs a unique key)
+	MaxBodySize         int64         // bytes of a request body, 10 MiB if 0
+	Influx              InfluxOptions // line protocol, Table and OnConflictDoNothing of the server if empty
+}
+
+// Server is an http.Handler which writes points received over HTTP through
+// a DbHandler.
+//
+//	POST /write                  JSON batch, see WriteRequest
+//	POST /influx/write           InfluxDB line protocol (v1), see InfluxHandler
+//	POST /influx/api/v2/write    InfluxDB line protocol (v2)
+//	POST /api/v1/write           Prometheus remote write
+//	GET  /metrics                operational metrics of the DbHandler
+//	POST /grafana/...            Grafana JSON datasource, see GrafanaHandler
+type Server struct {
+	dbh  *DbHandler
+	conf ServerConfig
+	mux  *http.ServeMux
+}
+
+// WriteRequest contains the points of one tag in the JSON body of /write,
+// the body is a single WriteRequest or an array of them. It has the JSON
+// form of TimeseriesImportStruct, values can be numbers, strings or null.
+type WriteRequest struct {
+	Tag        string            `json:"Tag"`
+	Timestamps []string          `json:"Timestamps"`
+	Values     []json.RawMessage `json:"Values"`
+	Comments   []string          `json:"Comments"`
+}
+
+// WriteResponse is the JSON response of /write
+type WriteResponse struct {
+	Written int          `json:"Written"`
+	Errors  []PointError `json:"Errors,omitempty"`
+	Error   string       `json:"Error,omitempty"` // the request failed as a whole
+}
+
+// PointError is a rejected point or series of a write request
+type PointError struct {
+	Series int    `json:"Series"` // index of the series in the request
+	Point  int    `json:"Point"`  // index of the point, -1 if the whole series is rejected
+	Error  string `json:"Error"`
+}
+
+// NewServer creates the HTTP handler for dbh.
+func NewServer(dbh *DbHandler, conf ServerConfig) *Server {
+	if len(conf.Table) == 0 {
+		conf.Table = DefaultTimeseriesTable
+	}
+	if conf.MaxBodySize <= 0 {
+		conf.MaxBodySize = defaultMaxBodySize
+	}
+	if len(conf.Influx.Table) == 0 {
+		conf.Influx.Table = conf.Table
+		conf.Influx.OnConflictDoNothing = conf.OnConflictDoNothing
+	}
+	s := &Server{dbh: dbh, conf: conf, mux: http.NewServeMux()}
+	s.mux.HandleFunc("/write", s.handleWrite)
+	s.mux.Handle("/influx/", http.StripPrefix("/influx", s.InfluxHandler()))
+	s.mux.HandleFunc("/api/v1/write", s.handleRemoteWrite)
+	s.mux.Handle("/metrics", dbh.Metrics())
+	s.mux.Handle("/grafana/", http.StripPrefix("/grafana", s.GrafanaHandler()))
+	return s
+}
+
+// ServeHTTP implements http.Handler
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// handleWrite writes a JSON batch. Valid points are written even if others
+// are rejected, the response is 422 with the rejected points then.
+func (s *Server) handleWrite(w http.ResponseWriter, r *http.Request) {
+	logFields := log.Fields{"package": logPkg, "func": "handleWrite"}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeJSON(w, http.StatusMethodNotAllowed, WriteResponse{Error: "only POST is allowed"})
+		return
+	}
+	body := http.MaxBytesReader(w, r.Body, s.conf.MaxBodySize)
+	requests, err := decodeWriteRequests(body)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeJSON(w, http.StatusRequestEntityTooLarge,
+				WriteResponse{Error: fmt.Sprintf("request body is larger than %d bytes", tooLarge.Limit)})
+			return
+		}
+		writeJSON(w, http.StatusBadRequest, WriteResponse{Error: err.Error()})
+		return
+	}
+
+	points, rejected := pointsFromWriteRequests(requests)
+	var response WriteResponse
+	response.Errors = rejected
+	if len(points) > 0 {
+		if err := s.dbh.InsertPointsContext(r.Context(), points, s.conf.OnConflictDoNothing, s.conf.Table); err != nil {
+			log.WithFields(logFields).Errorf("Failed to write %d points: %v", len(points), err)
+			response.Error = "failed to write points"
+			writeJSON(w, http.StatusInternalServerError, response)
+			return
+		}
+		response.Written = len(points)
+	}
+	status := http.StatusOK
+	if len(rejected) > 0 {
+		status = http.StatusUnprocessableEntity
+	}
+	log.WithFields(logFields).Infof("Wrote %d points, rejected %d", response.Written, len(rejected))
+	writeJSON(w, status, response)
+}
+
+// decodeWriteRequests decodes a single WriteRequest or an array of them
+func decodeWriteRequests(body io.Reader) ([]WriteRequest, error) {
+	var raw json.RawMessage
+	if err := json.NewDecoder(body).Decode(&raw); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %w", err)
+	}
+	var requests []WriteRequest
+	trimmed := strings.TrimSpace(string(raw))
+	if strings.HasPrefix(trimmed, "[") {
+		if err := json.Unmarshal(raw, &requests); err != nil {
+			return nil, fmt.Errorf("invalid JSON: %w", err)
+		}
+	} else {
+		var request WriteRequest
+		if err := json.Unmarshal(raw, &request); err != nil {
+			return nil, fmt.Errorf("invalid JSON: %w", err)
+		}
+		requests = append(requests, request)
+	}
+	if len(requests) == 0 {
+		return nil, errors.New("no series in request")
+	}
+	return requests, nil
+}
+
+// pointsFromWriteRequests validates the requests and returns the valid points
+func pointsFromWriteRequests(requests []WriteRequest) ([]Point, []PointError) {
+	var points []Point
+	var rejected []PointError
+	for n, request := range requests {
+		reject := func(index int, format string, args ...any) {
+			rejected = append(rejected, PointError{Series: n, Point: index, Error: fmt.Sprintf(format, args...)})
+		}
+		switch {
+		case len(strings.TrimSpace(request.Tag)) == 0:
+			reject(-1, "missing tag")
+			continue
+		case len(request.Values) != len(request.Timestamps):
+			reject(-1, "%d values for %d timestamps", len(request.Values), len(request.Timestamps))
+			continue
+		case len(request.Comments) > 0 && len(request.Comments) != len(request.Timestamps):
+			reject(-1, "%d comments for %d timestamps", len(request.Comments), len(request.Timestamps))
+			continue
+		}
+		for i, timestamp := range request.Timestamps {
+			t, err := ParseTimestamp(timestamp)
+			if err != nil {
+				reject(i, "invalid timestamp %q", timestamp)
+				continue
+			}
+			value, err := parseJSONValue(request.Values[i])
+			if err != nil {
+				reject(i, "%v", err)
+				continue
+			}
+			point := Point{Time: t, Tag: request.Tag, Value: value}
+			if len(request.Comments) > 0 {
+				point.Comment = request.Comments[i]
+			}
+			points = append(points, point)
+		}
+	}
+	return points, rejected
+}
+
+// parseJSONValue accepts a number, a string with a number, an empty string or
+// null, the last two become NaN (NULL)
+func parseJSONValue(raw json.RawMessage) (float64, error) {
+	var value any
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return 0, err
+	}
+	switch v := value.(type) {
+	case nil:
+		return math.NaN(), nil
+	case float64:
+		return v, nil
+	case string:
+		if isMissingValue(v) {
+			return math.NaN(), nil
+		}
+		number := ParseValue(v)
+		if math.IsNaN(number) {
+			return 0, fmt.Errorf("invalid value %q", v)
+		}
+		return number, nil
+	}
+	return 0, fmt.Errorf("invalid value %s", string(raw))
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.WithFields(log.Fields{"package": logPkg, "func": "writeJSON"}).Warnf("Failed to write response: %v", err)
+	}
+}
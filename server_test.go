@@ -0,0 +1,97 @@
+package timeseries
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func postJSON(t *testing.T, url string, body string) (int, WriteResponse) {
+	t.Helper()
+	resp, err := http.Post(url, "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("Failed to post: %v", err)
+	}
+	defer resp.Body.Close()
+	var response WriteResponse
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	return resp.StatusCode, response
+}
+
+func TestServerWrite(t *testing.T) {
+	t.Parallel()
+	dbh := newTestDbHandler(t)
+	server := httptest.NewServer(NewServer(dbh, ServerConfig{}))
+	defer server.Close()
+
+	status, response := postJSON(t, server.URL+"/write", `{"Tag": "living/temperature",
+		"Timestamps": ["2023-06-01 12:00:00", "2023-06-01T12:00:01Z"], "Values": [20.5, "21"], "Comments": ["", "window open"]}`)
+	if status != http.StatusOK || response.Written != 2 || len(response.Errors) != 0 {
+		t.Errorf("Unexpected response %d %+v", status, response)
+	}
+	start := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	series, err := dbh.ReadSeries(DefaultTimeseriesTable, "living/temperature", start, start.Add(time.Minute))
+	if err != nil {
+		t.Fatalf("Failed to read: %v", err)
+	}
+	if len(series.Points) != 2 || series.Points[1].Value != 21 || series.Points[1].Comment != "window open" {
+		t.Errorf("Unexpected series %+v", series)
+	}
+
+	// valid points are written, invalid ones are reported
+	status, response = postJSON(t, server.URL+"/write", `[
+		{"Tag": "living/humidity", "Timestamps": ["2023-06-01 12:00:00", "yesterday", "2023-06-01 12:00:02"], "Values": [40, 41, "wet"]},
+		{"Tag": "", "Timestamps": ["2023-06-01 12:00:00"], "Values": [1]},
+		{"Tag": "kitchen/humidity", "Timestamps": ["2023-06-01 12:00:00"], "Values": []}]`)
+	expected := []PointError{
+		{Series: 0, Point: 1, Error: `invalid timestamp "yesterday"`},
+		{Series: 0, Point: 2, Error: `invalid value "wet"`},
+		{Series: 1, Point: -1, Error: "missing tag"},
+		{Series: 2, Point: -1, Error: "0 values for 1 timestamps"},
+	}
+	if status != http.StatusUnprocessableEntity || response.Written != 1 || len(response.Errors) != len(expected) {
+		t.Fatalf("Unexpected response %d %+v", status, response)
+	}
+	for i, e := range expected {
+		if response.Errors[i] != e {
+			t.Errorf("Expected %+v but got %+v", e, response.Errors[i])
+		}
+	}
+
+	if status, _ := postJSON(t, server.URL+"/write", `{"Tag": `); status != http.StatusBadRequest {
+		t.Errorf("Expected 400 for invalid JSON but got %d", status)
+	}
+	if status, _ := postJSON(t, server.URL+"/write", `[]`); status != http.StatusBadRequest {
+		t.Errorf("Expected 400 for empty batch but got %d", status)
+	}
+	resp, err := http.Get(server.URL + "/write")
+	if err != nil {
+		t.Fatalf("Failed to get: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405 but got %d", resp.StatusCode)
+	}
+}
+
+func TestServerWriteLimits(t *testing.T) {
+	t.Parallel()
+	dbh := newTestDbHandler(t)
+	server := httptest.NewServer(NewServer(dbh, ServerConfig{Table: "sensors", MaxBodySize: 100}))
+	defer server.Close()
+
+	body := `{"Tag": "a", "Timestamps": ["2023-06-01 12:00:00"], "Values": [1], "Comments": ["` + strings.Repeat("x", 100) + `"]}`
+	if status, _ := postJSON(t, server.URL+"/write", body); status != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected 413 but got %d", status)
+	}
+	// the table doesn't exist
+	status, response := postJSON(t, server.URL+"/write", `{"Tag": "a", "Timestamps": ["2023-06-01 12:00:00"], "Values": [1]}`)
+	if status != http.StatusInternalServerError || response.Written != 0 {
+		t.Errorf("Expected 500 but got %d %+v", status, response)
+	}
+}
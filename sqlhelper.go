@@ -0,0 +1,342 @@
+package timeseries
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// sqliteMaxParams is SQLITE_MAX_VARIABLE_NUMBER of the bundled sqlite
+	sqliteMaxParams int = 32766
+	// postgresMaxParams is the limit of the postgres wire protocol
+	postgresMaxParams int = 65535
+)
+
+// quoteIdentifier returns a table name quoted. Names may be qualified with a
+// schema (schema.table), so a table name can't contain a dot itself.
+func (dbh *DbHandler) quoteIdentifier(name string) (string, error) {
+	parts := strings.Split(name, ".")
+	if len(parts) > 2 {
+		return "", fmt.Errorf("invalid identifier %q", name)
+	}
+	for i, part := range parts {
+		quoted, err := dbh.quoteName(part)
+		if err != nil {
+			return "", fmt.Errorf("invalid identifier %q", name)
+		}
+		parts[i] = quoted
+	}
+	return strings.Join(parts, "."), nil
+}
+
+// quoteIdentifiers quotes all column names with quoteName.
+func (dbh *DbHandler) quoteIdentifiers(names []string) ([]string, error) {
+	quoted := make([]string, len(names))
+	for i, name := range names {
+		q, err := dbh.quoteName(name)
+		if err != nil {
+			return nil, err
+		}
+		quoted[i] = q
+	}
+	return quoted, nil
+}
+
+// quoteName returns a single name quoted, embedded quotes are doubled. Column
+// names from CSV headers may contain spaces, dashes or dots. Postgres folds
+// unquoted names to lower case, so the name is lowered there to stay
+// compatible with tables created by earlier versions of this package.
+func (dbh *DbHandler) quoteName(name string) (string, error) {
+	if len(name) == 0 || strings.ContainsRune(name, 0) {
+		return "", fmt.Errorf("invalid identifier %q", name)
+	}
+	if dbh.conf.UsePostgres {
+		name = strings.ToLower(name)
+	}
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`, nil
+}
+
+// placeholder returns the bind parameter for the n-th argument (starting at 1)
+func (dbh *DbHandler) placeholder(n int) string {
+	if dbh.conf.UsePostgres {
+		return "$" + strconv.Itoa(n)
+	}
+	return "?"
+}
+
+// placeholders returns count comma separated bind parameters starting at first
+func (dbh *DbHandler) placeholders(first int, count int) string {
+	var str strings.Builder
+	for i := 0; i < count; i++ {
+		if i > 0 {
+			str.WriteString(", ")
+		}
+		str.WriteString(dbh.placeholder(first + i))
+	}
+	return str.String()
+}
+
+func (dbh *DbHandler) maxParams() int {
+	if dbh.conf.UsePostgres {
+		return postgresMaxParams
+	}
+	return sqliteMaxParams
+}
+
+func (dbh *DbHandler) timestampType() string {
+	if dbh.conf.UsePostgres {
+		return "TIMESTAMP"
+	}
+	return "DATETIME"
+}
+
+// parseNumber returns val as float64 or nil if it is neither a float nor an
+// integer. NaN is treated as null as well.
+func parseNumber(val string) any {
+	val = strings.TrimSpace(val)
+	if f, err := strconv.ParseFloat(val, 64); err == nil && !math.IsNaN(f) {
+		return f
+	}
+	if i, err := strconv.ParseInt(val, 0, 64); err == nil {
+		return float64(i)
+	}
+	return nil
+}
+
+// isMissingValue reports whether val is empty or NullValue
+func isMissingValue(val string) bool {
+	val = strings.TrimSpace(val)
+	return len(val) == 0 || val == NullValue
+}
+
+// createWideTable creates a table with one column per name. The column type
+// is derived from the samples: numbers (or the marker "float") become REAL,
+// everything else TEXT. withFetched adds the columns of an outbox, an id
+// which is never reused and Fetched.
+func (dbh *DbHandler) createWideTable(ctx context.Context, tableName string, names []string, samples []string, withFetched bool) ([]int, error) {
+	logFields := log.Fields{"package": logPkg, "func": "createWideTable"}
+	table, err := dbh.quoteIdentifier(tableName)
+	if err != nil {
+		return nil, err
+	}
+	columns, err := dbh.quoteIdentifiers(names)
+	if err != nil {
+		return nil, err
+	}
+	var str strings.Builder
+	str.WriteString("CREATE TABLE IF NOT EXISTS " + table + " (")
+	if withFetched {
+		for _, name := range names {
+			if strings.EqualFold(name, "id") {
+				return nil, fmt.Errorf("column id of %s is reserved for the outbox", tableName)
+			}
+		}
+		if dbh.conf.UsePostgres {
+			str.WriteString("id BIGSERIAL PRIMARY KEY, ")
+		} else {
+			str.WriteString("id INTEGER PRIMARY KEY AUTOINCREMENT, ")
+		}
+	}
+	str.WriteString("Timestamp " + dbh.timestampType())
+	columnTypes := make([]int, len(names))
+	for columnNr, column := range columns {
+		sample := strings.TrimSpace(samples[columnNr])
+		if parseNumber(sample) != nil || sample == "float" {
+			str.WriteString(", " + column + " REAL DEFAULT NULL")
+			columnTypes[columnNr] = columnFloatType
+		} else {
+			str.WriteString(", " + column + " TEXT DEFAULT NULL")
+			columnTypes[columnNr] = columnTextType
+			log.WithFields(logFields).Tracef("Is no number: %v", sample)
+		}
+	}
+	if withFetched {
+		str.WriteString(", Fetched INTEGER DEFAULT 0")
+	}
+	str.WriteString(");")
+	if err := dbh.writeToDB(ctx, str.String()); err != nil {
+		log.WithFields(logFields).Errorf("Failed to create table %s: %v", tableName, err)
+		return nil, fmt.Errorf("failed to create table %s: %v", tableName, err)
+	}
+	return columnTypes, nil
+}
+
+// insertRows writes rows into a table with bound parameters. The rows are
+// split into multi-row statements which stay below the parameter limit of the
+// driver and are written in one transaction. suffix is appended to every
+// statement (e.g. "ON CONFLICT DO NOTHING").
+func (dbh *DbHandler) insertRows(ctx context.Context, tableName string, columnNames []string, rows [][]any, suffix string) error {
+	if len(rows) == 0 {
+		return nil
+	}
+	var inserted int64
+	err := dbh.inTransaction(ctx, func(tx *sql.Tx) error {
+		var err error
+		inserted, err = dbh.insertRowsTx(ctx, tx, tableName, columnNames, rows, suffix)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	dbh.metrics.addRowsInserted(tableName, inserted)
+	return nil
+}
+
+// insertRowsTx writes rows like insertRows within tx and returns the number of
+// inserted rows. The caller counts them in the metrics once tx is committed.
+func (dbh *DbHandler) insertRowsTx(ctx context.Context, tx *sql.Tx, tableName string, columnNames []string, rows [][]any, suffix string) (int64, error) {
+	logFields := log.Fields{"package": logPkg, "func": "insertRows"}
+	if len(rows) == 0 {
+		return 0, nil
+	}
+	table, err := dbh.quoteIdentifier(tableName)
+	if err != nil {
+		return 0, err
+	}
+	columns, err := dbh.quoteIdentifiers(columnNames)
+	if err != nil {
+		return 0, err
+	}
+	rowsPerStatement := dbh.maxParams() / len(columns)
+	prefix := "INSERT INTO " + table + " (" + strings.Join(columns, ", ") + ") VALUES "
+	log.WithFields(logFields).Tracef("Insert string: %v", prefix)
+
+	var total int64
+	for start := 0; start < len(rows); start += rowsPerStatement {
+		end := start + rowsPerStatement
+		if end > len(rows) {
+			end = len(rows)
+		}
+		var str strings.Builder
+		str.WriteString(prefix)
+		args := make([]any, 0, (end-start)*len(columns))
+		for i, row := range rows[start:end] {
+			if len(row) != len(columns) {
+				return 0, fmt.Errorf("row %d has %d values for %d columns", start+i, len(row), len(columns))
+			}
+			if i > 0 {
+				str.WriteString(", ")
+			}
+			str.WriteString("(" + dbh.placeholders(len(args)+1, len(row)) + ")")
+			args = append(args, row...)
+		}
+		if len(suffix) > 0 {
+			str.WriteString(" " + suffix)
+		}
+		res, err := tx.ExecContext(ctx, str.String(), args...)
+		if err != nil {
+			log.WithFields(logFields).Errorf("Failed to insert into %s: %v", tableName, err)
+			return 0, err
+		}
+		inserted, err := res.RowsAffected()
+		if err != nil {
+			inserted = int64(end - start)
+		}
+		total += inserted
+	}
+	return total, nil
+}
+
+// inTransaction runs operation exclusively within a transaction which is
+// committed if operation succeeds and rolled back otherwise.
+func (dbh *DbHandler) inTransaction(ctx context.Context, operation func(tx *sql.Tx) error) error {
+	return dbh.execute(ctx, func() error {
+		start := time.Now()
+		defer func() { dbh.metrics.observeQuery("transaction", time.Since(start)) }()
+		tx, err := dbh.DB.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		if err := operation(tx); err != nil {
+			tx.Rollback()
+			return err
+		}
+		return tx.Commit()
+	})
+}
+
+// tableColumn describes a column of an existing table
+type tableColumn struct {
+	Name string
+	Type string // declared type, upper case
+}
+
+// isNumeric reports whether the column stores numbers
+func (c tableColumn) isNumeric() bool {
+	for _, numeric := range []string{"REAL", "DOUBLE", "FLOAT", "INT", "NUMERIC", "DECIMAL"} {
+		if strings.Contains(c.Type, numeric) {
+			return true
+		}
+	}
+	return false
+}
+
+// listTables returns the tables of the database (or current schema for postgres)
+func (dbh *DbHandler) listTables(ctx context.Context) ([]string, error) {
+	sqlStr := "SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%' ORDER BY name"
+	if dbh.conf.UsePostgres {
+		sqlStr = "SELECT table_name FROM information_schema.tables" +
+			" WHERE table_schema = current_schema() AND table_type = 'BASE TABLE' ORDER BY table_name"
+	}
+	rows, err := dbh.ExecuteQueryContext(ctx, sqlStr)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var tables []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		tables = append(tables, name)
+	}
+	return tables, rows.Err()
+}
+
+// tableColumns returns the columns of a table, nothing if it doesn't exist
+func (dbh *DbHandler) tableColumns(ctx context.Context, tableName string) ([]tableColumn, error) {
+	if _, err := dbh.quoteIdentifier(tableName); err != nil {
+		return nil, err
+	}
+	schema := ""
+	if dot := strings.LastIndex(tableName, "."); dot >= 0 {
+		schema = tableName[:dot]
+		tableName = tableName[dot+1:]
+	}
+	var rows *sql.Rows
+	var err error
+	if dbh.conf.UsePostgres {
+		sqlStr := "SELECT column_name, data_type FROM information_schema.columns" +
+			" WHERE table_schema = current_schema() AND table_name = $1 ORDER BY ordinal_position"
+		args := []any{strings.ToLower(tableName)}
+		if len(schema) > 0 {
+			sqlStr = strings.Replace(sqlStr, "current_schema()", "$2", 1)
+			args = append(args, strings.ToLower(schema))
+		}
+		rows, err = dbh.ExecuteQueryContext(ctx, sqlStr, args...)
+	} else {
+		rows, err = dbh.ExecuteQueryContext(ctx, "SELECT name, type FROM pragma_table_info(?) ORDER BY cid", tableName)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var columns []tableColumn
+	for rows.Next() {
+		var column tableColumn
+		if err := rows.Scan(&column.Name, &column.Type); err != nil {
+			return nil, err
+		}
+		column.Type = strings.ToUpper(column.Type)
+		columns = append(columns, column)
+	}
+	return columns, rows.Err()
+}
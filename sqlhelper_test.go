@@ -0,0 +1,110 @@
+package timeseries
+
+import (
+	"context"
+	"testing"
+)
+
+func TestQuoteIdentifier(t *testing.T) {
+	sqlite := &DbHandler{conf: DBConfig{UsePostgres: false}}
+	postgres := &DbHandler{conf: DBConfig{UsePostgres: true}}
+
+	valid := map[string]string{
+		"measurements":        `"measurements"`,
+		"Temperature":         `"Temperature"`,
+		"public.measurements": `"public"."measurements"`,
+		"_x1":                 `"_x1"`,
+	}
+	for name, expected := range valid {
+		quoted, err := sqlite.quoteIdentifier(name)
+		if err != nil {
+			t.Fatalf("Failed to quote %s: %v", name, err)
+		}
+		if quoted != expected {
+			t.Errorf("Expected %s but got %s", expected, quoted)
+		}
+	}
+	quoted, err := postgres.quoteIdentifier("Temperature")
+	if err != nil || quoted != `"temperature"` {
+		t.Errorf("Expected postgres to fold name but got %s (%v)", quoted, err)
+	}
+
+	invalid := []string{"", "a.b.c", ".measurements", "a\x00b"}
+	for _, name := range invalid {
+		if _, err := sqlite.quoteIdentifier(name); err == nil {
+			t.Errorf("Expected %q to be rejected", name)
+		}
+	}
+
+	columns := map[string]string{
+		"room temp":      `"room temp"`,
+		"humidity-%":     `"humidity-%"`,
+		"sensor.temp":    `"sensor.temp"`,
+		`a"b`:            `"a""b"`,
+		"a;DROP TABLE x": `"a;DROP TABLE x"`,
+	}
+	for name, expected := range columns {
+		quoted, err := sqlite.quoteIdentifiers([]string{name})
+		if err != nil {
+			t.Fatalf("Failed to quote %s: %v", name, err)
+		}
+		if quoted[0] != expected {
+			t.Errorf("Expected %s but got %s", expected, quoted[0])
+		}
+	}
+	if _, err := sqlite.quoteIdentifiers([]string{""}); err == nil {
+		t.Errorf("Expected empty column name to be rejected")
+	}
+}
+
+func TestPlaceholders(t *testing.T) {
+	sqlite := &DbHandler{conf: DBConfig{UsePostgres: false}}
+	postgres := &DbHandler{conf: DBConfig{UsePostgres: true}}
+	if p := sqlite.placeholders(4, 3); p != "?, ?, ?" {
+		t.Errorf("Unexpected sqlite placeholders: %s", p)
+	}
+	if p := postgres.placeholders(4, 3); p != "$4, $5, $6" {
+		t.Errorf("Unexpected postgres placeholders: %s", p)
+	}
+}
+
+func TestParseNumber(t *testing.T) {
+	numbers := map[string]float64{"1.5": 1.5, " 42 ": 42, "0x10": 16, "-3e2": -300}
+	for val, expected := range numbers {
+		if n := parseNumber(val); n != expected {
+			t.Errorf("Expected %v for %s but got %v", expected, val, n)
+		}
+	}
+	for _, val := range []string{"", "abc", "1'); DROP TABLE x; --"} {
+		if n := parseNumber(val); n != nil {
+			t.Errorf("Expected nil for %s but got %v", val, n)
+		}
+	}
+}
+
+func TestWideTableWithHeaderNames(t *testing.T) {
+	t.Parallel()
+	dbh := newTestDbHandler(t)
+	names := []string{"room temp", "humidity-%", "sensor.temp", `a"b`}
+	row := ImportRowStruct{Names: names, Timestamp: "2023-01-01 10:00:00", Values: []string{"20", "40", "21", "1"}}
+	if err := dbh.InsertRowToTable("living", row); err != nil {
+		t.Fatalf("Failed to insert row: %v", err)
+	}
+	columns, err := dbh.tableColumns(context.Background(), "living")
+	if err != nil {
+		t.Fatalf("Failed to read columns: %v", err)
+	}
+	found := map[string]bool{}
+	for _, column := range columns {
+		found[column.Name] = true
+	}
+	for _, name := range names {
+		if !found[name] {
+			t.Errorf("Expected column %q but got %v", name, columns)
+		}
+	}
+	var value float64
+	if err := dbh.DB.QueryRow(`SELECT "sensor.temp" FROM living`).Scan(&value); err != nil || value != 21 {
+		t.Errorf("Expected 21 but got %v (%v)", value, err)
+	}
+}
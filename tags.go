@@ -0,0 +1,219 @@
+package timeseries
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// TagCatalogueTable stores the metadata of the tags
+const TagCatalogueTable string = "tags"
+
+// tagCatalogueVersion is the migration which creates the tag catalogue
+const tagCatalogueVersion int = 2
+
+// ErrTagNotFound is returned if a tag is not in the catalogue
+var ErrTagNotFound = errors.New("tag not found")
+
+// TagInfo describes a tag of the timeseries tables
+type TagInfo struct {
+	Tag          string
+	Unit         string
+	Description  string
+	Source       string        // device or service which delivers the values
+	SamplePeriod time.Duration // expected time between two values, 0 if unknown
+	Precision    int           // number of meaningful decimals, -1 if unknown
+}
+
+// TagSummary is a catalogue entry together with the statistics of a table
+type TagSummary struct {
+	TagInfo
+	FirstTime time.Time // zero if there are no points
+	LastTime  time.Time
+	Count     int64
+}
+
+// CreateTag adds a tag to the catalogue, it fails if the tag exists.
+func (dbh *DbHandler) CreateTag(info TagInfo) error {
+	return dbh.CreateTagContext(context.Background(), info)
+}
+
+// CreateTagContext adds a tag to the catalogue, it fails if the tag exists.
+func (dbh *DbHandler) CreateTagContext(ctx context.Context, info TagInfo) error {
+	err := dbh.insertRows(ctx, TagCatalogueTable,
+		[]string{"tag", "unit", "description", "source", "sample_period_ms", "decimals", "created_at"},
+		[][]any{{info.Tag, info.Unit, info.Description, info.Source,
+			info.SamplePeriod.Milliseconds(), info.Precision, FormatTimestamp(time.Now())}}, "")
+	if err != nil {
+		log.WithField("package", logPkg).Errorf("Failed to create tag %s: %v", info.Tag, err)
+		return err
+	}
+	dbh.markTagsKnown([]string{info.Tag})
+	return nil
+}
+
+// GetTag reads a tag from the catalogue, ErrTagNotFound if it doesn't exist.
+func (dbh *DbHandler) GetTag(tag string) (TagInfo, error) {
+	return dbh.GetTagContext(context.Background(), tag)
+}
+
+// GetTagContext reads a tag from the catalogue, ErrTagNotFound if it doesn't exist.
+func (dbh *DbHandler) GetTagContext(ctx context.Context, tag string) (TagInfo, error) {
+	rows, err := dbh.ExecuteQueryContext(ctx, "SELECT tag, unit, description, source, sample_period_ms, decimals"+
+		" FROM "+TagCatalogueTable+" WHERE tag = "+dbh.placeholder(1), tag)
+	if err != nil {
+		return TagInfo{}, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return TagInfo{}, err
+		}
+		return TagInfo{}, fmt.Errorf("%w: %s", ErrTagNotFound, tag)
+	}
+	var info TagInfo
+	var samplePeriod int64
+	if err := rows.Scan(&info.Tag, &info.Unit, &info.Description, &info.Source, &samplePeriod, &info.Precision); err != nil {
+		return TagInfo{}, err
+	}
+	info.SamplePeriod = time.Duration(samplePeriod) * time.Millisecond
+	return info, nil
+}
+
+// UpdateTag overwrites the metadata of a tag, ErrTagNotFound if it doesn't exist.
+func (dbh *DbHandler) UpdateTag(info TagInfo) error {
+	return dbh.UpdateTagContext(context.Background(), info)
+}
+
+// UpdateTagContext overwrites the metadata of a tag, ErrTagNotFound if it doesn't exist.
+func (dbh *DbHandler) UpdateTagContext(ctx context.Context, info TagInfo) error {
+	sqlStr := "UPDATE " + TagCatalogueTable + " SET unit = " + dbh.placeholder(1) +
+		", description = " + dbh.placeholder(2) + ", source = " + dbh.placeholder(3) +
+		", sample_period_ms = " + dbh.placeholder(4) + ", decimals = " + dbh.placeholder(5) +
+		" WHERE tag = " + dbh.placeholder(6)
+	return dbh.execTag(ctx, info.Tag, sqlStr, info.Unit, info.Description, info.Source,
+		info.SamplePeriod.Milliseconds(), info.Precision, info.Tag)
+}
+
+// DeleteTag removes a tag from the catalogue, the points are kept.
+func (dbh *DbHandler) DeleteTag(tag string) error {
+	return dbh.DeleteTagContext(context.Background(), tag)
+}
+
+// DeleteTagContext removes a tag from the catalogue, the points are kept.
+func (dbh *DbHandler) DeleteTagContext(ctx context.Context, tag string) error {
+	err := dbh.execTag(ctx, tag, "DELETE FROM "+TagCatalogueTable+" WHERE tag = "+dbh.placeholder(1), tag)
+	dbh.stateMutex.Lock()
+	delete(dbh.knownTags, tag)
+	dbh.stateMutex.Unlock()
+	return err
+}
+
+// execTag executes a statement which has to change exactly the row of tag
+func (dbh *DbHandler) execTag(ctx context.Context, tag string, sqlStr string, args ...any) error {
+	return dbh.execute(ctx, func() error {
+		res, err := dbh.DB.ExecContext(ctx, sqlStr, args...)
+		if err != nil {
+			log.WithField("package", logPkg).Errorf("Failed to change tag %s: %v", tag, err)
+			return err
+		}
+		affected, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if affected == 0 {
+			return fmt.Errorf("%w: %s", ErrTagNotFound, tag)
+		}
+		return nil
+	})
+}
+
+// ListTags returns the catalogue ordered by tag together with the first and
+// last timestamp and the number of points of each tag in table.
+func (dbh *DbHandler) ListTags(table string) ([]TagSummary, error) {
+	return dbh.ListTagsContext(context.Background(), table)
+}
+
+// ListTagsContext returns the catalogue with statistics of table, see ListTags.
+func (dbh *DbHandler) ListTagsContext(ctx context.Context, table string) ([]TagSummary, error) {
+	quoted, err := dbh.quoteIdentifier(table)
+	if err != nil {
+		return nil, err
+	}
+	sqlStr := "SELECT c.tag, c.unit, c.description, c.source, c.sample_period_ms, c.decimals," +
+		" s.first_time, s.last_time, COALESCE(s.points, 0)" +
+		" FROM " + TagCatalogueTable + " AS c LEFT JOIN (" +
+		"SELECT tag, min(time) AS first_time, max(time) AS last_time, count(*) AS points" +
+		" FROM " + quoted + " GROUP BY tag) AS s ON s.tag = c.tag ORDER BY c.tag"
+	rows, err := dbh.ExecuteQueryContext(ctx, sqlStr)
+	if err != nil {
+		log.WithField("package", logPkg).Errorf("Failed to list tags: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+	var tags []TagSummary
+	for rows.Next() {
+		var summary TagSummary
+		var samplePeriod int64
+		var first, last any
+		err := rows.Scan(&summary.Tag, &summary.Unit, &summary.Description, &summary.Source,
+			&samplePeriod, &summary.Precision, &first, &last, &summary.Count)
+		if err != nil {
+			return nil, err
+		}
+		summary.SamplePeriod = time.Duration(samplePeriod) * time.Millisecond
+		if first != nil && last != nil {
+			if summary.FirstTime, err = scanTime(first); err != nil {
+				return nil, err
+			}
+			if summary.LastTime, err = scanTime(last); err != nil {
+				return nil, err
+			}
+		}
+		tags = append(tags, summary)
+	}
+	return tags, rows.Err()
+}
+
+// registerTags adds unknown tags to the catalogue
+func (dbh *DbHandler) registerTags(ctx context.Context, tags []string) error {
+	dbh.stateMutex.Lock()
+	enabled := dbh.catalogueEnabled
+	var unknown []string
+	seen := make(map[string]bool)
+	for _, tag := range tags {
+		if !dbh.knownTags[tag] && !seen[tag] {
+			seen[tag] = true
+			unknown = append(unknown, tag)
+		}
+	}
+	dbh.stateMutex.Unlock()
+	if !enabled || len(unknown) == 0 {
+		return nil
+	}
+	rows := make([][]any, 0, len(unknown))
+	now := FormatTimestamp(time.Now())
+	for _, tag := range unknown {
+		rows = append(rows, []any{tag, now})
+	}
+	err := dbh.insertRows(ctx, TagCatalogueTable, []string{"tag", "created_at"}, rows, "ON CONFLICT DO NOTHING")
+	if err != nil {
+		return fmt.Errorf("failed to register tags %v: %v", unknown, err)
+	}
+	dbh.markTagsKnown(unknown)
+	return nil
+}
+
+func (dbh *DbHandler) markTagsKnown(tags []string) {
+	dbh.stateMutex.Lock()
+	defer dbh.stateMutex.Unlock()
+	if dbh.knownTags == nil {
+		dbh.knownTags = make(map[string]bool)
+	}
+	for _, tag := range tags {
+		dbh.knownTags[tag] = true
+	}
+}
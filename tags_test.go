@@ -0,0 +1,109 @@
+package timeseries
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestTagCatalogue(t *testing.T) {
+	t.Parallel()
+	dbh := newTestDbHandler(t)
+	info := TagInfo{
+		Tag:          "livingroom/temperature",
+		Unit:         "°C",
+		Description:  "Temperature next to the window",
+		Source:       "esp32-livingroom",
+		SamplePeriod: 30 * time.Second,
+		Precision:    1,
+	}
+	if err := dbh.CreateTag(info); err != nil {
+		t.Fatalf("Failed to create tag: %v", err)
+	}
+	if err := dbh.CreateTag(info); err == nil {
+		t.Errorf("Expected error when creating tag twice")
+	}
+	got, err := dbh.GetTag(info.Tag)
+	if err != nil {
+		t.Fatalf("Failed to get tag: %v", err)
+	}
+	if got != info {
+		t.Errorf("Expected %+v but got %+v", info, got)
+	}
+
+	info.Unit = "K"
+	if err := dbh.UpdateTag(info); err != nil {
+		t.Fatalf("Failed to update tag: %v", err)
+	}
+	if got, _ := dbh.GetTag(info.Tag); got.Unit != "K" {
+		t.Errorf("Expected updated unit but got %+v", got)
+	}
+	if err := dbh.UpdateTag(TagInfo{Tag: "missing"}); !errors.Is(err, ErrTagNotFound) {
+		t.Errorf("Expected ErrTagNotFound but got %v", err)
+	}
+
+	if err := dbh.DeleteTag(info.Tag); err != nil {
+		t.Fatalf("Failed to delete tag: %v", err)
+	}
+	if _, err := dbh.GetTag(info.Tag); !errors.Is(err, ErrTagNotFound) {
+		t.Errorf("Expected ErrTagNotFound but got %v", err)
+	}
+	if err := dbh.DeleteTag(info.Tag); !errors.Is(err, ErrTagNotFound) {
+		t.Errorf("Expected ErrTagNotFound but got %v", err)
+	}
+}
+
+func TestTagRegistration(t *testing.T) {
+	t.Parallel()
+	dbh := newTestDbHandler(t)
+	if err := dbh.CreateTag(TagInfo{Tag: "a", Unit: "W", Precision: 2}); err != nil {
+		t.Fatalf("Failed to create tag: %v", err)
+	}
+	start := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	is := TimeseriesImportStruct{
+		Tag:        "b",
+		Timestamps: []string{FormatTimestamp(start), FormatTimestamp(start.Add(time.Minute))},
+		Values:     []string{"1", "2"},
+	}
+	if err := dbh.InsertTimeseries(is, false, DefaultTimeseriesTable); err != nil {
+		t.Fatalf("Failed to insert: %v", err)
+	}
+	points := []Point{{Time: start.Add(-time.Hour), Tag: "a", Value: 5}}
+	if err := dbh.InsertPoints(points, false, DefaultTimeseriesTable); err != nil {
+		t.Fatalf("Failed to insert: %v", err)
+	}
+	registered, err := dbh.GetTag("b")
+	if err != nil {
+		t.Fatalf("Tag was not registered: %v", err)
+	}
+	if registered.Unit != "" || registered.Precision != -1 {
+		t.Errorf("Expected empty metadata but got %+v", registered)
+	}
+
+	tags, err := dbh.ListTags(DefaultTimeseriesTable)
+	if err != nil {
+		t.Fatalf("Failed to list tags: %v", err)
+	}
+	if len(tags) != 2 {
+		t.Fatalf("Expected 2 tags but got %+v", tags)
+	}
+	if tags[0].Tag != "a" || tags[0].Unit != "W" || tags[0].Count != 1 ||
+		!tags[0].FirstTime.Equal(start.Add(-time.Hour)) || !tags[0].LastTime.Equal(start.Add(-time.Hour)) {
+		t.Errorf("Unexpected summary %+v", tags[0])
+	}
+	if tags[1].Tag != "b" || tags[1].Count != 2 ||
+		!tags[1].FirstTime.Equal(start) || !tags[1].LastTime.Equal(start.Add(time.Minute)) {
+		t.Errorf("Unexpected summary %+v", tags[1])
+	}
+
+	if err := dbh.CreateTag(TagInfo{Tag: "empty", Precision: -1}); err != nil {
+		t.Fatalf("Failed to create tag: %v", err)
+	}
+	tags, err = dbh.ListTags(DefaultTimeseriesTable)
+	if err != nil {
+		t.Fatalf("Failed to list tags: %v", err)
+	}
+	if len(tags) != 3 || tags[2].Count != 0 || !tags[2].FirstTime.IsZero() {
+		t.Errorf("Unexpected summaries %+v", tags)
+	}
+}
@@ -0,0 +1,161 @@
+package timeseries
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// TimeseriesTableOptions configures CreateTimeseriesTableWithOptions
+type TimeseriesTableOptions struct {
+	UniqueKey     bool          // unique (time, tag), needed to deduplicate with ON CONFLICT DO NOTHING
+	TagTimeIndex  bool          // index on (tag, time) for queries by tag
+	Hypertable    bool          // convert into a TimescaleDB hypertable if the extension is available
+	ChunkInterval time.Duration // chunk_time_interval of the hypertable, TimescaleDB default if 0
+	CompressAfter time.Duration // compress chunks older than this, no compression if 0
+}
+
+func GetDefaultTimeseriesTableOptions() TimeseriesTableOptions {
+	return TimeseriesTableOptions{
+		UniqueKey:     true,
+		TagTimeIndex:  true,
+		Hypertable:    true,
+		ChunkInterval: time.Hour * 24 * 7,
+		CompressAfter: 0,
+	}
+}
+
+// HasTimescaleDB reports whether the timescaledb extension is installed.
+// It is always false for sqlite.
+func (dbh *DbHandler) HasTimescaleDB() (bool, error) {
+	return dbh.HasTimescaleDBContext(context.Background())
+}
+
+// HasTimescaleDBContext reports whether the timescaledb extension is installed.
+func (dbh *DbHandler) HasTimescaleDBContext(ctx context.Context) (bool, error) {
+	if !dbh.conf.UsePostgres {
+		return false, nil
+	}
+	dbh.stateMutex.Lock()
+	cached := dbh.timescale
+	dbh.stateMutex.Unlock()
+	if cached != nil {
+		return *cached, nil
+	}
+	rows, err := dbh.ExecuteQueryContext(ctx,
+		"SELECT extversion FROM pg_extension WHERE extname = 'timescaledb'")
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	installed := rows.Next()
+	if installed {
+		var version string
+		if err := rows.Scan(&version); err == nil {
+			log.WithField("package", logPkg).Infof("TimescaleDB %s is installed", version)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return false, err
+	}
+	dbh.stateMutex.Lock()
+	dbh.timescale = &installed
+	dbh.stateMutex.Unlock()
+	return installed, nil
+}
+
+// CreateTimeseriesTableWithOptions creates a table for timeseries values and
+// adds the configured keys and indexes. Hypertable and compression are only
+// applied if TimescaleDB is available, otherwise they are skipped with a warning.
+// Existing tables are upgraded, but creating the unique key fails if the table
+// contains duplicates.
+func (dbh *DbHandler) CreateTimeseriesTableWithOptions(tableName string, opts TimeseriesTableOptions) error {
+	return dbh.CreateTimeseriesTableWithOptionsContext(context.Background(), tableName, opts)
+}
+
+// CreateTimeseriesTableWithOptionsContext is CreateTimeseriesTableWithOptions with a context
+func (dbh *DbHandler) CreateTimeseriesTableWithOptionsContext(ctx context.Context, tableName string, opts TimeseriesTableOptions) error {
+	logFields := log.Fields{"package": logPkg, "func": "CreateTimeseriesTableWithOptions"}
+	if err := dbh.CreateTimeseriesTableContext(ctx, tableName); err != nil {
+		return err
+	}
+	table, err := dbh.quoteIdentifier(tableName)
+	if err != nil {
+		return err
+	}
+	// indexes are created in the schema of the table
+	baseName := tableName[strings.LastIndex(tableName, ".")+1:]
+	if opts.UniqueKey {
+		index, err := dbh.quoteIdentifier(baseName + "_time_tag_key")
+		if err != nil {
+			return err
+		}
+		err = dbh.writeToDB(ctx, "CREATE UNIQUE INDEX IF NOT EXISTS "+index+" ON "+table+" (time, tag)")
+		if err != nil {
+			log.WithFields(logFields).Errorf("Failed to create unique key on %s: %v", tableName, err)
+			return err
+		}
+	}
+	if opts.TagTimeIndex {
+		index, err := dbh.quoteIdentifier(baseName + "_tag_time_idx")
+		if err != nil {
+			return err
+		}
+		err = dbh.writeToDB(ctx, "CREATE INDEX IF NOT EXISTS "+index+" ON "+table+" (tag, time)")
+		if err != nil {
+			log.WithFields(logFields).Errorf("Failed to create index on %s: %v", tableName, err)
+			return err
+		}
+	}
+	if !opts.Hypertable {
+		return nil
+	}
+	hasTimescale, err := dbh.HasTimescaleDBContext(ctx)
+	if err != nil {
+		return err
+	}
+	if !hasTimescale {
+		log.WithFields(logFields).Warnf("TimescaleDB not available, %s stays a plain table", tableName)
+		return nil
+	}
+	return dbh.createHypertable(ctx, tableName, table, opts)
+}
+
+func (dbh *DbHandler) createHypertable(ctx context.Context, tableName string, table string, opts TimeseriesTableOptions) error {
+	logFields := log.Fields{"package": logPkg, "func": "createHypertable"}
+	regclass := strings.ToLower(tableName)
+	return dbh.execute(ctx, func() error {
+		var err error
+		if opts.ChunkInterval > 0 {
+			_, err = dbh.DB.ExecContext(ctx, "SELECT create_hypertable($1::regclass, 'time', "+
+				"chunk_time_interval => make_interval(secs => $2), if_not_exists => TRUE, migrate_data => TRUE)",
+				regclass, opts.ChunkInterval.Seconds())
+		} else {
+			_, err = dbh.DB.ExecContext(ctx, "SELECT create_hypertable($1::regclass, 'time', "+
+				"if_not_exists => TRUE, migrate_data => TRUE)", regclass)
+		}
+		if err != nil {
+			log.WithFields(logFields).Errorf("Failed to create hypertable %s: %v", tableName, err)
+			return err
+		}
+		if opts.CompressAfter <= 0 {
+			return nil
+		}
+		_, err = dbh.DB.ExecContext(ctx, "ALTER TABLE "+table+
+			" SET (timescaledb.compress, timescaledb.compress_segmentby = 'tag')")
+		if err != nil {
+			log.WithFields(logFields).Errorf("Failed to enable compression on %s: %v", tableName, err)
+			return err
+		}
+		_, err = dbh.DB.ExecContext(ctx, "SELECT add_compression_policy($1::regclass, "+
+			"make_interval(secs => $2), if_not_exists => TRUE)",
+			regclass, opts.CompressAfter.Seconds())
+		if err != nil {
+			log.WithFields(logFields).Errorf("Failed to add compression policy to %s: %v", tableName, err)
+			return err
+		}
+		return nil
+	})
+}
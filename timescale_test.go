@@ -0,0 +1,59 @@
+package timeseries
+
+import (
+	"testing"
+)
+
+func TestCreateTimeseriesTableWithOptions(t *testing.T) {
+	t.Parallel()
+	dbh := newTestDbHandler(t)
+	for i := 0; i < 2; i++ {
+		if err := dbh.CreateTimeseriesTableWithOptions(DefaultTimeseriesTable, GetDefaultTimeseriesTableOptions()); err != nil {
+			t.Fatalf("Failed to create table (%d): %v", i, err)
+		}
+	}
+	if hasTimescale, err := dbh.HasTimescaleDB(); err != nil || hasTimescale {
+		t.Errorf("Expected no TimescaleDB on sqlite but got %v (%v)", hasTimescale, err)
+	}
+
+	rows, err := dbh.ExecuteQuery("SELECT name FROM sqlite_master WHERE type = 'index' AND tbl_name = ? ORDER BY name",
+		DefaultTimeseriesTable)
+	if err != nil {
+		t.Fatalf("Failed to read indexes: %v", err)
+	}
+	var indexes []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			t.Fatalf("Failed to scan: %v", err)
+		}
+		indexes = append(indexes, name)
+	}
+	rows.Close()
+	if len(indexes) != 2 || indexes[0] != "measurements_tag_time_idx" || indexes[1] != "measurements_time_tag_key" {
+		t.Errorf("Unexpected indexes %v", indexes)
+	}
+
+	is := TimeseriesImportStruct{
+		Tag:        "temperature",
+		Timestamps: []string{"2023-01-01 10:00:00", "2023-01-01 10:01:00"},
+		Values:     []string{"1", "2"},
+	}
+	for i := 0; i < 2; i++ {
+		if err := dbh.InsertTimeseries(is, true, DefaultTimeseriesTable); err != nil {
+			t.Fatalf("Failed to insert (%d): %v", i, err)
+		}
+	}
+	if err := dbh.InsertTimeseries(is, false, DefaultTimeseriesTable); err == nil {
+		t.Errorf("Expected unique violation")
+	}
+	rows, err = dbh.ExecuteQuery("SELECT count(*) FROM measurements")
+	if err != nil {
+		t.Fatalf("Failed to count: %v", err)
+	}
+	defer rows.Close()
+	var count int
+	if !rows.Next() || rows.Scan(&count) != nil || count != 2 {
+		t.Errorf("Expected duplicates to be skipped but got %d rows", count)
+	}
+}
@@ -0,0 +1,275 @@
+package timeseries
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// UnpivotProgressTable stores up to which timestamp a wide table is converted
+const UnpivotProgressTable string = "unpivot_progress"
+
+// DefaultTagFormat names the tag of a column of a wide table
+const DefaultTagFormat string = "{table}.{column}"
+
+// UnpivotOptions configures Unpivot
+type UnpivotOptions struct {
+	TagFormat           string   // tag of a column with {table} and {column}, DefaultTagFormat if empty
+	Columns             []string // columns to convert, all except Timestamp, id and Fetched if empty
+	TextAsComment       bool     // store text columns as comment of a point without value, else skip them
+	BatchSize           int      // rows per transaction, 1000 if 0
+	OnConflictDoNothing bool     // skip points which already exist (needs a unique key)
+	Restart             bool     // ignore the progress of an earlier run
+}
+
+// UnpivotResult reports what Unpivot converted
+type UnpivotResult struct {
+	Rows           int64    // rows of the wide table
+	Points         int64    // points written into the timeseries table
+	SkippedColumns []string // text columns which were skipped
+	Resumed        bool     // an earlier run was continued
+	LastTimestamp  string   // timestamp of the last converted row
+}
+
+// Unpivot converts a wide table (one column per sensor) into the tag/value
+// format of a timeseries table. Every non-null value becomes a point with
+// the tag given by TagFormat. Rows are converted in batches ordered by
+// timestamp, each batch is committed together with the progress, so an
+// interrupted conversion continues where it stopped.
+func (dbh *DbHandler) Unpivot(wideTable string, timeseriesTable string, opts UnpivotOptions) (UnpivotResult, error) {
+	return dbh.UnpivotContext(context.Background(), wideTable, timeseriesTable, opts)
+}
+
+// UnpivotContext converts a wide table into a timeseries table, see Unpivot.
+func (dbh *DbHandler) UnpivotContext(ctx context.Context, wideTable string, timeseriesTable string, opts UnpivotOptions) (UnpivotResult, error) {
+	logFields := log.Fields{"package": logPkg, "func": "Unpivot"}
+	var result UnpivotResult
+	if len(opts.TagFormat) == 0 {
+		opts.TagFormat = DefaultTagFormat
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 1000
+	}
+	table, err := dbh.quoteIdentifier(wideTable)
+	if err != nil {
+		return result, err
+	}
+	columns, numeric, err := dbh.wideColumns(ctx, wideTable, opts.Columns)
+	if err != nil {
+		return result, err
+	}
+	var selected []string
+	var tags []string
+	var isNumeric []bool
+	for i, column := range columns {
+		if !numeric[i] && !opts.TextAsComment {
+			result.SkippedColumns = append(result.SkippedColumns, column)
+			continue
+		}
+		selected = append(selected, column)
+		tags = append(tags, strings.NewReplacer("{table}", wideTable, "{column}", column).Replace(opts.TagFormat))
+		isNumeric = append(isNumeric, numeric[i])
+	}
+	if len(selected) == 0 {
+		return result, fmt.Errorf("no columns to convert in %s", wideTable)
+	}
+	quoted, err := dbh.quoteIdentifiers(append([]string{"Timestamp"}, selected...))
+	if err != nil {
+		return result, err
+	}
+	if err := dbh.CreateTimeseriesTableContext(ctx, timeseriesTable); err != nil {
+		return result, err
+	}
+
+	progressName := wideTable + ":" + timeseriesTable
+	if !opts.Restart {
+		result.LastTimestamp, err = dbh.unpivotProgress(ctx, progressName)
+		if err != nil {
+			return result, err
+		}
+		result.Resumed = len(result.LastTimestamp) > 0
+	}
+	// the raw text keeps the comparison exact on sqlite
+	position := quoted[0]
+	if !dbh.conf.UsePostgres {
+		position = "CAST(" + quoted[0] + " AS TEXT)"
+	}
+	selectStr := "SELECT " + position + ", " + strings.Join(quoted[1:], ", ") + " FROM " + table
+	suffix := ""
+	if opts.OnConflictDoNothing {
+		suffix = "ON CONFLICT DO NOTHING"
+	}
+
+	for {
+		rows, last, err := dbh.readUnpivotBatch(ctx, selectStr, quoted[0], result.LastTimestamp, len(selected), opts.BatchSize)
+		if err != nil || len(rows) == 0 {
+			return result, err
+		}
+		var points []Point
+		for _, row := range rows {
+			timestamp, err := ParseTimestamp(formatScanned(row[0]))
+			if err != nil {
+				return result, err
+			}
+			for i, value := range row[1:] {
+				if value == nil {
+					continue
+				}
+				point := Point{Time: timestamp, Tag: tags[i], Value: math.NaN()}
+				if isNumeric[i] {
+					point.Value = ParseValue(formatScanned(value))
+				} else {
+					point.Comment = formatScanned(value)
+				}
+				points = append(points, point)
+			}
+		}
+		values := make([][]any, 0, len(points))
+		for _, point := range points {
+			values = append(values, pointRow(point.Tag, point))
+		}
+		var inserted int64
+		err = dbh.inTransaction(ctx, func(tx *sql.Tx) error {
+			var err error
+			inserted, err = dbh.insertRowsTx(ctx, tx, timeseriesTable, []string{"time", "tag", "value", "comment"}, values, suffix)
+			if err != nil {
+				return err
+			}
+			_, err = dbh.insertRowsTx(ctx, tx, UnpivotProgressTable, []string{"name", "last_timestamp", "updated_at"},
+				[][]any{{progressName, last, FormatTimestamp(time.Now())}},
+				"ON CONFLICT (name) DO UPDATE SET last_timestamp = excluded.last_timestamp, updated_at = excluded.updated_at")
+			return err
+		})
+		if err != nil {
+			log.WithFields(logFields).Errorf("Failed to convert %s after %s: %v", wideTable, result.LastTimestamp, err)
+			return result, err
+		}
+		dbh.metrics.addRowsInserted(timeseriesTable, inserted)
+		result.Rows += int64(len(rows))
+		result.Points += int64(len(points))
+		result.LastTimestamp = last
+		log.WithFields(logFields).Infof("Converted %d rows of %s up to %s", result.Rows, wideTable, last)
+		dbh.afterInsert(ctx, timeseriesTable, points)
+	}
+}
+
+// readUnpivotBatch reads the rows after the timestamp last. A batch contains
+// all rows of its last timestamp, so the timestamp can be used as position.
+func (dbh *DbHandler) readUnpivotBatch(ctx context.Context, selectStr string, timestamp string, last string, columns int, batchSize int) ([][]any, string, error) {
+	where := ""
+	var args []any
+	if len(last) > 0 {
+		where = " WHERE " + timestamp + " > " + dbh.placeholder(1)
+		args = append(args, last)
+	}
+	rows, err := dbh.queryRows(ctx, selectStr+where+" ORDER BY "+timestamp+" LIMIT "+strconv.Itoa(batchSize), columns+1, args...)
+	if err != nil || len(rows) == 0 {
+		return nil, "", err
+	}
+	newest := formatScanned(rows[len(rows)-1][0])
+	if len(rows) < batchSize {
+		return rows, newest, nil
+	}
+	// drop the rows of the newest timestamp, they might continue in the next batch
+	complete := rows[:0]
+	for _, row := range rows {
+		if formatScanned(row[0]) != newest {
+			complete = append(complete, row)
+		}
+	}
+	if len(complete) > 0 {
+		return complete, formatScanned(complete[len(complete)-1][0]), nil
+	}
+	// all rows have the same timestamp
+	rows, err = dbh.queryRows(ctx, selectStr+" WHERE "+timestamp+" = "+dbh.placeholder(1), columns+1, rows[0][0])
+	return rows, newest, err
+}
+
+// queryRows reads all rows of a query with the given number of columns
+func (dbh *DbHandler) queryRows(ctx context.Context, sqlStr string, columns int, args ...any) ([][]any, error) {
+	rows, err := dbh.ExecuteQueryContext(ctx, sqlStr, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result [][]any
+	for rows.Next() {
+		values := make([]any, columns)
+		dest := make([]any, columns)
+		for i := range values {
+			dest[i] = &values[i]
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		result = append(result, values)
+	}
+	return result, rows.Err()
+}
+
+// wideColumns returns the requested or all value columns of a wide table
+// and whether they are numeric
+func (dbh *DbHandler) wideColumns(ctx context.Context, wideTable string, requested []string) ([]string, []bool, error) {
+	existing, err := dbh.tableColumns(ctx, wideTable)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(existing) == 0 {
+		return nil, nil, fmt.Errorf("table %s doesn't exist", wideTable)
+	}
+	var columns []string
+	var numeric []bool
+	if len(requested) == 0 {
+		// the id of an outbox isn't a value
+		outbox := false
+		for _, column := range existing {
+			outbox = outbox || strings.EqualFold(column.Name, "Fetched")
+		}
+		for _, column := range existing {
+			if strings.EqualFold(column.Name, "Timestamp") || strings.EqualFold(column.Name, "Fetched") ||
+				(outbox && strings.EqualFold(column.Name, "id")) {
+				continue
+			}
+			columns = append(columns, column.Name)
+			numeric = append(numeric, column.isNumeric())
+		}
+		return columns, numeric, nil
+	}
+	for _, name := range requested {
+		found := false
+		for _, column := range existing {
+			if strings.EqualFold(column.Name, name) {
+				columns = append(columns, column.Name)
+				numeric = append(numeric, column.isNumeric())
+				found = true
+			}
+		}
+		if !found {
+			return nil, nil, fmt.Errorf("column %s doesn't exist in %s", name, wideTable)
+		}
+	}
+	return columns, numeric, nil
+}
+
+// unpivotProgress returns the last converted timestamp, empty if there is none
+func (dbh *DbHandler) unpivotProgress(ctx context.Context, name string) (string, error) {
+	rows, err := dbh.ExecuteQueryContext(ctx, "SELECT last_timestamp FROM "+UnpivotProgressTable+
+		" WHERE name = "+dbh.placeholder(1), name)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+	last := ""
+	if rows.Next() {
+		if err := rows.Scan(&last); err != nil {
+			return "", err
+		}
+	}
+	return last, rows.Err()
+}
@@ -0,0 +1,70 @@
+package timeseries
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestUnpivot(t *testing.T) {
+	t.Parallel()
+	dbh := newTestDbHandler(t)
+	is := ImportStruct{
+		Names:      []string{"Temperature", "Humidity", "Room"},
+		Timestamps: []string{"2023-06-01 12:00:00", "2023-06-01 12:00:01", "2023-06-01 12:00:01", "2023-06-01 12:00:01", "2023-06-01 12:00:02"},
+		Data: [][]string{
+			{"20.5", "21", "22", "", "23"},
+			{"40", "41", "", "43", "44"},
+			{"living", "living", "kitchen", "bath", "living"},
+		},
+	}
+	if err := dbh.InsertIntoDatabase("living", is); err != nil {
+		t.Fatalf("Failed to insert: %v", err)
+	}
+
+	if _, err := dbh.Unpivot("living", DefaultTimeseriesTable, UnpivotOptions{Columns: []string{"Missing"}}); err == nil {
+		t.Errorf("Expected error for missing column")
+	}
+
+	opts := UnpivotOptions{BatchSize: 2}
+	result, err := dbh.Unpivot("living", DefaultTimeseriesTable, opts)
+	if err != nil {
+		t.Fatalf("Failed to unpivot: %v", err)
+	}
+	if result.Rows != 5 || result.Points != 8 || result.Resumed ||
+		!reflect.DeepEqual(result.SkippedColumns, []string{"Room"}) || result.LastTimestamp != "2023-06-01 12:00:02" {
+		t.Errorf("Unexpected result %+v", result)
+	}
+	start := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	series, err := dbh.QueryRange(DefaultTimeseriesTable, []string{"living.Temperature", "living.Humidity"},
+		start, start.Add(time.Minute), QueryOptions{})
+	if err != nil {
+		t.Fatalf("Failed to query: %v", err)
+	}
+	if len(series) != 2 || len(series[0].Points) != 4 || len(series[1].Points) != 4 || series[0].Points[0].Value != 20.5 {
+		t.Errorf("Unexpected series %+v", series)
+	}
+
+	// nothing new to convert, then a new row
+	result, err = dbh.Unpivot("living", DefaultTimeseriesTable, opts)
+	if err != nil || result.Rows != 0 || !result.Resumed {
+		t.Errorf("Expected resumed run without rows but got %+v: %v", result, err)
+	}
+	is = ImportStruct{Names: is.Names, Timestamps: []string{"2023-06-01 12:00:03"}, Data: [][]string{{"24"}, {"45"}, {"bath"}}}
+	if err := dbh.InsertIntoDatabase("living", is); err != nil {
+		t.Fatalf("Failed to insert: %v", err)
+	}
+	opts.TagFormat = "home/{column}"
+	opts.TextAsComment = true
+	result, err = dbh.Unpivot("living", DefaultTimeseriesTable, opts)
+	if err != nil || result.Rows != 1 || result.Points != 3 {
+		t.Errorf("Expected one converted row but got %+v: %v", result, err)
+	}
+	rooms, err := dbh.QueryRange(DefaultTimeseriesTable, []string{"home/Room"}, start, start.Add(time.Minute), QueryOptions{IncludeNulls: true})
+	if err != nil {
+		t.Fatalf("Failed to query: %v", err)
+	}
+	if len(rooms) != 1 || len(rooms[0].Points) != 1 || rooms[0].Points[0].Comment != "bath" {
+		t.Errorf("Expected text column as comment but got %+v", rooms)
+	}
+}